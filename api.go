@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/markdrayton/mijiamon/pkg/sensor"
+)
+
+// apiConfig configures the control API, for automation managing a running
+// instance: listing sensors, adding and removing them, flushing, and changing
+// log levels.
+type apiConfig struct {
+	Listen    string // HTTP address; the API is off if unset
+	Token     string // required, as a bearer token
+	TokenFile string `toml:"token_file"` // read Token from here
+}
+
+// apiSensor describes a sensor in the API's responses.
+type apiSensor struct {
+	Name     string       `json:"name"`
+	MAC      string       `json:"mac"`
+	Type     string       `json:"type,omitempty"`
+	Source   string       `json:"source"` // config, accept_unknown or api
+	LastSeen time.Time    `json:"last_seen"`
+	Reading  *lastReading `json:"reading,omitempty"`
+}
+
+// logLevelsBody is the body of /v1/log-levels: the minimum level and the
+// per-component overrides, where setting "" removes one.
+type logLevelsBody struct {
+	Level  string            `json:"level,omitempty"`
+	Levels map[string]string `json:"levels"`
+}
+
+// serveAPI serves the control API.
+func (c *collector) serveAPI(conf apiConfig) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/sensors", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, c.apiSensors())
+		case http.MethodPost:
+			sc, err := decodeSensorConfig(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s, code, err := c.addSensor(sc)
+			if err != nil {
+				http.Error(w, err.Error(), code)
+				return
+			}
+			writeJSON(w, http.StatusCreated, s)
+		default:
+			http.Error(w, "GET or POST sensors", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/v1/sensors/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/v1/sensors/")
+		switch r.Method {
+		case http.MethodGet:
+			for _, s := range c.apiSensors() {
+				if s.Name == name || s.MAC == strings.ToLower(name) {
+					writeJSON(w, http.StatusOK, s)
+					return
+				}
+			}
+			http.Error(w, fmt.Sprintf("no sensor %s", name), http.StatusNotFound)
+		case http.MethodDelete:
+			if !c.removeSensor(name) {
+				http.Error(w, fmt.Sprintf("no sensor %s", name), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "GET or DELETE a sensor", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/v1/flush", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST flush", http.StatusMethodNotAllowed)
+			return
+		}
+		// not the request's context: outputs are bounded by their timeout,
+		// and a write abandoned halfway would lose readings
+		mainLog.Infof("api: flushing")
+		c.flush(context.Background())
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/v1/log-levels", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var body logLevelsBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := setLogLevels(body.Level, body.Levels); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mainLog.Infof("api: log levels changed")
+		default:
+			http.Error(w, "GET or PUT log-levels", http.StatusMethodNotAllowed)
+			return
+		}
+		level, levels := currentLogLevels()
+		writeJSON(w, http.StatusOK, logLevelsBody{level, levels})
+	})
+	want := []byte("Bearer " + conf.Token)
+	return http.ListenAndServe(conf.Listen, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// decodeSensorConfig decodes a sensor from JSON with the keys of a
+// [[sensors]] entry, by way of TOML so that it's read exactly as the config
+// file would be.
+func decodeSensorConfig(r io.Reader) (sensorConfig, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var m map[string]interface{}
+	if err := dec.Decode(&m); err != nil {
+		return sensorConfig{}, err
+	}
+	var buf bytes.Buffer
+	var sc sensorConfig
+	if err := toml.NewEncoder(&buf).Encode(fromJSON(m, reflect.TypeOf(sc))); err != nil {
+		return sensorConfig{}, err
+	}
+	meta, err := toml.Decode(buf.String(), &sc)
+	if err != nil {
+		return sensorConfig{}, err
+	}
+	if keys := meta.Undecoded(); len(keys) > 0 {
+		return sensorConfig{}, fmt.Errorf("unknown setting %s", keys[0])
+	}
+	return sc, nil
+}
+
+// fromJSON turns the json.Numbers in v, which is being decoded into a t,
+// into floats or integers to suit the fields they're for, as TOML
+// distinguishes them.
+func fromJSON(v interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = fromJSON(e, fieldType(t, k))
+		}
+	case []interface{}:
+		var et reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			et = t.Elem()
+		}
+		for i, e := range x {
+			x[i] = fromJSON(e, et)
+		}
+	case json.Number:
+		if t != nil && (t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64) {
+			f, _ := x.Float64()
+			return f
+		}
+		if n, err := x.Int64(); err == nil {
+			return n
+		}
+		f, _ := x.Float64()
+		return f
+	}
+	return v
+}
+
+// fieldType returns the type of the value under key in a t, matching keys
+// to struct fields as the TOML decoder does, or nil if it's unknown.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous {
+				if ft := fieldType(f.Type, key); ft != nil {
+					return ft
+				}
+				continue
+			}
+			name := f.Tag.Get("toml")
+			if name == "" {
+				name = f.Name
+			}
+			if strings.EqualFold(name, key) {
+				return f.Type
+			}
+		}
+	}
+	return nil
+}
+
+// apiSensors returns the sensors, sorted by name.
+func (c *collector) apiSensors() []apiSensor {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.latestMu.Lock()
+	defer c.latestMu.Unlock()
+	sensors := make([]apiSensor, 0, len(c.sensors))
+	for mac, s := range c.sensors {
+		as := apiSensor{Name: s.Name, MAC: mac, Type: s.Model, Source: "config", LastSeen: s.LastHeard()}
+		switch {
+		case c.accepted[mac]:
+			as.Source = "accept_unknown"
+		case c.added[mac] != nil:
+			as.Source = "api"
+		}
+		if r, ok := c.latest[s.Name]; ok {
+			as.Reading = &r
+		}
+		sensors = append(sensors, as)
+	}
+	sort.Slice(sensors, func(i, j int) bool { return sensors[i].Name < sensors[j].Name })
+	return sensors
+}
+
+// addSensor adds the sensor sc configures, replacing one accept_unknown
+// added for its MAC address, and returns it or an error with the HTTP status
+// describing it.
+func (c *collector) addSensor(sc sensorConfig) (apiSensor, int, error) {
+	mac := strings.ToLower(sc.Mac)
+	if hw, err := net.ParseMAC(mac); err != nil || len(hw) != 6 {
+		return apiSensor{}, http.StatusBadRequest, fmt.Errorf("bad MAC address %q", sc.Mac)
+	}
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sc.Name == "" {
+		var err error
+		if sc.Name, err = sensorName(c.conf, sc); err != nil {
+			return apiSensor{}, http.StatusBadRequest, err
+		}
+	}
+	s, err := newConfiguredSensor(c.conf, sc)
+	if err != nil {
+		return apiSensor{}, http.StatusBadRequest, err
+	}
+	old, ok := c.sensors[mac]
+	if ok && !c.accepted[mac] {
+		return apiSensor{}, http.StatusConflict, fmt.Errorf("sensor %s: MAC address %s is already configured", sc.Name, mac)
+	}
+	for m, o := range c.sensors {
+		if o.Name == sc.Name && m != mac {
+			return apiSensor{}, http.StatusConflict, fmt.Errorf("sensor %s: name is already used by another sensor", sc.Name)
+		}
+	}
+	for _, z := range c.zones {
+		if z.name == sc.Name {
+			return apiSensor{}, http.StatusConflict, fmt.Errorf("sensor %s: name is already used by a zone", sc.Name)
+		}
+	}
+	if ok {
+		s.Adopt(old)
+		delete(c.accepted, mac)
+	}
+	sc.Mac = mac
+	c.added[mac] = &sc
+	c.sensors[mac] = s
+	c.due[mac] = time.Now().Add(s.Interval)
+	c.rpaMu.Lock()
+	c.rpas = make(map[string]string)
+	c.rpaMu.Unlock()
+	select {
+	case c.rescheduled <- struct{}{}:
+	default:
+	}
+	c.outputs.Configure(c.devices())
+	mainLog.Infof("api: adding %s (%s)", s.Name, mac)
+	return apiSensor{Name: s.Name, MAC: mac, Type: s.Model, Source: "api", LastSeen: s.LastHeard()}, 0, nil
+}
+
+// removeSensor removes the sensor with the name or MAC address name,
+// reporting whether there was one.
+func (c *collector) removeSensor(name string) bool {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mac := strings.ToLower(name)
+	s, ok := c.sensors[mac]
+	if !ok {
+		for m, o := range c.sensors {
+			if o.Name == name {
+				mac, s, ok = m, o, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return false
+	}
+	delete(c.sensors, mac)
+	delete(c.accepted, mac)
+	delete(c.added, mac)
+	delete(c.due, mac)
+	c.latestMu.Lock()
+	delete(c.latest, s.Name)
+	c.latestMu.Unlock()
+	c.rpaMu.Lock()
+	c.rpas = make(map[string]string)
+	c.rpaMu.Unlock()
+	c.outputs.Configure(c.devices())
+	mainLog.Infof("api: removing %s (%s)", s.Name, mac)
+	return true
+}
+
+// sensorNamed reports whether one of sensors is called name.
+func sensorNamed(sensors map[string]*sensor.Sensor, name string) bool {
+	for _, s := range sensors {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newConfiguredSensor returns the sensor s configures, outside
+// conf.Sensors.
+func newConfiguredSensor(conf *Config, s sensorConfig) (*sensor.Sensor, error) {
+	agg, err := sensor.NewAggregation(conf.Aggregate, conf.Aggregates, conf.Extremes)
+	if err != nil {
+		return nil, err
+	}
+	return newSensor(conf, s, agg)
+}
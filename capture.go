@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/markdrayton/mijiamon/pkg/sensor"
+)
+
+// btsnoopEpoch is the btsnoop timestamp, in microseconds since midnight on 1
+// January 0 AD, of the Unix epoch.
+const btsnoopEpoch = 0x00dcddb30f2f8000
+
+// A btsnoop writes advertisements to a btsnoop file, as the HCI LE
+// Advertising Report events that would have carried them, for Wireshark.
+type btsnoop struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openCapture(path string) (*btsnoop, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	// version 1, HCI UART (H4) datalink
+	hdr := []byte("btsnoop\x00\x00\x00\x00\x01\x00\x00\x03\xea")
+	if _, err := f.Write(hdr); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &btsnoop{f: f}, nil
+}
+
+// advData rebuilds a's advertising data from the parts go-ble decoded. The
+// order of the AD structures isn't necessarily the original's.
+func advData(a ble.Advertisement) []byte {
+	var b []byte
+	ad := func(typ byte, data ...[]byte) {
+		n := 1
+		for _, d := range data {
+			n += len(d)
+		}
+		b = append(b, byte(n), typ)
+		for _, d := range data {
+			b = append(b, d...)
+		}
+	}
+	if name := a.LocalName(); name != "" {
+		ad(0x09, []byte(name))
+	}
+	for _, sd := range a.ServiceData() {
+		// UUIDs are stored little-endian, as sent
+		switch len(sd.UUID) {
+		case 2:
+			ad(0x16, sd.UUID, sd.Data)
+		case 4:
+			ad(0x20, sd.UUID, sd.Data)
+		default:
+			ad(0x21, sd.UUID, sd.Data)
+		}
+	}
+	if md := a.ManufacturerData(); len(md) > 0 {
+		ad(0xff, md)
+	}
+	return b
+}
+
+// write records a, heard at t.
+func (c *btsnoop) write(a ble.Advertisement, t time.Time) error {
+	data := advData(a)
+	// LE Advertising Report with one report: event type, address type,
+	// address (little-endian), data length, data and RSSI
+	report := []byte{0x02, 0x01, 0x00, 0x00}
+	if !a.Connectable() {
+		report[2] = 0x03 // ADV_NONCONN_IND
+	}
+	hw, _ := net.ParseMAC(a.Addr().String())
+	for i := len(hw) - 1; i >= 0; i-- {
+		report = append(report, hw[i])
+	}
+	report = append(report, byte(len(data)))
+	report = append(report, data...)
+	report = append(report, byte(int8(a.RSSI())))
+	// H4 event packet: LE Meta event
+	pkt := append([]byte{0x04, 0x3e, byte(len(report))}, report...)
+
+	rec := make([]byte, 24, 24+len(pkt))
+	binary.BigEndian.PutUint32(rec[0:], uint32(len(pkt)))
+	binary.BigEndian.PutUint32(rec[4:], uint32(len(pkt)))
+	binary.BigEndian.PutUint32(rec[8:], 0x03) // received event
+	binary.BigEndian.PutUint64(rec[16:], uint64(t.UnixNano()/1000+btsnoopEpoch))
+	rec = append(rec, pkt...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.f.Write(rec)
+	return err
+}
+
+func (c *btsnoop) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.f.Close()
+}
+
+// An unknownDump appends payloads that couldn't be decoded to a file, a line
+// each in the form logged with -log-levels ble=debug, which mijiamon decode
+// reads.
+type unknownDump struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openUnknownDump(path string) (*unknownDump, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &unknownDump{f: f}, nil
+}
+
+func (u *unknownDump) write(s *sensor.Sensor, uuid string, b []byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, err := fmt.Fprintf(u.f, "%s %s %s (%s) UUID: %s, data (len %d): %s\n",
+		time.Now().Format(time.RFC3339), s.Name, s.MAC, s.Model, uuid, len(b), decode.FormatHex(b))
+	if err != nil {
+		mainLog.Errorf("dump-unknown: %s", err)
+	}
+}
+
+func (u *unknownDump) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.f.Close()
+}
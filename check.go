@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/markdrayton/mijiamon/pkg/alert"
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/markdrayton/mijiamon/pkg/output"
+	"github.com/markdrayton/mijiamon/pkg/sensor"
+)
+
+// validate checks conf more thoroughly than loading it does, returning
+// every problem found rather than only the first. It creates nothing and
+// makes no connections.
+func validate(conf *Config) []string {
+	var problems []string
+	add := func(where, format string, a ...interface{}) {
+		problems = append(problems, where+": "+fmt.Sprintf(format, a...))
+	}
+
+	macs := make(map[string]int)
+	names := make(map[string]int)
+	for i, s := range conf.Sensors {
+		where := fmt.Sprintf("sensors[%d]", i)
+		if s.Name != "" {
+			where += fmt.Sprintf(" (%s)", s.Name)
+		}
+		mac := strings.ToLower(s.Mac)
+		if hw, err := net.ParseMAC(mac); err != nil || len(hw) != 6 {
+			add(where, "bad MAC address %q, want e.g. a4:c1:38:12:34:56", s.Mac)
+		} else if j, ok := macs[mac]; ok {
+			add(where, "MAC address %s is also used by sensors[%d]", mac, j)
+		} else {
+			macs[mac] = i
+		}
+		if s.Name == "" {
+			add(where, "no name configured")
+		} else if j, ok := names[s.Name]; ok {
+			add(where, "name is also used by sensors[%d]", j)
+		} else {
+			names[s.Name] = i
+		}
+		types := s.Types
+		if s.Type != "" {
+			types = append([]string{s.Type}, types...)
+		}
+		if auto, err := autoType(types); err != nil {
+			add(where, "%s", err)
+		} else if !auto {
+			for _, t := range types {
+				if _, err := decode.Processors(t); err != nil {
+					add(where, "%s", err)
+				}
+			}
+		}
+		if s.Derived != nil {
+			if err := sensor.CheckDerived(*s.Derived); err != nil {
+				add(where, "%s", err)
+			}
+		}
+		if _, err := output.Resolve(conf.OutputConfig, s.OutputConfig); err != nil {
+			add(where, "%s", err)
+		}
+		if _, ok := s.Tags["name"]; ok {
+			add(where, "tag name is reserved for the sensor's name")
+		}
+		if s.MaxRate != nil && *s.MaxRate < 0 {
+			add(where, "max_rate must not be negative")
+		}
+	}
+	if conf.MaxRate < 0 {
+		add("max_rate", "must not be negative")
+	}
+	if len(problems) == 0 {
+		// catches the remaining per-sensor settings, e.g. bind keys
+		if sensors, err := newSensors(conf); err != nil {
+			add("sensors", "%s", err)
+		} else if _, err := newZones(conf, sensors); err != nil {
+			add("zones", "%s", err)
+		}
+	}
+	if _, ok := conf.Tags["name"]; ok {
+		add("tags", "tag name is reserved for the sensor's name")
+	}
+	if _, err := sensor.NewAggregation(conf.Aggregate, conf.Aggregates, conf.Extremes); err != nil {
+		add("aggregate", "%s", err)
+	}
+	if err := sensor.CheckDerived(conf.Derived); err != nil {
+		add("derived", "%s", err)
+	}
+	for _, u := range []struct{ where, units string }{
+		{"units", conf.Units},
+		{"database.units", conf.Database.Units},
+		{"mqtt.units", conf.MQTT.Units},
+		{"file.units", conf.File.Units},
+		{"stdout.units", conf.Stdout.Units},
+		{"graphite.units", conf.Graphite.Units},
+		{"dashboard.units", conf.Dashboard.Units},
+	} {
+		if err := output.CheckUnits(u.units); err != nil {
+			add(u.where, "%s", err)
+		}
+	}
+	if err := conf.Queue.Check(); err != nil {
+		add("queue", "%s", err)
+	}
+	for name, q := range conf.Queue.Outputs {
+		if err := q.Check(); err != nil {
+			add("queue.outputs."+name, "%s", err)
+		}
+	}
+	if conf.API.Listen != "" && conf.API.Token == "" {
+		add("api", "a token is required")
+	}
+	if (conf.Ingest.Listen != "" || conf.Ingest.UDP != "") && conf.Ingest.Token == "" {
+		add("ingest", "a token is required")
+	}
+	if err := checkScan(conf); err != nil {
+		add("scan", "%s", err)
+	}
+	if _, err := newClock(conf); err != nil {
+		add("clock", "%s", err)
+	}
+	if err := checkInflux(conf); err != nil {
+		add("database", "%s", err)
+	}
+	if conf.RemoteWrite.URL != "" {
+		if _, err := output.NewRemoteWrite(conf.RemoteWrite); err != nil {
+			add("remote_write", "%s", err)
+		}
+	}
+	if conf.Pushgateway.URL != "" {
+		if _, err := output.NewPushgateway(conf.Pushgateway); err != nil {
+			add("pushgateway", "%s", err)
+		}
+	}
+	if conf.Dashboard.Enabled {
+		if _, err := output.NewDashboard(conf.Dashboard); err != nil {
+			add("dashboard", "%s", err)
+		}
+	}
+	if conf.OTLP.URL != "" {
+		if _, err := output.NewOTLP(conf.OTLP); err != nil {
+			add("otlp", "%s", err)
+		}
+	}
+	if conf.NATS.URL != "" {
+		if _, err := output.NewNATS(conf.NATS); err != nil {
+			add("nats", "%s", err)
+		}
+	}
+	if conf.Graphite.Address != "" {
+		if _, err := output.NewGraphite(conf.Graphite); err != nil {
+			add("graphite", "%s", err)
+		}
+	}
+	if conf.Relay.enabled() {
+		if _, err := newRelayer(conf.Relay); err != nil {
+			add("relay", "%s", err)
+		}
+	}
+	if _, err := conf.SQLite.RetentionPeriod(); err != nil {
+		add("sqlite", "%s", err)
+	}
+	if _, err := alert.New(conf.Alerts); err != nil {
+		add("alerts", "%s", err)
+	}
+	if conf.File.Dir != "" {
+		if err := output.CheckFile(conf.File); err != nil {
+			add("file", "%s", err)
+		}
+	}
+	return problems
+}
+
+// runCheckConfig validates the config at path, reporting any problems, and
+// returns whether it's valid.
+func runCheckConfig(path string) bool {
+	var (
+		conf *Config
+		meta toml.MetaData
+		err  error
+	)
+	if envMode {
+		path = "environment"
+		conf, err = loadEnvConfig()
+	} else {
+		conf, meta, err = decodeConfig(path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	for _, key := range meta.Undecoded() {
+		fmt.Fprintf(os.Stderr, "%s: warning: unknown setting %s\n", path, key)
+	}
+	problems := validate(conf)
+	if host := conf.Database.Host; host != "" && checkInflux(conf) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			problems = append(problems, "database: can't resolve host: "+err.Error())
+		}
+	}
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, p)
+	}
+	if len(problems) > 0 {
+		return false
+	}
+	fmt.Printf("%s: OK, %d sensors\n", path, len(conf.Sensors))
+	return true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// heldPoint is a point held until the system clock is synchronised.
+type heldPoint struct {
+	name   string
+	fields decode.Data
+	ts     time.Time
+}
+
+// write writes a point to the outputs, or holds it while waiting for the
+// system clock to be synchronised; c.flushMu must be held.
+func (c *collector) write(ctx context.Context, name string, fields decode.Data, ts time.Time) {
+	if c.waitSync {
+		if len(c.held) >= c.maxHeld {
+			c.held = c.held[1:]
+		}
+		c.held = append(c.held, heldPoint{name, fields, ts})
+		return
+	}
+	if err := c.outputs.Write(ctx, name, fields, ts); err != nil {
+		writeLog.Errorf("write %s: %s", name, err)
+	}
+}
+
+// releaseHeld stops holding points once the system clock is synchronised, or
+// it's given up waiting, and writes those held. Their timestamps are
+// corrected by the monotonic clock, which stepping the system clock doesn't
+// move, as the same time before the present. c.flushMu must be held.
+func (c *collector) releaseHeld(ctx context.Context) {
+	if !c.waitSync {
+		return
+	}
+	synced, err := clockSynced()
+	if err != nil {
+		mainLog.Warnf("clock: checking synchronisation: %s", err)
+	}
+	waited := time.Since(c.syncStart)
+	switch {
+	case synced:
+		mainLog.Infof("clock: synchronised after %s, writing %d held points", waited.Round(time.Second), len(c.held))
+	case err != nil, c.syncTimeout > 0 && waited >= c.syncTimeout:
+		mainLog.Warnf("clock: not synchronised after %s, writing %d held points", waited.Round(time.Second), len(c.held))
+	default:
+		if len(c.held) == 0 {
+			mainLog.Infof("clock: holding points until the system clock is synchronised")
+		}
+		return
+	}
+	c.waitSync = false
+	now := time.Now()
+	for _, p := range c.held {
+		c.write(ctx, p.name, p.fields, now.Add(-now.Sub(p.ts)))
+	}
+	c.held = nil
+}
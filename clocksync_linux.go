@@ -0,0 +1,19 @@
+package main
+
+import "syscall"
+
+// timeError is the adjtimex state TIME_ERROR, returned while the clock is
+// unsynchronised.
+const timeError = 5
+
+// clockSynced reports whether the kernel considers the system clock
+// synchronised, which NTP daemons such as chrony and systemd-timesyncd tell
+// it once they've set the time.
+func clockSynced() (bool, error) {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return false, err
+	}
+	return state != timeError, nil
+}
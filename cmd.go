@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/alert"
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/markdrayton/mijiamon/pkg/output"
+	"github.com/markdrayton/mijiamon/pkg/sensor"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = ""
+
+// command is a subcommand, e.g. mijiamon discover.
+type command struct {
+	name    string
+	summary string
+	args    bool // takes arguments after its flags
+	// flags registers the command's flags, other than the logging ones
+	// every command has.
+	flags func(fs *flag.FlagSet)
+	// run runs the command, returning the exit status.
+	run func(fs *flag.FlagSet) int
+}
+
+var commands = []*command{
+	{
+		name:    "run",
+		summary: "collect readings and write them to the outputs (the default)",
+		flags: func(fs *flag.FlagSet) {
+			configFlags(fs)
+			fs.StringVar(&debugListen, "debug-listen", "", "address for pprof, /debug/vars and /healthz, overriding [debug] listen (default localhost:6060, or off with -env); empty disables")
+			fs.BoolVar(&dryRun, "n", false, "dry run: print the InfluxDB line protocol rather than writing to any outputs")
+			fs.BoolVar(&once, "once", false, "exit after one flush interval")
+			fs.BoolVar(&telegrafMode, "telegraf", false, "run as a Telegraf execd input: print the line protocol to stdout, flushing when Telegraf signals")
+			fs.BoolVar(&passiveScan, "passive", false, "scan passively with every adapter, whatever the config says")
+			fs.StringVar(&captureFile, "capture", "", "write the advertisements heard to this btsnoop file, for Wireshark")
+			fs.StringVar(&dumpUnknown, "dump-unknown", "", "append each distinct payload that couldn't be decoded to this file, in hex")
+			fs.BoolVar(&captureFails, "capture-failed", false, "with -capture, only write configured sensors' advertisements that failed to decode")
+			// before subcommands
+			fs.BoolVar(&discoverMode, "discover", false, "deprecated: use mijiamon discover")
+			fs.BoolVar(&checkConfig, "check-config", false, "deprecated: use mijiamon check-config")
+			fs.DurationVar(&discoverFor, "discover-for", 30*time.Second, "deprecated: use mijiamon discover -for")
+			fs.BoolVar(&discoverTOML, "discover-toml", false, "deprecated: use mijiamon discover -toml")
+		},
+		run: cmdRun,
+	},
+	{
+		name:    "discover",
+		summary: "scan for nearby sensors and exit",
+		flags: func(fs *flag.FlagSet) {
+			fs.DurationVar(&discoverFor, "for", 30*time.Second, "how long to scan")
+			fs.BoolVar(&discoverTOML, "toml", false, "print [[sensors]] config for discovered sensors")
+			fs.BoolVar(&passiveScan, "passive", false, "scan passively")
+		},
+		run: func(*flag.FlagSet) int {
+			if err := runDiscover(); err != nil {
+				mainLog.Errorf("%s", err)
+				return 1
+			}
+			return 0
+		},
+	},
+	{
+		name:    "decode",
+		summary: "decode hex service data given as arguments or on stdin",
+		args:    true,
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&decodeType, "type", "", "sensor type, e.g. LYWSD03MMC; inferred from the UUID if unset")
+			fs.StringVar(&decodeUUID, "uuid", "", "service data UUID, e.g. 181a; each of the type's is tried if unset")
+			fs.StringVar(&decodeBindkey, "bindkey", "", "MiBeacon or BTHome bindkey for encrypted frames")
+			fs.StringVar(&decodeMAC, "mac", "", "the sending device's MAC address, for encrypted BTHome frames and checking custom format ones")
+			fs.BoolVar(&decodeJSON, "json", false, "print the fields as JSON")
+		},
+		run: func(fs *flag.FlagSet) int {
+			if !runDecode(fs.Args()) {
+				return 1
+			}
+			return 0
+		},
+	},
+	{
+		name:    "history",
+		summary: "print readings from the [sqlite] history store",
+		flags: func(fs *flag.FlagSet) {
+			configFlags(fs)
+			fs.StringVar(&historySensor, "sensor", "", "only this sensor's readings")
+			fs.DurationVar(&historySince, "since", 24*time.Hour, "how far back to go")
+			fs.StringVar(&historyField, "field", "", "only this field")
+			fs.BoolVar(&historyJSON, "json", false, "print JSON lines rather than text")
+		},
+		run: func(*flag.FlagSet) int {
+			if err := runHistory(); err != nil {
+				mainLog.Errorf("%s", err)
+				return 1
+			}
+			return 0
+		},
+	},
+	{
+		name:    "check",
+		summary: "check a sensor's reading against thresholds, as a Nagios plugin",
+		flags: func(fs *flag.FlagSet) {
+			configFlags(fs)
+			fs.StringVar(&checkSensor, "sensor", "", "the sensor's name")
+			fs.StringVar(&checkField, "field", "temperature", "the field to check")
+			fs.StringVar(&checkWarn, "warn", "", "warning range, in the Nagios format, e.g. 18:25")
+			fs.StringVar(&checkCrit, "crit", "", "critical range, e.g. 15:28")
+			fs.StringVar(&checkURL, "url", "", "ask the daemon with this debug address, e.g. http://localhost:6060, rather than scanning")
+			fs.DurationVar(&checkFor, "for", 30*time.Second, "how long to scan for a reading")
+			fs.DurationVar(&checkMaxAge, "max-age", 10*time.Minute, "with -url, the oldest reading accepted")
+		},
+		run: func(*flag.FlagSet) int {
+			return runCheck()
+		},
+	},
+	{
+		name:    "sensors",
+		summary: "add a sensor to the config and the running daemon: sensors add -mac ...",
+		args:    true,
+		flags:   sensorsFlags,
+		run: func(fs *flag.FlagSet) int {
+			return runSensors(fs, fs.Args())
+		},
+	},
+	{
+		name:    "check-config",
+		summary: "validate the config and exit",
+		flags:   configFlags,
+		run: func(*flag.FlagSet) int {
+			if !runCheckConfig(configFile) {
+				return 1
+			}
+			return 0
+		},
+	},
+	{
+		name:    "version",
+		summary: "print the version and exit",
+		flags:   func(*flag.FlagSet) {},
+		run: func(*flag.FlagSet) int {
+			fmt.Printf("mijiamon %s %s %s/%s\n", buildVersion(), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+			return 0
+		},
+	},
+}
+
+func configFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configFile, "c", "config.toml", "config file path")
+	fs.BoolVar(&envMode, "env", false, "read the config from MIJIAMON_* environment variables rather than a file")
+}
+
+func logFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&verbose, "v", false, "verbose logging; same as -log-level debug")
+	fs.StringVar(&logLevelFlag, "log-level", "info", "minimum log level: debug, info, warn or error")
+	fs.StringVar(&logLevels, "log-levels", "", "per-component log levels, e.g. ble=debug,write=warn")
+	fs.StringVar(&logFormat, "log-format", "text", "log format: text or json")
+}
+
+// buildVersion returns the version set at build time, or else the module
+// version go install recorded.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: mijiamon [command] [flags]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-13s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun mijiamon <command> -h for its flags.\n")
+}
+
+// findCommand returns the command named by args[0], and the arguments after
+// it. With no command named, as when the first argument is a flag, it's run.
+func findCommand(args []string) (*command, []string) {
+	if len(args) > 0 {
+		for _, c := range commands {
+			if args[0] == c.name {
+				return c, args[1:]
+			}
+		}
+	}
+	return commands[0], args
+}
+
+func cmdRun(fs *flag.FlagSet) int {
+	if checkConfig {
+		if !runCheckConfig(configFile) {
+			return 1
+		}
+		return 0
+	}
+	if discoverMode {
+		if err := runDiscover(); err != nil {
+			mainLog.Errorf("%s", err)
+			return 1
+		}
+		return 0
+	}
+
+	fs.Visit(func(f *flag.Flag) { debugListenSet = debugListenSet || f.Name == "debug-listen" })
+
+	if err := run(); err != nil {
+		mainLog.Errorf("%s", err)
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		usage()
+		return
+	}
+	c, args := findCommand(args)
+	fs := flag.NewFlagSet("mijiamon "+c.name, flag.ExitOnError)
+	c.flags(fs)
+	logFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 && !c.args {
+		fmt.Fprintf(os.Stderr, "mijiamon %s: unexpected argument %s\n", c.name, fs.Arg(0))
+		os.Exit(2)
+	}
+
+	if verbose {
+		logLevelFlag = "debug"
+	}
+	if err := setupLogging(logLevelFlag, logLevels, logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	decode.Log = decodeLog
+	sensor.Log = sensorLog
+	output.Log = writeLog
+	alert.Log = alertLog
+
+	os.Exit(c.run(fs))
+}
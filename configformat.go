@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A config file whose name ends .json or .yaml (or .yml) is read as JSON or
+// YAML, with the same keys and structure as the TOML file, e.g. the sensors
+// as a list of maps under sensors. Like MIJIAMON_CONFIG_JSON, an unknown
+// setting is an error rather than a warning.
+
+// configFormat returns the format of the config at path, by its extension:
+// json, yaml or, for anything else, toml.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "toml"
+}
+
+// decodeJSONConfig decodes b, a JSON config, into v, a pointer to a Config
+// or a struct with some of its fields.
+func decodeJSONConfig(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var j map[string]interface{}
+	if err := dec.Decode(&j); err != nil {
+		return err
+	}
+	return setJSON(reflect.ValueOf(v).Elem(), j, "")
+}
+
+// decodeYAMLConfig decodes b, a YAML config, into v, as decodeJSONConfig.
+func decodeYAMLConfig(b []byte, v interface{}) error {
+	var y interface{}
+	if err := yaml.Unmarshal(b, &y); err != nil {
+		return err
+	}
+	if y == nil {
+		return nil
+	}
+	j, err := fromYAML(y)
+	if err != nil {
+		return err
+	}
+	if _, ok := j.(map[string]interface{}); !ok {
+		return fmt.Errorf("want a mapping of settings")
+	}
+	return setJSON(reflect.ValueOf(v).Elem(), j, "")
+}
+
+// fromYAML turns v, as decoded by the YAML package, into what the JSON
+// decoder would have made of it, for setJSON: maps keyed by strings and
+// numbers as json.Numbers.
+func fromYAML(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v isn't a string", k)
+			}
+			var err error
+			if m[ks], err = fromYAML(e); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(x))
+		for i, e := range x {
+			var err error
+			if l[i], err = fromYAML(e); err != nil {
+				return nil, err
+			}
+		}
+		return l, nil
+	case int, int64, uint64, float64:
+		return json.Number(fmt.Sprint(x)), nil
+	}
+	return v, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// defaultDebugListen is where the debug listener is served unless
+// configured otherwise: only to the host itself, as it has no auth by
+// default.
+const defaultDebugListen = "localhost:6060"
+
+// debugConfig configures the debug listener, which serves pprof,
+// /debug/vars, /healthz, /readyz and /stream.
+type debugConfig struct {
+	Listen   string // defaults to localhost:6060
+	Disabled bool
+	Pprof    *bool  // serve /debug/pprof; defaults to true
+	User     string // require basic auth, if set
+	Pass     string
+	PassFile string `toml:"pass_file"` // read Pass from here
+}
+
+// debugAddr returns the address to serve the debug listener on, or "" if it
+// isn't to be. -debug-listen, if given, takes precedence over the config,
+// and without either it's off with -env, as a container's localhost isn't
+// much use.
+func debugAddr(conf debugConfig) string {
+	if debugListenSet {
+		return debugListen
+	}
+	if conf.Disabled {
+		return ""
+	}
+	if conf.Listen != "" {
+		return conf.Listen
+	}
+	if envMode {
+		return ""
+	}
+	return defaultDebugListen
+}
+
+// serveDebug serves the handlers registered on http.DefaultServeMux at addr,
+// leaving out pprof's if it's disabled.
+func serveDebug(conf debugConfig, addr string) error {
+	pprof := conf.Pprof == nil || *conf.Pprof
+	return http.ListenAndServe(addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conf.User != "" {
+			user, pass, ok := r.BasicAuth()
+			if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(conf.User)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(pass), []byte(conf.Pass)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="mijiamon"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		if !pprof && strings.HasPrefix(r.URL.Path, "/debug/pprof") {
+			http.NotFound(w, r)
+			return
+		}
+		http.DefaultServeMux.ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/markdrayton/mijiamon/pkg/sensor"
+)
+
+var (
+	decodeType    string
+	decodeUUID    string
+	decodeBindkey string
+	decodeMAC     string
+	decodeJSON    bool
+)
+
+// advLogLine matches the advertisements logged with -log-levels ble=debug.
+var advLogLine = regexp.MustCompile(`UUID: ([0-9a-f]{4}), data \(len \d+\): ([0-9a-f ]+)`)
+
+// parsePayload parses a hex payload, e.g. "95 fe 50 20", "95:fe:50:20" or
+// "0x95fe5020", or an advertisement logged by mijiamon, returning the UUID
+// if the line had one.
+func parsePayload(line string) (uuid string, b []byte, err error) {
+	line = strings.TrimSpace(line)
+	if m := advLogLine.FindStringSubmatch(line); m != nil {
+		uuid, line = m[1], m[2]
+	}
+	line = strings.TrimPrefix(strings.ToLower(line), "0x")
+	h := strings.NewReplacer(" ", "", ":", "", "-", "").Replace(line)
+	b, err = hex.DecodeString(h)
+	if err != nil {
+		return "", nil, fmt.Errorf("bad hex payload %q", line)
+	}
+	return uuid, b, nil
+}
+
+// decodePayload decodes service data b and prints the fields. uuid and
+// decodeType are inferred from each other if only one is known; with only
+// the type, each of its processors is tried.
+func decodePayload(w io.Writer, uuid string, b []byte) error {
+	typ := decodeType
+	if typ == "" {
+		if uuid == "" {
+			return errors.New("need -type or -uuid to decode a bare payload")
+		}
+		if typ = decode.InferType(uuid, b); typ == "" {
+			return fmt.Errorf("can't tell the sensor type from UUID %s data; set -type", uuid)
+		}
+	}
+	processors, err := decode.Processors(typ)
+	if err != nil {
+		return err
+	}
+	var mac net.HardwareAddr
+	if decodeMAC != "" {
+		if mac, err = net.ParseMAC(decodeMAC); err != nil || len(mac) != 6 {
+			return fmt.Errorf("bad MAC address %q", decodeMAC)
+		}
+	}
+	if decodeBindkey != "" {
+		key, err := hex.DecodeString(decodeBindkey)
+		if err != nil || len(key) != 16 {
+			return errors.New("bindkey must be 32 hex digits")
+		}
+		processors["fe95"] = decode.NewMiBeacon(key, mac)
+		if _, ok := processors["fcd2"]; ok {
+			processors["fcd2"] = decode.NewBTHome(key, mac)
+		}
+	}
+	uuids := []string{uuid}
+	if uuid == "" {
+		uuids = nil
+		for u := range processors {
+			uuids = append(uuids, u)
+		}
+		sort.Strings(uuids)
+	}
+	s := sensor.New("decode", processors)
+	decoded := false
+	for _, u := range uuids {
+		p, ok := processors[u]
+		if !ok {
+			return fmt.Errorf("type %s doesn't decode UUID %s", typ, u)
+		}
+		if err := decode.Validate(u, b, mac); err != nil {
+			if uuid == "" {
+				continue // trying each UUID
+			}
+			return fmt.Errorf("%s: rejected as %s: %s", decode.FormatHex(b), typ, err)
+		}
+		d := s.Decode(p, u, b)
+		if len(d) == 0 {
+			continue
+		}
+		decoded = true
+		if err := printFields(w, typ, u, d); err != nil {
+			return err
+		}
+	}
+	if !decoded {
+		return fmt.Errorf("%s: no fields decoded as %s", decode.FormatHex(b), typ)
+	}
+	return nil
+}
+
+func printFields(w io.Writer, typ, uuid string, d decode.Data) error {
+	if decodeJSON {
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "%s, UUID %s:\n", typ, uuid)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %s = %v\n", k, d[k])
+	}
+	return nil
+}
+
+// runDecode decodes each payload in args, or each line of stdin if there
+// are none, returning whether all were decoded.
+func runDecode(args []string) bool {
+	ok := true
+	one := func(line string) {
+		uuid, b, err := parsePayload(line)
+		if err == nil {
+			if uuid == "" {
+				uuid = decodeUUID
+			}
+			err = decodePayload(os.Stdout, uuid, b)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			ok = false
+		}
+	}
+	if len(args) > 0 {
+		one(strings.Join(args, " "))
+		return ok
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "" {
+			one(scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return ok
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/darwin"
+)
+
+// newDevice opens the CoreBluetooth central. macOS has a single adapter, so
+// the adapters setting is ignored beyond naming it.
+func newDevice(...ble.Option) (ble.Device, error) {
+	d, err := darwin.NewDevice()
+	if err != nil {
+		return nil, fmt.Errorf("can't create new device: %s", err)
+	}
+	return d, nil
+}
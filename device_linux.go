@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux"
+)
+
+// newDevice opens an HCI device; pass ble.OptDeviceID to pick one other
+// than hci0.
+func newDevice(opts ...ble.Option) (ble.Device, error) {
+	d, err := linux.NewDevice(opts...)
+	if err != nil {
+		if missing := missingCaps(); len(missing) > 0 {
+			return nil, fmt.Errorf("can't create new device: %s; the HCI socket needs %s, so run as root "+
+				"(see the user setting to drop privileges afterwards) or grant them with e.g. "+
+				"setcap cap_net_admin,cap_net_raw+ep or systemd's AmbientCapabilities",
+				err, strings.Join(missing, " and "))
+		}
+		return nil, fmt.Errorf("can't create new device: %s", err)
+	}
+	return d, nil
+}
+
+// hciCaps are the capabilities needed to open an HCI socket, by bit.
+var hciCaps = []struct {
+	bit  uint
+	name string
+}{
+	{12, "CAP_NET_ADMIN"},
+	{13, "CAP_NET_RAW"},
+}
+
+// missingCaps returns the capabilities needed to open an HCI socket that the
+// process doesn't have, or nil if it can't tell.
+func missingCaps() []string {
+	b, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		eff, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return nil
+		}
+		var missing []string
+		for _, c := range hciCaps {
+			if eff&(1<<c.bit) == 0 {
+				missing = append(missing, c.name)
+			}
+		}
+		return missing
+	}
+	return nil
+}
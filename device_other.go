@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+
+	"github.com/go-ble/ble"
+)
+
+// newDevice fails: go-ble has no backend for this platform. Everything but
+// scanning, e.g. check-config, still works.
+func newDevice(...ble.Option) (ble.Device, error) {
+	return nil, errors.New("bluetooth isn't supported on this platform")
+}
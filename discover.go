@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/markdrayton/mijiamon/pkg/sensor"
+)
+
+type discovered struct {
+	mac    string
+	typ    string
+	rssi   int
+	sample decode.Data
+}
+
+// discover scans with d for duration, printing each recognised device when
+// first heard and, if emitTOML is set, a [[sensors]] block for each at the
+// end.
+func discover(ctx context.Context, d ble.Device, duration time.Duration, emitTOML bool) error {
+	var mu sync.Mutex
+	found := make(map[string]*discovered)
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	err := d.Scan(ctx, true, func(a ble.Advertisement) {
+		mac := a.Addr().String()
+		for _, sd := range a.ServiceData() {
+			uuid := sd.UUID.String()
+			typ := decode.InferType(uuid, sd.Data)
+			if typ == "" {
+				continue
+			}
+			processors, err := decode.Processors(typ)
+			if err != nil {
+				continue
+			}
+			s := sensor.New(mac, processors)
+			sample := s.Decode(processors[uuid], uuid, sd.Data)
+
+			mu.Lock()
+			dev, seen := found[mac]
+			if !seen {
+				dev = &discovered{mac: mac, typ: typ}
+				found[mac] = dev
+			}
+			dev.rssi = a.RSSI()
+			// report new devices, and again on their first decoded reading
+			report := !seen || len(sample) > 0 && dev.sample == nil
+			if len(sample) > 0 {
+				dev.sample = sample
+			}
+			rssi := dev.rssi
+			mu.Unlock()
+			if report {
+				fmt.Printf("%s  rssi %d  %s  %v\n", mac, rssi, typ, sample)
+			}
+		}
+	})
+	if err != nil && err != context.DeadlineExceeded && err != context.Canceled {
+		return err
+	}
+
+	if emitTOML {
+		mu.Lock()
+		defer mu.Unlock()
+		macs := make([]string, 0, len(found))
+		for mac := range found {
+			macs = append(macs, mac)
+		}
+		sort.Strings(macs)
+		for _, mac := range macs {
+			dev := found[mac]
+			suffix := strings.Replace(mac[len(mac)-8:], ":", "", -1)
+			name := strings.ToLower(strings.SplitN(dev.typ, "/", 2)[0]) + "-" + suffix
+			fmt.Printf("\n[[sensors]]\nmac = %q\nname = %q\ntype = %q\n", mac, name, dev.typ)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// In -env mode the config comes from the environment: MIJIAMON_CONFIG_JSON
+// holds the whole config as JSON, with the same keys as the TOML file, and
+// MIJIAMON_<SECTION>__<KEY> variables set or override single settings,
+// e.g. MIJIAMON_DATABASE__HOST=influx or MIJIAMON_INTERVAL=30s.
+const (
+	envPrefix     = "MIJIAMON_"
+	envConfigJSON = envPrefix + "CONFIG_JSON"
+)
+
+func loadEnvConfig() (*Config, error) {
+	conf := &Config{}
+	if js := os.Getenv(envConfigJSON); js != "" {
+		dec := json.NewDecoder(strings.NewReader(js))
+		dec.UseNumber()
+		var j map[string]interface{}
+		if err := dec.Decode(&j); err != nil {
+			return nil, fmt.Errorf("%s: %s", envConfigJSON, err)
+		}
+		if err := setJSON(reflect.ValueOf(conf).Elem(), j, ""); err != nil {
+			return nil, fmt.Errorf("%s: %s", envConfigJSON, err)
+		}
+	}
+	for _, kv := range os.Environ() {
+		i := strings.Index(kv, "=")
+		k, v := kv[:i], kv[i+1:]
+		if !strings.HasPrefix(k, envPrefix) || k == envConfigJSON {
+			continue
+		}
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(k, envPrefix)), "__")
+		if err := setConfig(reflect.ValueOf(conf).Elem(), path, v); err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err)
+		}
+	}
+	if err := loadSensorsDir(conf, ""); err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(conf); err != nil {
+		return nil, err
+	}
+	if err := nameSensors(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// setJSON sets v from decoded JSON j, matching object keys to fields by
+// their TOML keys.
+func setJSON(v reflect.Value, j interface{}, path string) error {
+	if j == nil {
+		// null, or an empty YAML value: leave the setting unset
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	switch j := j.(type) {
+	case map[string]interface{}:
+		switch v.Kind() {
+		case reflect.Struct:
+			for k, e := range j {
+				f, ok := configField(v, k)
+				if !ok {
+					return fmt.Errorf("unknown setting %s", join(path, k))
+				}
+				if err := setJSON(f, e, join(path, k)); err != nil {
+					return err
+				}
+			}
+			return nil
+		case reflect.Map:
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			for k, e := range j {
+				ev := reflect.New(v.Type().Elem()).Elem()
+				if err := setJSON(ev, e, join(path, k)); err != nil {
+					return err
+				}
+				v.SetMapIndex(reflect.ValueOf(k), ev)
+			}
+			return nil
+		}
+	case []interface{}:
+		if v.Kind() == reflect.Slice {
+			l := reflect.MakeSlice(v.Type(), len(j), len(j))
+			for i, e := range j {
+				if err := setJSON(l.Index(i), e, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			v.Set(l)
+			return nil
+		}
+	case json.Number:
+		if err := setValue(v, j.String()); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		return nil
+	case string:
+		if err := setValue(v, j); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		return nil
+	case bool:
+		if v.Kind() == reflect.Bool {
+			v.SetBool(j)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: wrong type of value", path)
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+var textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// setConfig sets the setting at path in v, a struct, from the string s.
+func setConfig(v reflect.Value, path []string, s string) error {
+	if v.Kind() == reflect.Map && len(path) == 1 && v.Type().Key().Kind() == reflect.String {
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		e := reflect.New(v.Type().Elem()).Elem()
+		if err := setValue(e, s); err != nil {
+			return err
+		}
+		v.SetMapIndex(reflect.ValueOf(path[0]), e)
+		return nil
+	}
+	if v.Kind() != reflect.Struct {
+		return fmt.Errorf("unknown setting %s", strings.Join(path, "."))
+	}
+	f, ok := configField(v, path[0])
+	if !ok {
+		return fmt.Errorf("unknown setting %s", path[0])
+	}
+	if len(path) > 1 {
+		return setConfig(f, path[1:], s)
+	}
+	return setValue(f, s)
+}
+
+// configField finds the field of struct v with TOML key name, looking into
+// embedded structs as the TOML decoder does.
+func configField(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			if f, ok := configField(v.Field(i), name); ok {
+				return f, true
+			}
+			continue
+		}
+		key := strings.Split(sf.Tag.Get("toml"), ",")[0]
+		if key == "" {
+			key = sf.Name
+		}
+		if strings.EqualFold(key, name) {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func setValue(f reflect.Value, s string) error {
+	if f.Kind() == reflect.Ptr {
+		if f.IsNil() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+		f = f.Elem()
+	}
+	if f.CanAddr() && f.Addr().Type().Implements(textUnmarshaler) {
+		return f.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Slice:
+		// comma-separated
+		var parts []string
+		if s != "" {
+			parts = strings.Split(s, ",")
+		}
+		l := reflect.MakeSlice(f.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setValue(l.Index(i), strings.TrimSpace(p)); err != nil {
+				return err
+			}
+		}
+		f.Set(l)
+	default:
+		return fmt.Errorf("can't be set from the environment")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetConfig(t *testing.T) {
+	passive := true
+	for _, tc := range []struct {
+		name  string
+		env   string // the variable's name, less MIJIAMON_
+		value string
+		want  func(*Config)
+		err   string
+	}{
+		{"duration", "INTERVAL", "30s", func(c *Config) { c.Interval.Duration = 30 * time.Second }, ""},
+		{"duration in seconds", "INTERVAL", "90", func(c *Config) { c.Interval.Duration = 90 * time.Second }, ""},
+		{"section", "DATABASE__HOST", "influx", func(c *Config) { c.Database.Host = "influx" }, ""},
+		{"int", "DATABASE__PORT", "8086", func(c *Config) { c.Database.Port = 8086 }, ""},
+		{"TOML key", "TAG_ADAPTER", "true", func(c *Config) { c.TagAdapter = true }, ""},
+		{"slice", "ADAPTERS", "0, 1", func(c *Config) { c.Adapters = []int{0, 1} }, ""},
+		{"empty slice", "EXTREMES", "", func(c *Config) { c.Extremes = []string{} }, ""},
+		{"map key", "AGGREGATES__TEMPERATURE", "mean", func(c *Config) {
+			c.Aggregates = map[string]string{"temperature": "mean"}
+		}, ""},
+		{"embedded pointer", "SCAN__PASSIVE", "true", func(c *Config) { c.Scan.Passive = &passive }, ""},
+		{"unknown setting", "NOSUCH", "1", nil, "unknown setting nosuch"},
+		{"unknown section setting", "DATABASE__NOSUCH", "1", nil, "unknown setting nosuch"},
+		{"too deep", "DATABASE__HOST__NAME", "influx", nil, "unknown setting name"},
+		{"bad int", "DATABASE__PORT", "http", nil, "invalid syntax"},
+		{"bad duration", "INTERVAL", "soon", nil, "invalid duration"},
+		{"bad slice element", "ADAPTERS", "0,hci1", nil, "invalid syntax"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := &Config{}
+			path := strings.Split(strings.ToLower(tc.env), "__")
+			err := setConfig(reflect.ValueOf(got).Elem(), path, tc.value)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("setConfig(%s) = %v, want an error containing %q", tc.env, err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setConfig(%s) = %s", tc.env, err)
+			}
+			want := &Config{}
+			tc.want(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("setConfig(%s) = %+v, want %+v", tc.env, got, want)
+			}
+		})
+	}
+}
+
+func TestSetJSON(t *testing.T) {
+	passive := true
+	for _, tc := range []struct {
+		name string
+		js   string
+		want func(*Config)
+		err  string
+	}{
+		{"sections", `{"interval": "1m", "database": {"host": "influx", "port": 8086}}`, func(c *Config) {
+			c.Interval.Duration = time.Minute
+			c.Database.Host = "influx"
+			c.Database.Port = 8086
+		}, ""},
+		{"array and bool", `{"adapters": [0, 1], "tag_adapter": true}`, func(c *Config) {
+			c.Adapters = []int{0, 1}
+			c.TagAdapter = true
+		}, ""},
+		{"map", `{"aggregates": {"temperature": "mean"}}`, func(c *Config) {
+			c.Aggregates = map[string]string{"temperature": "mean"}
+		}, ""},
+		{"embedded pointer", `{"scan": {"passive": true}}`, func(c *Config) { c.Scan.Passive = &passive }, ""},
+		{"null", `{"database": null}`, func(c *Config) {}, ""},
+		{"unknown setting", `{"nosuch": 1}`, nil, "unknown setting nosuch"},
+		{"unknown section setting", `{"database": {"nosuch": 1}}`, nil, "unknown setting database.nosuch"},
+		{"wrong type", `{"database": {"port": true}}`, nil, "database.port: wrong type of value"},
+		{"bad array element", `{"adapters": [0, "hci1"]}`, nil, "adapters[1]: "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dec := json.NewDecoder(strings.NewReader(tc.js))
+			dec.UseNumber()
+			var j map[string]interface{}
+			if err := dec.Decode(&j); err != nil {
+				t.Fatal(err)
+			}
+			got := &Config{}
+			err := setJSON(reflect.ValueOf(got).Elem(), j, "")
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("setJSON(%s) = %v, want an error containing %q", tc.js, err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setJSON(%s) = %s", tc.js, err)
+			}
+			want := &Config{}
+			tc.want(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("setJSON(%s) = %+v, want %+v", tc.js, got, want)
+			}
+		})
+	}
+}
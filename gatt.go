@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/markdrayton/mijiamon/pkg/sensor"
+)
+
+const (
+	pollCheck   = 30 * time.Second // how often to look for sensors due a poll
+	pollTimeout = 30 * time.Second // for connecting and reading
+	// how soon setting a clock is tried again after failing
+	syncRetry = 10 * time.Minute
+)
+
+// connect connects to the sensor at mac with d and discovers its
+// characteristics, returning the client and a function finding one by UUID.
+func connect(ctx context.Context, d ble.Device, mac string) (ble.Client, func(string) *ble.Characteristic, error) {
+	cln, err := d.Dial(ctx, ble.NewAddr(mac))
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := cln.DiscoverProfile(true)
+	if err != nil {
+		cln.CancelConnection()
+		return nil, nil, err
+	}
+	find := func(uuid string) *ble.Characteristic {
+		return p.FindCharacteristic(ble.NewCharacteristic(ble.MustParse(uuid)))
+	}
+	return cln, find, nil
+}
+
+// poll connects to the sensor at mac with d and reads its current values.
+func poll(ctx context.Context, d ble.Device, mac string) (decode.Data, error) {
+	ctx, cancel := context.WithTimeout(ctx, pollTimeout)
+	defer cancel()
+	cln, find, err := connect(ctx, d, mac)
+	if err != nil {
+		return nil, err
+	}
+	defer cln.CancelConnection()
+
+	fields := decode.Data{}
+	if c := find(decode.MiTempHumidityChar); c != nil {
+		// notify-only; wait for the next value
+		values := make(chan []byte, 1)
+		err := cln.Subscribe(c, false, func(b []byte) {
+			select {
+			case values <- append([]byte(nil), b...):
+			default:
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case b := <-values:
+			for k, v := range decode.MiTempHumidity(b) {
+				fields[k] = v
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		cln.Unsubscribe(c, false)
+	}
+	for _, r := range []struct {
+		uuid   string
+		decode decode.Processor
+	}{
+		{decode.TemperatureChar, decode.GATTTemperature},
+		{decode.HumidityChar, decode.GATTHumidity},
+		{decode.BatteryChar, decode.GATTBattery},
+		{decode.MiBatteryChar, decode.GATTBattery},
+	} {
+		c := find(r.uuid)
+		if c == nil {
+			continue
+		}
+		b, err := cln.ReadCharacteristic(c)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range r.decode(b) {
+			if _, ok := fields[k]; !ok {
+				fields[k] = v
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("no known characteristics")
+	}
+	return fields, nil
+}
+
+// setTime connects to the LYWSD02 at mac with d and sets its clock to the
+// time now in loc.
+func setTime(ctx context.Context, d ble.Device, mac string, loc *time.Location) error {
+	ctx, cancel := context.WithTimeout(ctx, pollTimeout)
+	defer cancel()
+	cln, find, err := connect(ctx, d, mac)
+	if err != nil {
+		return err
+	}
+	defer cln.CancelConnection()
+	ch := find(decode.LYWSD02TimeChar)
+	if ch == nil {
+		return errors.New("no clock characteristic")
+	}
+	return cln.WriteCharacteristic(ch, decode.LYWSD02Time(time.Now().In(loc)), false)
+}
+
+// pollLoop polls each sensor with polling enabled whose advertisements
+// haven't delivered a reading for its poll interval, and sets the clock of
+// each with sync_time once started and then every sync_time_interval, one
+// at a time, until ctx is cancelled.
+func (c *collector) pollLoop(ctx context.Context, a *adapter) {
+	ticker := time.NewTicker(pollCheck)
+	defer ticker.Stop()
+	lastPolled := make(map[string]time.Time)
+	nextSync := make(map[string]time.Time) // zero for a sensor not yet set
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		c.mu.RLock()
+		var due, syncs []*sensor.Sensor
+		now := time.Now()
+		for mac, s := range c.sensors {
+			if _, ok := lastPolled[mac]; !ok {
+				lastPolled[mac] = now // give advertisements a chance first
+			}
+			if s.Poll > 0 && now.Sub(s.LastReading()) > s.Poll && now.Sub(lastPolled[mac]) > s.Poll && s.Active(now) {
+				due = append(due, s)
+			}
+			if s.SyncTime > 0 && !now.Before(nextSync[mac]) && s.Active(now) {
+				syncs = append(syncs, s)
+			}
+		}
+		c.mu.RUnlock()
+		for _, s := range syncs {
+			d := a.device()
+			if d == nil {
+				break // being reopened
+			}
+			err := setTime(ctx, d, s.MAC, s.TimeZone)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				bleLog.Warnf("%s: setting clock failed: %s", s.Name, err)
+				retry := syncRetry
+				if s.SyncTime < retry {
+					retry = s.SyncTime
+				}
+				nextSync[s.MAC] = time.Now().Add(retry)
+				continue
+			}
+			bleLog.Infof("%s: clock set to %s", s.Name, time.Now().In(s.TimeZone).Format("15:04 MST"))
+			nextSync[s.MAC] = time.Now().Add(s.SyncTime)
+		}
+		for _, s := range due {
+			lastPolled[s.MAC] = time.Now()
+			d := a.device()
+			if d == nil {
+				break // being reopened
+			}
+			fields, err := poll(ctx, d, s.MAC)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				bleLog.Warnf("%s: poll failed: %s", s.Name, err)
+				continue
+			}
+			bleLog.Debugf("%s: polled %+v", s.Name, fields)
+			// the sensor may have been replaced by a reload meanwhile
+			c.mu.RLock()
+			if cur, ok := c.sensors[s.MAC]; ok {
+				cur.Record(fields)
+			}
+			c.mu.RUnlock()
+		}
+	}
+}
@@ -4,7 +4,14 @@ go 1.15
 
 require (
 	github.com/BurntSushi/toml v0.3.1
+	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/go-ble/ble v0.0.0-20200407180624-067514cd6e24
+	github.com/golang/snappy v0.0.3
 	github.com/influxdata/influxdb-client-go/v2 v2.2.2
-	golang.org/x/sys v0.0.0-20200625212154-ddb9806d33ae // indirect
+	github.com/mattn/go-sqlite3 v1.14.7
+	github.com/prometheus/client_golang v1.11.1
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
+	google.golang.org/protobuf v1.26.0-rc.1
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// healthConfig configures the health listener, serving /healthz and
+// /readyz on their own for container probes, apart from the debug listener
+// and its pprof.
+type healthConfig struct {
+	Listen string // e.g. :6061; off if unset
+}
+
+type adapterStatus struct {
+	Scanning          bool      `json:"scanning"`
+	LastAdvertisement time.Time `json:"last_advertisement"`
+}
+
+type sensorStatus struct {
+	LastSeen        time.Time    `json:"last_seen"`
+	AgeSecs         float64      `json:"age_secs"`
+	BatteryDaysLeft *float64     `json:"battery_days_left,omitempty"`
+	Reading         *lastReading `json:"reading,omitempty"`
+}
+
+// lastReading is the last point written for a sensor.
+type lastReading struct {
+	Time   time.Time   `json:"time"`
+	Fields decode.Data `json:"fields"`
+}
+
+type influxStatus struct {
+	LastWrite time.Time `json:"last_write"`
+	Buffered  int       `json:"buffered"`
+}
+
+type status struct {
+	Healthy   bool                     `json:"healthy"` // the flush loop is running
+	Ready     bool                     `json:"ready"`   // at least one adapter is scanning
+	LastFlush time.Time                `json:"last_flush"`
+	Adapters  map[string]adapterStatus `json:"adapters"`
+	Sensors   map[string]sensorStatus  `json:"sensors"`
+	InfluxDB  *influxStatus            `json:"influxdb,omitempty"`
+}
+
+func (c *collector) status() status {
+	now := time.Now()
+	st := status{
+		LastFlush: time.Unix(0, atomic.LoadInt64(&c.lastFlush)),
+		Adapters:  make(map[string]adapterStatus),
+		Sensors:   make(map[string]sensorStatus),
+	}
+	// a flush is due every interval; allow one to be missed
+	st.Healthy = now.Sub(st.LastFlush) < 2*c.interval
+	for _, a := range c.adapters {
+		scanning := atomic.LoadInt32(&a.scanning) == 1
+		st.Ready = st.Ready || scanning
+		st.Adapters[a.name] = adapterStatus{scanning, time.Unix(0, atomic.LoadInt64(&a.lastAdv))}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, s := range c.sensors {
+		t := s.LastHeard()
+		ss := sensorStatus{LastSeen: t, AgeSecs: now.Sub(t).Round(time.Second).Seconds()}
+		if days, ok := s.BatteryDaysLeft(); ok {
+			ss.BatteryDaysLeft = &days
+		}
+		c.latestMu.Lock()
+		if r, ok := c.latest[s.Name]; ok {
+			ss.Reading = &r
+		}
+		c.latestMu.Unlock()
+		st.Sensors[s.Name] = ss
+	}
+	if c.influx != nil {
+		st.InfluxDB = &influxStatus{c.influx.LastWrite(), c.influx.Buffered()}
+	}
+	return st
+}
+
+func writeStatus(w http.ResponseWriter, st status, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(st)
+}
+
+// serveHealth answers liveness probes on /healthz, failing if readings have
+// stopped being flushed.
+func (c *collector) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	st := c.status()
+	writeStatus(w, st, st.Healthy)
+}
+
+// serveHealthListener serves /healthz and /readyz, and nothing else, at
+// addr.
+func (c *collector) serveHealthListener(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", c.serveHealth)
+	mux.HandleFunc("/readyz", c.serveReady)
+	return http.ListenAndServe(addr, mux)
+}
+
+// serveReady answers readiness probes on /readyz, failing until an adapter
+// is scanning.
+func (c *collector) serveReady(w http.ResponseWriter, _ *http.Request) {
+	st := c.status()
+	writeStatus(w, st, st.Ready)
+}
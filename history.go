@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/markdrayton/mijiamon/pkg/output"
+)
+
+var (
+	historySensor string
+	historySince  time.Duration
+	historyField  string
+	historyJSON   bool
+)
+
+// runHistory prints the readings stored in the config's SQLite database.
+func runHistory() error {
+	var conf *Config
+	var err error
+	if envMode {
+		conf, err = loadEnvConfig()
+	} else {
+		conf, err = loadConfig(configFile)
+	}
+	if err != nil {
+		return err
+	}
+	if conf.SQLite.Path == "" {
+		return errors.New("no [sqlite] path configured")
+	}
+	if _, err := os.Stat(conf.SQLite.Path); err != nil {
+		return err
+	}
+	db, err := output.NewSQLite(conf.SQLite)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	defer db.Close(ctx)
+
+	rows, err := db.History(ctx, historySensor, time.Now().Add(-historySince))
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 && historySensor != "" {
+		names, err := db.Names(ctx)
+		if err == nil {
+			return fmt.Errorf("no readings from %s in the last %s; sensors stored: %s",
+				historySensor, historySince, strings.Join(names, ", "))
+		}
+	}
+	out := output.NewJSON(os.Stdout)
+	for _, r := range rows {
+		fields := r.Fields
+		if historyField != "" {
+			v, ok := fields[historyField]
+			if !ok {
+				continue
+			}
+			fields = decode.Data{historyField: v}
+		}
+		if historyJSON {
+			if err := out.Write(ctx, r.Name, fields, r.Time); err != nil {
+				return err
+			}
+			continue
+		}
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, k := range keys {
+			pairs[i] = fmt.Sprintf("%s=%v", k, fields[k])
+		}
+		fmt.Printf("%s  %s  %s\n", r.Time.Format(time.RFC3339), r.Name, strings.Join(pairs, " "))
+	}
+	return nil
+}
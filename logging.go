@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func parseLevel(s string) (logLevel, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s", s)
+}
+
+// logger writes leveled messages for one component, so that e.g. the
+// per-advertisement debug messages from ble can be enabled on their own.
+type logger struct {
+	component string
+}
+
+var (
+	mainLog   = &logger{"main"}
+	bleLog    = &logger{"ble"}    // scanning and advertisements
+	decodeLog = &logger{"decode"} // payload decoding
+	sensorLog = &logger{"sensor"} // sensor state, e.g. going stale
+	writeLog  = &logger{"write"}  // InfluxDB and the other outputs
+	alertLog  = &logger{"alert"}  // alerts firing and notifications
+)
+
+var logging = struct {
+	mu     sync.Mutex
+	out    io.Writer
+	json   bool
+	level  logLevel
+	levels map[string]logLevel // per component, overriding level
+	text   *log.Logger
+}{
+	out:   os.Stderr,
+	level: levelInfo,
+	text:  log.New(os.Stderr, "", log.Ldate|log.Lmicroseconds),
+}
+
+// setupLogging applies the -log-* flags. levels is a comma-separated list of
+// component=level pairs.
+func setupLogging(level, levels, format string) error {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	l, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	logging.level = l
+	logging.levels = make(map[string]logLevel)
+	for _, kv := range strings.Split(levels, ",") {
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return fmt.Errorf("bad log level %q, want component=level", kv)
+		}
+		l, err := parseLevel(kv[i+1:])
+		if err != nil {
+			return err
+		}
+		logging.levels[kv[:i]] = l
+	}
+	switch format {
+	case "text":
+		logging.json = false
+	case "json":
+		logging.json = true
+	default:
+		return fmt.Errorf("unknown log format %s", format)
+	}
+	return nil
+}
+
+// components are the loggers whose levels can be set.
+var components = []*logger{mainLog, bleLog, decodeLog, sensorLog, writeLog, alertLog}
+
+// currentLogLevels returns the minimum level and the per-component overrides.
+func currentLogLevels() (string, map[string]string) {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	levels := make(map[string]string, len(logging.levels))
+	for c, l := range logging.levels {
+		levels[c] = levelNames[l]
+	}
+	return levelNames[logging.level], levels
+}
+
+// setLogLevels changes the minimum level, unless level is empty, and the
+// overrides of the components in levels, removing those set to "".
+func setLogLevels(level string, levels map[string]string) error {
+	min, err := logging.level, error(nil)
+	if level != "" {
+		if min, err = parseLevel(level); err != nil {
+			return err
+		}
+	}
+	set := make(map[string]logLevel)
+	for c, name := range levels {
+		known := false
+		for _, l := range components {
+			known = known || l.component == c
+		}
+		if !known {
+			return fmt.Errorf("unknown log component %s", c)
+		}
+		if name == "" {
+			continue
+		}
+		if set[c], err = parseLevel(name); err != nil {
+			return err
+		}
+	}
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	logging.level = min
+	if logging.levels == nil {
+		logging.levels = make(map[string]logLevel)
+	}
+	for c := range levels {
+		if l, ok := set[c]; ok {
+			logging.levels[c] = l
+		} else {
+			delete(logging.levels, c)
+		}
+	}
+	return nil
+}
+
+func (l *logger) enabled(level logLevel) bool {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	min, ok := logging.levels[l.component]
+	if !ok {
+		min = logging.level
+	}
+	return level >= min
+}
+
+func (l *logger) logf(level logLevel, format string, a ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, a...), "\n")
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	if !logging.json {
+		logging.text.Printf("%-5s %s: %s", strings.ToUpper(levelNames[level]), l.component, msg)
+		return
+	}
+	b, err := json.Marshal(struct {
+		Time      string `json:"time"`
+		Level     string `json:"level"`
+		Component string `json:"component"`
+		Msg       string `json:"msg"`
+	}{time.Now().Format(time.RFC3339Nano), levelNames[level], l.component, msg})
+	if err != nil {
+		return
+	}
+	logging.out.Write(append(b, '\n'))
+}
+
+func (l *logger) Debugf(format string, a ...interface{}) { l.logf(levelDebug, format, a...) }
+func (l *logger) Infof(format string, a ...interface{})  { l.logf(levelInfo, format, a...) }
+func (l *logger) Warnf(format string, a ...interface{})  { l.logf(levelWarn, format, a...) }
+func (l *logger) Errorf(format string, a ...interface{}) { l.logf(levelError, format, a...) }
@@ -1,215 +1,2079 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/binary"
+	"crypto/cipher"
 	"encoding/hex"
-	"flag"
+	"expvar"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/go-ble/ble"
-	"github.com/go-ble/ble/linux"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/markdrayton/mijiamon/pkg/alert"
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/markdrayton/mijiamon/pkg/output"
+	"github.com/markdrayton/mijiamon/pkg/sensor"
 )
 
-type Data map[string]interface{}
+// OutputConfig controls how readings are written. The top-level values are
+// defaults which each sensor can override.
+type OutputConfig = output.Settings
+
+// duration wraps time.Duration so it can be decoded from strings like "5m",
+// or a plain number of seconds.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	if n, err := strconv.Atoi(string(text)); err == nil {
+		d.Duration = time.Duration(n) * time.Second
+		return nil
+	}
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+type databaseConfig struct {
+	Scheme string // http, or https; defaults to https if TLS is set
+	Host   string
+	Port   int
+	// InfluxDB 1.8 compatibility mode
+	User     string
+	Pass     string
+	PassFile string `toml:"pass_file"` // read Pass from here
+	Name     string
+	// Native InfluxDB 2.x, used instead if Token is set
+	Token     string
+	TokenFile string `toml:"token_file"` // read Token from here
+	Org       string
+	Bucket    string
+	TLS       output.TLSConfig
+	Units     string // overrides the top-level units
+}
 
 type Config struct {
-	Database struct {
-		Host string
-		Port int
-		User string
-		Pass string
-		Name string
+	OutputConfig
+	Interval duration // how often readings are written; defaults to 1m
+	// How long each write to an output, and each InfluxDB request, may
+	// take; defaults to 10s, negative waits indefinitely.
+	Timeout duration
+	// Unit system for the outputs: metric (the default) or imperial. Each
+	// output's units setting overrides it.
+	Units string
+	// HCI device IDs to scan with, e.g. [0, 1] for hci0 and hci1; defaults
+	// to hci0 alone.
+	Adapters []int
+	// Switch to this user, and group if set, once the adapters are open,
+	// rather than running as root throughout.
+	User  string
+	Group string
+	Scan  struct {
+		scanConfig
+		Adapter map[string]scanConfig // keyed by adapter name, e.g. hci1
+	}
+	// Tag each point with the adapter that heard the sensor most during
+	// the interval.
+	TagAdapter bool `toml:"tag_adapter"`
+	// Reopen an adapter that hasn't heard any advertisements for this long,
+	// as it has probably wedged; defaults to 5m, negative disables.
+	ScanWatchdog duration `toml:"scan_watchdog"`
+	// How values received during an interval are combined: mean, min, max
+	// or last (the default), optionally per field.
+	Aggregate  string
+	Aggregates map[string]string
+	Extremes   []string // also write <field>_min and <field>_max
+	// Metrics computed from temperature and humidity at flush time:
+	// dew_point, absolute_humidity, vpd, heat_index, humidex and comfort.
+	Derived []string
+	// Filters applied to each value of a field as it's received, keyed by
+	// field.
+	Smoothing map[string]sensor.Smoothing
+	// Fields only written when they've changed by at least delta, or
+	// max_interval has passed, keyed by field.
+	ReportOnChange map[string]reportOnChange `toml:"report_on_change"`
+	// Bounds on each field's values and how fast they can change, for
+	// catching corrupted advertisements, keyed by field.
+	Plausibility map[string]plausibility
+	// Fields that arrive infrequently, such as battery_pct, written with
+	// every point from their last known value for up to max_age, keyed by
+	// field.
+	CarryForward map[string]carryForward `toml:"carry_forward"`
+	// How long to spend writing out buffered readings on exit; defaults to
+	// 10s.
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
+	// Discard the first reading from a sensor that hasn't been heard from
+	// for longer than this; zero disables.
+	ReappearGap duration `toml:"reappear_gap"`
+	// Drop the copies of an advertisement heard by more than one adapter
+	// or relay within this; defaults to 2s.
+	DedupeWindow duration `toml:"dedupe_window"`
+	// Maximum advertisements processed per second per sensor; zero is
+	// unlimited.
+	MaxRate float64 `toml:"max_rate"`
+	// Warn when a sensor hasn't been heard from for this long; zero
+	// disables. With StaleMarker, a point with stale=1 is also written.
+	StaleAfter  duration `toml:"stale_after"`
+	StaleMarker bool     `toml:"stale_marker"`
+	// Estimate how many days each sensor's battery has left from a linear
+	// fit of its level over this many days; zero disables.
+	BatteryTrendDays int `toml:"battery_trend_days"`
+	// Add a sensor, named after its MAC address and tagged
+	// configured=false, for any unconfigured device advertising data of a
+	// recognised type.
+	AcceptUnknown bool `toml:"accept_unknown"`
+	// Names sensors configured without one; see sensorName. Defaults to
+	// {type}-{mac_suffix}.
+	NameTemplate string `toml:"name_template"`
+	// A directory of files of further [[sensors]] entries; see
+	// loadSensorsDir. Defaults to sensors.d next to the config file.
+	SensorsDir string `toml:"sensors_dir"`
+	// How points are timestamped: flush (the default) for the flush time,
+	// received for when the last advertisement in the interval was
+	// received, or each to write a point per reading as it was received.
+	Timestamps string
+	Clock      struct {
+		Source string // "system" (the default) or "file"
+		Path   string
+		Unit   string // unit of the epoch in Path: ns, us, ms or s (the default)
+		// Hold points at startup until the system clock is synchronised,
+		// giving up after sync_timeout (an hour by default; negative waits
+		// indefinitely).
+		WaitSync    bool     `toml:"wait_sync"`
+		SyncTimeout duration `toml:"sync_timeout"`
+	}
+	Parquet struct {
+		Dir string // write Parquet files, by day, here if set
+	}
+	Exporter struct {
+		Enabled bool
+		Listen  string // defaults to :9110
+	}
+	Buffer struct {
+		MaxPoints int    `toml:"max_points"` // defaults to 10000
+		Dir       string // persist points awaiting retry here if set
+		// Write every point ahead to a spool in dir, sending those left
+		// there on restart, rather than buffering up to max_points.
+		Spool bool
+	}
+	// Save each sensor's last known value of every field to file, and
+	// restore them on startup, so slow fields such as battery_pct are known
+	// before they're next advertised. Values older than max_age aren't
+	// restored; zero restores them all.
+	State struct {
+		File   string
+		MaxAge duration `toml:"max_age"`
+	}
+	// The queue in front of each output, overridable per output by name
+	// under outputs.
+	Queue struct {
+		output.QueueConfig
+		Outputs map[string]output.QueueConfig
+	}
+	Database databaseConfig // InfluxDB writes are skipped if Host is unset
+	Hourly   struct {
+		Enabled     bool
+		Measurement string // defaults to each sensor's measurement with _hourly appended
 	}
-	Sensors []struct {
-		Mac  string
-		Name string
-		Type string
+	MQTT        output.MQTTConfig
+	RemoteWrite output.RemoteWriteConfig `toml:"remote_write"`
+	Pushgateway output.PushgatewayConfig
+	OTLP        output.OTLPConfig
+	NATS        output.NATSConfig
+	Graphite    output.GraphiteConfig
+	SQLite      output.SQLiteConfig
+	Dashboard   output.DashboardConfig
+	Ingest      ingestConfig
+	Relay       relayConfig
+	API         apiConfig
+	Debug       debugConfig
+	Health      healthConfig
+	File        output.FileConfig
+	Alerts      alert.Config
+	Stdout      struct {
+		Enabled bool // write each reading to stdout as a line of JSON
+		Units   string
 	}
+	Sensors []sensorConfig
+	Zones   []zoneConfig
+}
+
+// sensorConfig configures a sensor, in a [[sensors]] entry.
+type sensorConfig struct {
+	OutputConfig
+	Mac         string
+	Name        string
+	Type        string
+	Types       []string
+	ReappearGap *duration `toml:"reappear_gap"`
+	MaxRate     *float64  `toml:"max_rate"`
+	StaleAfter  *duration `toml:"stale_after"`
+	Bindkey     string    // hex AES key for encrypted MiBeacon or BTHome data
+	// hex identity resolving key, for a sensor advertising from resolvable
+	// private addresses rather than its MAC address
+	IRK string
+	// Corrections applied to each reading as value*scale + offset.
+	TempOffset     float64  `toml:"temp_offset"`
+	TempScale      *float64 `toml:"temp_scale"`
+	HumidityOffset float64  `toml:"humidity_offset"`
+	HumidityScale  *float64 `toml:"humidity_scale"`
+	Derived        *[]string
+	Smoothing      map[string]sensor.Smoothing // overrides the top-level smoothing per field
+	ReportOnChange map[string]reportOnChange   `toml:"report_on_change"` // overrides the top-level report_on_change per field
+	CarryForward   map[string]carryForward     `toml:"carry_forward"`    // overrides the top-level carry_forward per field
+	Plausibility   map[string]plausibility     // overrides the top-level plausibility per field
+	// Connect and read the sensor over GATT when its advertisements
+	// haven't got through for poll_interval (default 5m).
+	Poll         bool
+	PollInterval *duration `toml:"poll_interval"`
+	// Set the clock of an LYWSD02 over GATT every sync_time_interval
+	// (default 24h), in timezone, a name like Europe/London (default the
+	// local time zone).
+	SyncTime         bool      `toml:"sync_time"`
+	SyncTimeInterval *duration `toml:"sync_time_interval"`
+	Timezone         string
+	Interval         *duration // overrides the top-level interval
+	Timestamps       string    // overrides the top-level timestamps
+	// A disabled sensor is left out, as if it weren't configured, other
+	// than not being accepted by accept_unknown.
+	Enabled *bool
+	// When the sensor is active, as cron-style expressions; outside them
+	// its advertisements are ignored and it doesn't go stale. Always if
+	// unset.
+	Active []string
+}
+
+// enabled reports whether the sensor is enabled, as it is by default.
+func (s sensorConfig) enabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+// disabledSensors returns the MAC addresses and names of the sensors
+// configured but disabled.
+func disabledSensors(conf *Config) (macs, names map[string]bool) {
+	macs, names = make(map[string]bool), make(map[string]bool)
+	for _, s := range conf.Sensors {
+		if !s.enabled() {
+			macs[strings.ToLower(s.Mac)] = true
+			names[s.Name] = true
+		}
+	}
+	return macs, names
+}
+
+// plausibility configures sensor.Plausibility for a field.
+type plausibility struct {
+	Min, Max *float64
+	MaxRate  float64 `toml:"max_rate"` // per minute
+	// What's done with an implausible value: reject (the default) drops
+	// it, flag writes it with implausible=1.
+	Action string
+}
+
+// carryForward configures sensor.CarryForward for a field.
+type carryForward struct {
+	// How long after a value is received it's carried forward; defaults
+	// to 1h, negative carries it indefinitely.
+	MaxAge duration `toml:"max_age"`
+}
+
+// reportOnChange configures sensor.ReportOnChange for a field.
+type reportOnChange struct {
+	Delta       float64
+	MaxInterval duration `toml:"max_interval"`
 }
 
-type sensor struct {
-	name      string
-	data      Data
-	mu        *sync.Mutex
-	processor func([]byte) Data
+func (d databaseConfig) authToken() string {
+	if d.Token != "" {
+		return d.Token
+	}
+	return d.User + ":" + d.Pass
 }
 
-func newSensor(name string, processor func([]byte) Data) *sensor {
-	return &sensor{
-		name:      name,
-		data:      make(Data),
-		mu:        &sync.Mutex{},
-		processor: processor,
+func (d databaseConfig) org() string {
+	if d.Token != "" {
+		return d.Org
 	}
+	return ""
 }
 
-func (s *sensor) processAdv(b []byte) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	for k, v := range s.processor(b) {
-		s.data[k] = v
+// scheme returns the database URL's scheme, https by default if TLS is
+// configured.
+func (d databaseConfig) scheme() string {
+	if d.Scheme != "" {
+		return d.Scheme
 	}
+	if d.TLS.Enabled() {
+		return "https"
+	}
+	return "http"
 }
 
-func (s *sensor) flush() Data {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	ret := make(Data)
-	for k, v := range s.data {
-		ret[k] = v
+func (d databaseConfig) defaultBucket() string {
+	if d.Token != "" {
+		return d.Bucket
 	}
-	s.data = make(Data)
-	return ret
+	return d.Name
 }
 
-func processAdvLYWSD03MMC(b []byte) Data {
-	// assumes https://github.com/pvvx/ATC_MiThermometer firmware
-	if len(b) == 15 {
-		return Data{
-			"temperature": float64(int16(binary.LittleEndian.Uint16(b[6:8]))) / 100,
-			"humidity":    float64(binary.LittleEndian.Uint16(b[8:10])) / 100,
-			"battery_pct": int(b[12]),
+// scanRestarts counts restarted scans, by adapter.
+var scanRestarts = expvar.NewMap("scan_restarts")
+
+const (
+	minScanBackoff = 5 * time.Second
+	maxScanBackoff = time.Minute
+)
+
+var (
+	configFile  string
+	envMode     bool
+	debugListen string
+	// -debug-listen was given, overriding the config
+	debugListenSet bool
+	dryRun         bool
+	once           bool
+	telegrafMode   bool
+	passiveScan    bool
+	captureFile    string
+	captureFails   bool
+	dumpUnknown    string
+	verbose        bool
+	discoverMode   bool
+	checkConfig    bool
+	discoverFor    time.Duration
+	discoverTOML   bool
+	logLevelFlag   string
+	logLevels      string
+	logFormat      string
+)
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces each ${VAR} in b with the value of the environment
+// variable, which must be set. Comment lines are left alone.
+func expandEnv(b []byte) ([]byte, error) {
+	var err error
+	lines := bytes.Split(b, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			continue
 		}
+		lines[i] = envRef.ReplaceAllFunc(line, func(ref []byte) []byte {
+			name := string(envRef.FindSubmatch(ref)[1])
+			v, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("line %d: environment variable %s is not set", i+1, name)
+			}
+			return []byte(v)
+		})
+	}
+	return bytes.Join(lines, []byte("\n")), err
+}
+
+// readSecret sets *dst to the contents of path, without any trailing
+// newline, if path is set.
+func readSecret(dst *string, path string) error {
+	if path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	*dst = strings.TrimRight(string(b), "\r\n")
+	return nil
+}
+
+func loadConfig(path string) (*Config, error) {
+	conf, _, err := decodeConfig(path)
+	return conf, err
+}
+
+// decodeConfig loads the config at path, in the format its extension names,
+// also returning the TOML metadata, which is empty for JSON and YAML.
+func decodeConfig(path string) (*Config, toml.MetaData, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, toml.MetaData{}, err
+	}
+	if b, err = expandEnv(b); err != nil {
+		return nil, toml.MetaData{}, fmt.Errorf("%s: %s", path, err)
+	}
+	var (
+		conf Config
+		meta toml.MetaData
+	)
+	switch configFormat(path) {
+	case "json":
+		err = decodeJSONConfig(b, &conf)
+	case "yaml":
+		err = decodeYAMLConfig(b, &conf)
+	default:
+		meta, err = toml.Decode(string(b), &conf)
+	}
+	if err != nil {
+		return nil, meta, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := loadSensorsDir(&conf, filepath.Dir(path)); err != nil {
+		return nil, meta, err
+	}
+	if err := resolveSecrets(&conf); err != nil {
+		return nil, meta, err
 	}
-	return Data{}
+	return &conf, meta, nameSensors(&conf)
 }
 
-func processAdvLYWSDCGQ(b []byte) Data {
-	switch int(b[13]) {
-	case 0x01:
-		return Data{
-			"battery_pct": int(b[14]),
+// resolveSecrets reads the passwords and tokens configured as files.
+func resolveSecrets(conf *Config) error {
+	for _, s := range []struct {
+		dst  *string
+		path string
+	}{
+		{&conf.Database.Pass, conf.Database.PassFile},
+		{&conf.Database.Token, conf.Database.TokenFile},
+		{&conf.MQTT.Pass, conf.MQTT.PassFile},
+		{&conf.RemoteWrite.Pass, conf.RemoteWrite.PassFile},
+		{&conf.Pushgateway.Pass, conf.Pushgateway.PassFile},
+		{&conf.NATS.Pass, conf.NATS.PassFile},
+		{&conf.Ingest.Token, conf.Ingest.TokenFile},
+		{&conf.Relay.Token, conf.Relay.TokenFile},
+		{&conf.API.Token, conf.API.TokenFile},
+		{&conf.Debug.Pass, conf.Debug.PassFile},
+	} {
+		if err := readSecret(s.dst, s.path); err != nil {
+			return err
 		}
-	case 0x04:
-		return Data{
-			"temperature": float64(int16(binary.LittleEndian.Uint16(b[14:16]))) / 10,
-			"humidity":    float64(binary.LittleEndian.Uint16(b[16:18])) / 10,
+	}
+	return nil
+}
+
+// autoType reports whether a sensor configured with types has its type
+// detected from its advertisements, as it does with none or "auto".
+func autoType(types []string) (bool, error) {
+	for _, t := range types {
+		if t == "auto" && len(types) > 1 {
+			return false, fmt.Errorf("type auto can't be combined with other types")
 		}
 	}
-	return Data{}
+	return len(types) == 0 || types[0] == "auto", nil
 }
 
-var (
-	configFile string
-	dryRun     bool
-	verbose    bool
-	sensors    map[string]*sensor
-)
+// hasType reports whether types includes typ.
+func hasType(types []string, typ string) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
 
-func init() {
-	log.SetFlags(log.Ldate | log.Lmicroseconds)
+// processorsFor returns the processors for a sensor of types with address
+// mac, decrypting its advertisements with key if set.
+func processorsFor(types []string, key []byte, mac net.HardwareAddr) (map[string]decode.Processor, error) {
+	processors, err := decode.Merge(types)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		processors["fe95"] = decode.NewMiBeacon(key, mac)
+		if _, ok := processors["fcd2"]; ok {
+			processors["fcd2"] = decode.NewBTHome(key, mac)
+		}
+	}
+	return processors, nil
+}
 
-	d, err := linux.NewDevice()
+func newSensors(conf *Config) (map[string]*sensor.Sensor, error) {
+	agg, err := sensor.NewAggregation(conf.Aggregate, conf.Aggregates, conf.Extremes)
 	if err != nil {
-		log.Fatal("Can't create new device:", err)
+		return nil, err
+	}
+	sensors := make(map[string]*sensor.Sensor)
+	names := make(map[string]bool)
+	for _, s := range conf.Sensors {
+		mac := strings.ToLower(s.Mac)
+		if hw, err := net.ParseMAC(mac); err != nil || len(hw) != 6 {
+			return nil, fmt.Errorf("sensor %s: bad MAC address %q", s.Name, s.Mac)
+		}
+		if _, ok := sensors[mac]; ok {
+			return nil, fmt.Errorf("sensor %s: MAC address %s is already configured", s.Name, mac)
+		}
+		if s.Name == "" {
+			return nil, fmt.Errorf("sensor %s: no name configured", mac)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("sensor %s: name is already used by another sensor", s.Name)
+		}
+		names[s.Name] = true
+		sn, err := newSensor(conf, s, agg)
+		if err != nil {
+			return nil, err
+		}
+		if !s.enabled() {
+			continue
+		}
+		sensors[mac] = sn
 	}
-	ble.SetDefaultDevice(d)
+	return sensors, nil
+}
 
-	flag.StringVar(&configFile, "c", "config.toml", "config file path")
-	flag.BoolVar(&dryRun, "n", false, "dry run mode")
-	flag.BoolVar(&verbose, "v", false, "verbose logginge")
-	flag.Parse()
+// newSensor returns the sensor configured by s, whose MAC address has been
+// checked.
+func newSensor(conf *Config, s sensorConfig, agg sensor.Aggregation) (*sensor.Sensor, error) {
+	mac := strings.ToLower(s.Mac)
+	types := s.Types
+	if s.Type != "" {
+		types = append([]string{s.Type}, types...)
+	}
+	var (
+		key []byte
+		err error
+	)
+	if s.Bindkey != "" {
+		key, err = hex.DecodeString(s.Bindkey)
+		if err != nil || len(key) != 16 {
+			return nil, fmt.Errorf("sensor %s: bindkey must be 32 hex digits", s.Name)
+		}
+	}
+	var irk cipher.Block
+	if s.IRK != "" {
+		b, err := hex.DecodeString(s.IRK)
+		if err != nil || len(b) != 16 {
+			return nil, fmt.Errorf("sensor %s: irk must be 32 hex digits", s.Name)
+		}
+		irk, _ = sensor.NewIRK(b)
+	}
+	hw, _ := net.ParseMAC(mac) // checked by the caller
+	auto, err := autoType(types)
+	if err != nil {
+		return nil, fmt.Errorf("sensor %s: %s", s.Name, err)
+	}
+	var processors map[string]decode.Processor
+	if !auto {
+		if processors, err = processorsFor(types, key, hw); err != nil {
+			return nil, fmt.Errorf("sensor %s: %s", s.Name, err)
+		}
+	}
+	sn := sensor.New(s.Name, processors)
+	sn.MAC = mac
+	sn.Model = strings.Join(types, ", ")
+	if auto {
+		sn.Model = "auto"
+		sn.Detect = func(uuid string, b []byte) (string, map[string]decode.Processor) {
+			typ := decode.InferType(uuid, b)
+			if typ == "" {
+				return "", nil
+			}
+			ps, err := processorsFor([]string{typ}, key, hw)
+			if err != nil {
+				return "", nil
+			}
+			return typ, ps
+		}
+	}
+	sn.IRK = irk
+	sn.Aggregation = agg
+	sn.Output, err = output.Resolve(conf.OutputConfig, s.OutputConfig)
+	if err != nil {
+		return nil, fmt.Errorf("sensor %s: %s", s.Name, err)
+	}
+	if sn.Output.Bucket == "" {
+		sn.Output.Bucket = conf.Database.defaultBucket()
+	}
+	sn.ReappearGap = conf.ReappearGap.Duration
+	if s.ReappearGap != nil {
+		sn.ReappearGap = s.ReappearGap.Duration
+	}
+	sn.DedupeWindow = conf.DedupeWindow.Duration
+	sn.BatteryTrend = time.Duration(conf.BatteryTrendDays) * 24 * time.Hour
+	sn.MaxRate = conf.MaxRate
+	if s.MaxRate != nil {
+		sn.MaxRate = *s.MaxRate
+	}
+	if sn.MaxRate < 0 {
+		return nil, fmt.Errorf("sensor %s: max_rate must not be negative", s.Name)
+	}
+	sn.StaleAfter = conf.StaleAfter.Duration
+	if s.StaleAfter != nil {
+		sn.StaleAfter = s.StaleAfter.Duration
+	}
+	if sn.Schedule, err = sensor.ParseSchedule(s.Active); err != nil {
+		return nil, fmt.Errorf("sensor %s: active: %s", s.Name, err)
+	}
+	sn.Derived = conf.Derived
+	if s.Derived != nil {
+		sn.Derived = *s.Derived
+	}
+	sn.Timestamps = conf.Timestamps
+	if s.Timestamps != "" {
+		sn.Timestamps = s.Timestamps
+	}
+	if err := sensor.CheckTimestamps(sn.Timestamps); err != nil {
+		return nil, fmt.Errorf("sensor %s: %s", s.Name, err)
+	}
+	sn.Interval = time.Minute
+	if conf.Interval.Duration > 0 {
+		sn.Interval = conf.Interval.Duration
+	}
+	if s.Interval != nil {
+		if s.Interval.Duration <= 0 {
+			return nil, fmt.Errorf("sensor %s: interval must be positive", s.Name)
+		}
+		sn.Interval = s.Interval.Duration
+	}
+	if s.Poll {
+		sn.Poll = 5 * time.Minute
+		if s.PollInterval != nil {
+			sn.Poll = s.PollInterval.Duration
+		}
+	}
+	if s.SyncTime {
+		if !hasType(types, "LYWSD02") {
+			return nil, fmt.Errorf("sensor %s: sync_time needs type LYWSD02", s.Name)
+		}
+		sn.SyncTime = 24 * time.Hour
+		if s.SyncTimeInterval != nil {
+			if s.SyncTimeInterval.Duration <= 0 {
+				return nil, fmt.Errorf("sensor %s: sync_time_interval must be positive", s.Name)
+			}
+			sn.SyncTime = s.SyncTimeInterval.Duration
+		}
+		sn.TimeZone = time.Local
+		if s.Timezone != "" {
+			if sn.TimeZone, err = time.LoadLocation(s.Timezone); err != nil {
+				return nil, fmt.Errorf("sensor %s: timezone: %s", s.Name, err)
+			}
+		}
+	}
+	if err := sensor.CheckDerived(sn.Derived); err != nil {
+		return nil, fmt.Errorf("sensor %s: %s", s.Name, err)
+	}
+	sn.Smoothing = make(map[string]sensor.Smoothing)
+	for _, sm := range []map[string]sensor.Smoothing{conf.Smoothing, s.Smoothing} {
+		for field, c := range sm {
+			if err := c.Check(); err != nil {
+				return nil, fmt.Errorf("sensor %s: smoothing %s: %s", s.Name, field, err)
+			}
+			sn.Smoothing[field] = c
+			if c.Method == "none" {
+				delete(sn.Smoothing, field)
+			}
+		}
+	}
+	sn.ReportOnChange = make(map[string]sensor.ReportOnChange)
+	for _, rc := range []map[string]reportOnChange{conf.ReportOnChange, s.ReportOnChange} {
+		for field, c := range rc {
+			r := sensor.ReportOnChange{Delta: c.Delta, MaxInterval: c.MaxInterval.Duration}
+			if err := r.Check(); err != nil {
+				return nil, fmt.Errorf("sensor %s: report_on_change %s: %s", s.Name, field, err)
+			}
+			sn.ReportOnChange[field] = r
+		}
+	}
+	sn.Plausibility = make(map[string]sensor.Plausibility)
+	for _, pl := range []map[string]plausibility{conf.Plausibility, s.Plausibility} {
+		for field, c := range pl {
+			p := sensor.Plausibility{Min: c.Min, Max: c.Max, MaxRate: c.MaxRate}
+			switch c.Action {
+			case "", "reject":
+			case "flag":
+				p.Flag = true
+			default:
+				return nil, fmt.Errorf("sensor %s: plausibility %s: unknown action %s, want reject or flag", s.Name, field, c.Action)
+			}
+			if err := p.Check(); err != nil {
+				return nil, fmt.Errorf("sensor %s: plausibility %s: %s", s.Name, field, err)
+			}
+			sn.Plausibility[field] = p
+		}
+	}
+	sn.CarryForward = make(map[string]time.Duration)
+	for _, cf := range []map[string]carryForward{conf.CarryForward, s.CarryForward} {
+		for field, c := range cf {
+			sn.CarryForward[field] = c.MaxAge.Duration
+			if c.MaxAge.Duration == 0 {
+				sn.CarryForward[field] = time.Hour
+			}
+		}
+	}
+	sn.Calibration = make(map[string]sensor.Calibration)
+	for _, c := range []struct {
+		field  string
+		scale  *float64
+		offset float64
+	}{
+		{"temperature", s.TempScale, s.TempOffset},
+		{"humidity", s.HumidityScale, s.HumidityOffset},
+	} {
+		cal := sensor.Calibration{Scale: 1, Offset: c.offset}
+		if c.scale != nil {
+			cal.Scale = *c.scale
+		}
+		if cal != (sensor.Calibration{Scale: 1}) {
+			sn.Calibration[c.field] = cal
+		}
+	}
+	return sn, nil
+}
+
+// adapter is an HCI device to scan with.
+type adapter struct {
+	lastAdv  int64 // UnixNano of the last advertisement heard; atomic
+	scanning int32 // 1 while a scan is running; atomic
+	id       int
+	name     string
+	opts     []ble.Option
+	allowDup bool
+
+	mu  sync.Mutex // guards dev, which is also used for polling
+	dev ble.Device
+}
+
+// device returns the adapter's device, or nil while it's being reopened.
+func (a *adapter) device() ble.Device {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.dev
+}
+
+// reopen replaces the adapter's device with a freshly opened one.
+func (a *adapter) reopen() error {
+	a.stop()
+	d, err := newDevice(a.opts...)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.dev = d
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *adapter) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.dev != nil {
+		a.dev.Stop()
+		a.dev = nil
+	}
+}
+
+// newAdapters opens each configured HCI device.
+func newAdapters(conf *Config) ([]*adapter, error) {
+	if err := checkScan(conf); err != nil {
+		return nil, err
+	}
+	ids := conf.Adapters
+	if len(ids) == 0 {
+		ids = []int{0}
+	}
+	var adapters []*adapter
+	for _, id := range ids {
+		a := &adapter{id: id, name: fmt.Sprintf("hci%d", id)}
+		scan, _ := conf.scanSettings(a.name) // checked above
+		a.opts = append([]ble.Option{ble.OptDeviceID(id)}, scan.options()...)
+		a.allowDup = scan.allowDuplicates
+		d, err := newDevice(a.opts...)
+		if err != nil {
+			for _, a := range adapters {
+				a.stop()
+			}
+			return nil, fmt.Errorf("%s: %s", a.name, err)
+		}
+		a.dev = d
+		if scan.passive {
+			bleLog.Infof("%s: scanning passively", a.name)
+		}
+		adapters = append(adapters, a)
+	}
+	return adapters, nil
+}
+
+// clock supplies point timestamps.
+type clock interface {
+	Now() (time.Time, error)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() (time.Time, error) {
+	return time.Now(), nil
+}
 
-	sensors = make(map[string]*sensor)
+// fileClock reads the time as an integer epoch from a file maintained by an
+// external, authoritative source such as a GPS-disciplined clock.
+type fileClock struct {
+	path string
+	unit time.Duration
 }
 
-func vlog(fmt string, a ...interface{}) {
-	if verbose {
-		log.Printf(fmt, a...)
+func (c fileClock) Now() (time.Time, error) {
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: %s", c.path, err)
 	}
+	return time.Unix(0, n*int64(c.unit)), nil
 }
 
-func formatHex(b []byte) string {
-	h := hex.EncodeToString(b)
-	out := ""
-	i := 0
-	for i < len(h) {
-		out += h[i : i+2]
-		i += 2
-		if i != len(h) {
-			out += " "
+func newClock(conf *Config) (clock, error) {
+	switch conf.Clock.Source {
+	case "", "system":
+		return systemClock{}, nil
+	case "file":
+		if conf.Clock.WaitSync {
+			return nil, fmt.Errorf("wait_sync only applies to the system clock")
 		}
+		unit := time.Second
+		if conf.Clock.Unit != "" {
+			var ok bool
+			if unit, ok = output.Precisions[conf.Clock.Unit]; !ok {
+				return nil, fmt.Errorf("unknown clock unit %s", conf.Clock.Unit)
+			}
+		}
+		return fileClock{conf.Clock.Path, unit}, nil
 	}
-	return out
+	return nil, fmt.Errorf("unknown clock source %s", conf.Clock.Source)
 }
 
-func advHandler(a ble.Advertisement) {
-	s := sensors[a.Addr().String()]
+// collector owns the configured sensors and periodically writes their
+// readings to each configured output.
+type collector struct {
+	conf *Config
+	// reload the configuration from here on SIGHUP if set
+	configPath string
+
+	// mu guards the fields replaced on reload; flushMu stops a reload
+	// happening while readings are being written.
+	mu       sync.RWMutex
+	flushMu  sync.Mutex
+	sensors  map[string]*sensor.Sensor
+	accepted map[string]bool          // sensors added by accept_unknown
+	disabled map[string]bool          // MACs of the sensors configured but disabled
+	added    map[string]*sensorConfig // sensors added through the API, by MAC
+	zones    []*zone
+	// resolvable private addresses heard, to the MAC of the sensor each
+	// resolves to or ""
+	rpaMu    sync.Mutex
+	rpas     map[string]string
+	due      map[string]time.Time // when each sensor is next flushed; guarded by flushMu
+	outputs  *output.Fanout
+	influx   *output.Influx
+	exporter *output.Exporter
+	nats     *output.NATS
+	dash     *output.Dashboard
+	stream   *streamer
+	relay    *relayer // forward advertisements rather than decode them
+	capture  *btsnoop
+	// capture only the advertisements of configured sensors that
+	// couldn't be decoded
+	captureFails bool
+	captureErr   int32 // 1 once capturing has failed; atomic
+	unknown      *unknownDump
+	clock        clock
+	// points held until the system clock is synchronised, while waitSync
+	// is set; guarded by flushMu
+	waitSync    bool
+	syncTimeout time.Duration
+	syncStart   time.Time
+	held        []heldPoint
+	maxHeld     int
+
+	interval time.Duration
+	// how long to spend writing buffered readings on exit
+	shutdownTimeout time.Duration
+	dryRun          bool
+	once            bool // stop after one interval
+	multiAdapter    bool // more than one adapter could hear each sensor
+	tagAdapter      bool
+	watchdog        time.Duration
+	rescheduled     chan struct{} // a reload changed the flush schedule
+	trigger         chan struct{} // flush every sensor now, for Telegraf
+	latestMu        sync.Mutex
+	latest          map[string]lastReading // by sensor name, for /healthz
+	statePath       string                 // the state file, if any
+	adapters        []*adapter             // for /healthz
+	lastFlush       int64                  // UnixNano; atomic
+}
+
+// newInflux returns the InfluxDB output, or nil if no database is
+// configured.
+func newInflux(conf *Config) (*output.Influx, error) {
+	db := conf.Database
+	if db.Host == "" {
+		return nil, nil
+	}
+	if err := checkInflux(conf); err != nil {
+		return nil, err
+	}
+	scheme := db.scheme()
+	tlsConf, err := db.TLS.Build()
+	if err != nil {
+		return nil, fmt.Errorf("database tls: %s", err)
+	}
+	return output.NewInflux(output.InfluxConfig{
+		URL:       fmt.Sprintf("%s://%s:%d/", scheme, db.Host, db.Port),
+		Token:     db.authToken(),
+		Org:       db.org(),
+		MaxPoints: conf.Buffer.MaxPoints,
+		BufferDir: conf.Buffer.Dir,
+		Spool:     conf.Buffer.Spool,
+		TLS:       tlsConf,
+		Timeout:   conf.writeTimeout(),
+
+		Hourly:            conf.Hourly.Enabled,
+		HourlyMeasurement: conf.Hourly.Measurement,
+	}), nil
+}
+
+// checkInflux returns an error if the database settings are invalid,
+// without creating the output.
+func checkInflux(conf *Config) error {
+	db := conf.Database
+	if db.Host == "" {
+		return nil
+	}
+	if scheme := db.scheme(); scheme != "http" && scheme != "https" {
+		return fmt.Errorf("unknown database scheme %s", scheme)
+	}
+	if _, err := db.TLS.Build(); err != nil {
+		return fmt.Errorf("database tls: %s", err)
+	}
+	if conf.Buffer.Spool && conf.Buffer.Dir == "" {
+		return fmt.Errorf("buffer: spool requires dir")
+	}
+	return nil
+}
+
+// queueFor returns the queue settings for the output called name.
+func (conf *Config) queueFor(name string) output.QueueConfig {
+	q := conf.Queue.QueueConfig
+	if o, ok := conf.Queue.Outputs[name]; ok {
+		if o.Size != 0 {
+			q.Size = o.Size
+		}
+		if o.Policy != "" {
+			q.Policy = o.Policy
+		}
+	}
+	return q
+}
+
+// writeTimeout returns how long each write may take, or zero for no limit.
+func (conf *Config) writeTimeout() time.Duration {
+	switch d := conf.Timeout.Duration; {
+	case d < 0:
+		return 0
+	case d == 0:
+		return 10 * time.Second
+	default:
+		return d
+	}
+}
+
+// unitsFor returns the unit system for an output whose own units setting is
+// override: override if set, or else the top-level setting.
+func (conf *Config) unitsFor(override string) string {
+	if override != "" {
+		return override
+	}
+	return conf.Units
+}
+
+func newCollector(conf *Config, dryRun bool) (*collector, error) {
+	for _, u := range []string{conf.Units, conf.Database.Units, conf.MQTT.Units, conf.File.Units, conf.Stdout.Units, conf.Graphite.Units, conf.Dashboard.Units} {
+		if err := output.CheckUnits(u); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.Queue.Check(); err != nil {
+		return nil, fmt.Errorf("queue: %s", err)
+	}
+	if conf.API.Listen != "" && conf.API.Token == "" {
+		return nil, fmt.Errorf("api: a token is required")
+	}
+	if (conf.Ingest.Listen != "" || conf.Ingest.UDP != "") && conf.Ingest.Token == "" {
+		return nil, fmt.Errorf("ingest: a token is required")
+	}
+	for name, q := range conf.Queue.Outputs {
+		if err := q.Check(); err != nil {
+			return nil, fmt.Errorf("queue.outputs.%s: %s", name, err)
+		}
+	}
+	sensors, err := newSensors(conf)
+	if err != nil {
+		return nil, err
+	}
+	disabled, _ := disabledSensors(conf)
+	zones, err := newZones(conf, sensors)
+	if err != nil {
+		return nil, err
+	}
+	if conf.State.File != "" {
+		if err := restoreState(conf.State.File, conf.State.MaxAge.Duration, sensors); err != nil {
+			mainLog.Warnf("state: %s", err)
+		}
+	}
+	clock, err := newClock(conf)
+	if err != nil {
+		return nil, err
+	}
+	c := &collector{
+		conf:            conf,
+		sensors:         sensors,
+		accepted:        make(map[string]bool),
+		disabled:        disabled,
+		added:           make(map[string]*sensorConfig),
+		zones:           zones,
+		rpas:            make(map[string]string),
+		due:             make(map[string]time.Time),
+		outputs:         output.NewFanout(),
+		stream:          newStreamer(),
+		interval:        time.Minute,
+		shutdownTimeout: 10 * time.Second,
+		clock:           clock,
+		dryRun:          dryRun,
+		multiAdapter:    len(conf.Adapters) > 1 || conf.Ingest.Listen != "" || conf.Ingest.UDP != "",
+		tagAdapter:      conf.TagAdapter,
+		watchdog:        5 * time.Minute,
+		rescheduled:     make(chan struct{}, 1),
+		trigger:         make(chan struct{}, 1),
+		latest:          make(map[string]lastReading),
+		statePath:       conf.State.File,
+		waitSync:        conf.Clock.WaitSync,
+		syncTimeout:     time.Hour,
+		syncStart:       time.Now(),
+		maxHeld:         10000,
+	}
+	if conf.Clock.SyncTimeout.Duration != 0 {
+		c.syncTimeout = conf.Clock.SyncTimeout.Duration
+	}
+	if conf.Buffer.MaxPoints > 0 {
+		c.maxHeld = conf.Buffer.MaxPoints
+	}
+	c.outputs.Observe = observeWrite
+	c.outputs.Queue = conf.queueFor
+	c.outputs.Dropped = func(o string) { queueDropped.WithLabelValues(o).Inc() }
+	c.outputs.Queued = func(o string, n int) { queueLength.WithLabelValues(o).Set(float64(n)) }
+	c.outputs.SetTimeout(conf.writeTimeout())
+	if conf.ScanWatchdog.Duration != 0 {
+		c.watchdog = conf.ScanWatchdog.Duration
+	}
+	if conf.Interval.Duration > 0 {
+		c.interval = conf.Interval.Duration
+	}
+	if conf.ShutdownTimeout.Duration > 0 {
+		c.shutdownTimeout = conf.ShutdownTimeout.Duration
+	}
+	if !dryRun {
+		if c.influx, err = newInflux(conf); err != nil {
+			return nil, err
+		} else if c.influx != nil {
+			c.outputs.Set("influxdb", output.WithUnits(c.influx, conf.unitsFor(conf.Database.Units)))
+		}
+		if conf.Parquet.Dir != "" {
+			c.outputs.Set("parquet", output.NewParquetWriter(conf.Parquet.Dir))
+		}
+		if conf.MQTT.Broker != "" {
+			mqttConf := conf.MQTT
+			mqttConf.Units = conf.unitsFor(mqttConf.Units)
+			c.outputs.Set("mqtt", output.WithUnits(output.NewMQTT(mqttConf), mqttConf.Units))
+		}
+		if conf.RemoteWrite.URL != "" {
+			rw, err := output.NewRemoteWrite(conf.RemoteWrite)
+			if err != nil {
+				return nil, fmt.Errorf("remote_write: %s", err)
+			}
+			c.outputs.Set("remote_write", rw)
+		}
+		if conf.Pushgateway.URL != "" {
+			pg, err := output.NewPushgateway(conf.Pushgateway)
+			if err != nil {
+				return nil, fmt.Errorf("pushgateway: %s", err)
+			}
+			c.outputs.Set("pushgateway", pg)
+		}
+		if conf.OTLP.URL != "" {
+			o, err := output.NewOTLP(conf.OTLP)
+			if err != nil {
+				return nil, fmt.Errorf("otlp: %s", err)
+			}
+			c.outputs.Set("otlp", o)
+		}
+		if conf.NATS.URL != "" {
+			if c.nats, err = output.NewNATS(conf.NATS); err != nil {
+				return nil, fmt.Errorf("nats: %s", err)
+			}
+			c.outputs.Set("nats", c.nats)
+		}
+		if conf.Graphite.Address != "" {
+			g, err := output.NewGraphite(conf.Graphite)
+			if err != nil {
+				return nil, fmt.Errorf("graphite: %s", err)
+			}
+			c.outputs.Set("graphite", output.WithUnits(g, conf.unitsFor(conf.Graphite.Units)))
+		}
+		if conf.SQLite.Path != "" {
+			db, err := output.NewSQLite(conf.SQLite)
+			if err != nil {
+				return nil, fmt.Errorf("sqlite: %s", err)
+			}
+			c.outputs.Set("sqlite", db)
+		}
+		if len(conf.Alerts.Rules) > 0 {
+			a, err := alert.New(conf.Alerts)
+			if err != nil {
+				return nil, err
+			}
+			c.outputs.Set("alerts", a)
+		}
+		if conf.File.Dir != "" {
+			f, err := output.NewFile(conf.File)
+			if err != nil {
+				return nil, err
+			}
+			c.outputs.Set("file", output.WithUnits(f, conf.unitsFor(conf.File.Units)))
+		}
+	}
+	if dryRun {
+		c.outputs.Set("dry_run", output.WithUnits(output.NewLineProtocol(os.Stdout), conf.unitsFor(conf.Database.Units)))
+	}
+	if conf.Stdout.Enabled {
+		c.outputs.Set("stdout", output.WithUnits(output.NewJSON(os.Stdout), conf.unitsFor(conf.Stdout.Units)))
+	}
+	if conf.Exporter.Enabled {
+		c.exporter = output.NewExporter()
+		c.exporter.Register(telemetry...)
+		c.outputs.Set("exporter", c.exporter)
+	}
+	if conf.Relay.enabled() {
+		if c.relay, err = newRelayer(conf.Relay); err != nil {
+			return nil, fmt.Errorf("relay: %s", err)
+		}
+	}
+	if conf.Dashboard.Enabled {
+		if c.dash, err = output.NewDashboard(conf.Dashboard); err != nil {
+			return nil, fmt.Errorf("dashboard: %s", err)
+		}
+		c.dash.LastSeen = c.lastHeard
+		c.outputs.Set("dashboard", output.WithUnits(c.dash, conf.unitsFor(conf.Dashboard.Units)))
+	}
+	return c, nil
+}
+
+func (c *collector) advHandler(adapter string, a ble.Advertisement) {
+	// held while processing so that a reload can't swap the sensor out
+	// midway
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s, ok := c.sensorFor(a.Addr().String())
+	if !ok {
+		return // removed by a reload
+	}
+	if c.relay != nil {
+		advsReceived.Inc()
+		s.Seen(a.RSSI())
+		c.relay.forward(a)
+		return
+	}
+	if c.multiAdapter {
+		// copies of a measurement are recognised by its packet counter
+		// where the format has one
+		var id strings.Builder
+		for _, sd := range a.ServiceData() {
+			uuid := sd.UUID.String()
+			id.WriteString(uuid)
+			id.WriteString(decode.PacketID(uuid, sd.Data))
+		}
+		if s.Heard(adapter, id.String(), a.RSSI(), time.Now()) {
+			advsDropped.WithLabelValues("duplicate").Inc()
+			return
+		}
+	} else {
+		s.Seen(a.RSSI())
+	}
+	advsReceived.Inc()
+	failed := false
+	// the rate limit is checked once per advertisement, for its first
+	// payload to get past the checks below, so repeats don't use it up
+	var allowed *bool
 	for _, sd := range a.ServiceData() {
-		vlog("adv: %s, UUID: %s, data (len %d): %s",
-			s.name, sd.UUID.String(), len(sd.Data), formatHex(sd.Data))
-		s.processAdv(sd.Data)
+		uuid := sd.UUID.String()
+		bleLog.Debugf("adv: %s, UUID: %s, data (len %d): %s",
+			s.Name, uuid, len(sd.Data), decode.FormatHex(sd.Data))
+		if _, ok := s.Processor(uuid, sd.Data); ok && s.Repeat(uuid, sd.Data, time.Now()) {
+			advsDropped.WithLabelValues("repeat").Inc()
+			continue
+		}
+		if s.Rejects(uuid, sd.Data) {
+			advsDropped.WithLabelValues("invalid").Inc()
+			continue
+		}
+		if allowed == nil {
+			ok := s.Allow(time.Now())
+			if !ok {
+				advsDropped.WithLabelValues("rate_limited").Inc()
+			}
+			allowed = &ok
+		}
+		if !*allowed {
+			continue
+		}
+		if d := s.ProcessAdv(uuid, sd.Data); d != nil {
+			payloadsDecoded.Inc()
+			e := streamEvent{
+				Time:    time.Now(),
+				Name:    s.Name,
+				MAC:     s.MAC,
+				Adapter: adapter,
+				UUID:    uuid,
+				RSSI:    a.RSSI(),
+				Fields:  d,
+			}
+			c.stream.publish(e)
+			if c.nats != nil {
+				c.nats.PublishAdvertisement(s.Name, e)
+			}
+		} else if _, ok := s.Processor(uuid, sd.Data); ok {
+			payloadsUndecoded.Inc()
+			failed = true
+			if s.Undecodable(uuid, sd.Data) && c.unknown != nil {
+				c.unknown.write(s, uuid, sd.Data)
+			}
+		}
+	}
+	if failed && c.captureFails {
+		c.captureAdv(a)
+	}
+}
+
+// captureAdv writes a to the capture file, if capturing.
+func (c *collector) captureAdv(a ble.Advertisement) {
+	if c.capture == nil || atomic.LoadInt32(&c.captureErr) == 1 {
+		return
+	}
+	if err := c.capture.write(a, time.Now()); err != nil {
+		atomic.StoreInt32(&c.captureErr, 1)
+		mainLog.Errorf("capture: %s; no longer capturing", err)
 	}
 }
 
-func advFilter(a ble.Advertisement) bool {
-	_, ok := sensors[a.Addr().String()]
-	return ok
+func (c *collector) advFilter(a ble.Advertisement) bool {
+	mac := a.Addr().String()
+	c.mu.RLock()
+	s, ok := c.sensorFor(mac)
+	accept := c.conf.AcceptUnknown && !c.disabled[mac]
+	c.mu.RUnlock()
+	if ok {
+		return s.Active(time.Now())
+	}
+	if !accept {
+		return false
+	}
+	if hw, _ := net.ParseMAC(mac); sensor.IsRPA(hw) {
+		return false // would be added afresh each time it rotates
+	}
+	return c.acceptUnknown(mac, a)
 }
 
-func main() {
-	go func() {
-		log.Println(http.ListenAndServe(":6060", nil))
-	}()
+// maxRPAs bounds the resolvable private addresses remembered, as every
+// phone nearby rotates through them.
+const maxRPAs = 1024
 
-	var conf Config
-	_, err := toml.DecodeFile(configFile, &conf)
+// sensorFor returns the sensor advertising from addr: the one with that MAC
+// address, or else the one whose IRK resolves it; c.mu must be held.
+func (c *collector) sensorFor(addr string) (*sensor.Sensor, bool) {
+	if s, ok := c.sensors[addr]; ok {
+		return s, true
+	}
+	hw, err := net.ParseMAC(addr)
+	if err != nil || !sensor.IsRPA(hw) {
+		return nil, false
+	}
+	c.rpaMu.Lock()
+	defer c.rpaMu.Unlock()
+	mac, ok := c.rpas[addr]
+	if !ok {
+		for m, s := range c.sensors {
+			if s.Resolves(hw) {
+				mac = m
+				sensorLog.Debugf("%s: resolved %s", s.Name, addr)
+				break
+			}
+		}
+		if len(c.rpas) >= maxRPAs {
+			c.rpas = make(map[string]string)
+		}
+		c.rpas[addr] = mac
+	}
+	s, ok := c.sensors[mac]
+	return s, ok
+}
+
+// acceptUnknown adds an unconfigured sensor for mac if a carries service data
+// of a recognised type, reporting whether it did.
+func (c *collector) acceptUnknown(mac string, a ble.Advertisement) bool {
+	typ := ""
+	for _, sd := range a.ServiceData() {
+		if typ = decode.InferType(sd.UUID.String(), sd.Data); typ != "" {
+			break
+		}
+	}
+	if typ == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.sensors[mac]; ok {
+		return true
+	}
+	s, err := newUnknownSensor(c.conf, mac)
 	if err != nil {
-		log.Fatal(err)
+		sensorLog.Errorf("accepting %s: %s", mac, err)
+		return false
 	}
+	sensorLog.Infof("accepting unconfigured %s sensor %s", typ, mac)
+	c.sensors[mac] = s
+	c.accepted[mac] = true
+	c.outputs.Configure(c.devices())
+	return true
+}
 
-	url := fmt.Sprintf("http://%s:%d/", conf.Database.Host, conf.Database.Port)
-	client := influxdb2.NewClient(url, conf.Database.User+":"+conf.Database.Pass)
-	writeAPI := client.WriteAPIBlocking("", conf.Database.Name)
+// newUnknownSensor returns a sensor for the unconfigured device mac, with
+// the top-level settings and its type detected from its advertisements.
+func newUnknownSensor(conf *Config, mac string) (*sensor.Sensor, error) {
+	return newConfiguredSensor(conf, sensorConfig{
+		OutputConfig: OutputConfig{Tags: map[string]string{"configured": "false"}},
+		Mac:          mac,
+		Name:         mac,
+	})
+}
 
-	for _, s := range conf.Sensors {
-		mac := strings.ToLower(s.Mac)
-		switch s.Type {
-		case "LYWSD03MMC":
-			sensors[mac] = newSensor(s.Name, processAdvLYWSD03MMC)
-		case "LYWSDCGQ/01ZM":
-			sensors[mac] = newSensor(s.Name, processAdvLYWSDCGQ)
-		default:
-			log.Fatalf("unknown sensor type %s", s.Type)
+// flush writes out every sensor's readings.
+func (c *collector) flush(ctx context.Context) {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.flushSensors(ctx, func(string) bool { return true })
+}
+
+// flushDue writes out the readings of the sensors due to be flushed at now,
+// scheduling their next flush, and returns when the next is due.
+func (c *collector) flushDue(ctx context.Context, now time.Time) time.Time {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.flushSensors(ctx, func(mac string) bool {
+		return !c.due[mac].After(now)
+	})
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	// waking at least every interval, which /healthz relies on
+	next := now.Add(c.interval)
+	for mac, s := range c.sensors {
+		due := c.due[mac]
+		if due.IsZero() {
+			due = now
+		}
+		if !due.After(now) {
+			// skipping any intervals missed, e.g. while suspended
+			due = due.Add((now.Sub(due)/s.Interval + 1) * s.Interval)
+			c.due[mac] = due
+		}
+		if due.Before(next) {
+			next = due
 		}
 	}
+	return next
+}
 
-	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
-		for {
-			<-ticker.C
-			for _, s := range sensors {
-				fields := s.flush()
-				log.Printf("%s %+v\n", s.name, fields)
-				if !dryRun && len(fields) > 0 {
-					p := influxdb2.NewPoint(
-						"environment",
-						map[string]string{
-							"name": s.name,
-						},
-						fields,
-						time.Now(),
-					)
-					err := writeAPI.WritePoint(context.Background(), p)
-					if err != nil {
-						fmt.Printf("Write error: %s\n", err.Error())
+// schedule sets when each sensor is next flushed: an interval from now for
+// the new ones and any whose interval changed, old holding the sensors
+// they're replacing. c.flushMu and c.mu must be held.
+func (c *collector) schedule(now time.Time, old map[string]*sensor.Sensor) {
+	due := make(map[string]time.Time, len(c.sensors))
+	for mac, s := range c.sensors {
+		if o, ok := old[mac]; ok && o.Interval == s.Interval && !c.due[mac].IsZero() {
+			due[mac] = c.due[mac]
+		} else {
+			due[mac] = now.Add(s.Interval)
+		}
+	}
+	c.due = due
+}
+
+// flushSensors writes out the readings of the sensors for which flush
+// returns true, given their MACs; c.flushMu must be held.
+func (c *collector) flushSensors(ctx context.Context, flush func(mac string) bool) {
+	start := time.Now()
+	defer func() { flushDuration.Observe(time.Since(start).Seconds()) }()
+
+	// take the readings under the lock but don't hold it while writing
+	type flushed struct {
+		s        *sensor.Sensor
+		readings []sensor.Reading
+		adapter  string
+	}
+	c.mu.RLock()
+	clock, staleMarker, zones := c.clock, c.conf.StaleMarker, c.zones
+	readings := make([]flushed, 0, len(c.sensors))
+	for mac, s := range c.sensors {
+		if !flush(mac) {
+			continue
+		}
+		rs := s.Readings()
+		age, stale := s.CheckStale(time.Now())
+		if stale && staleMarker {
+			if len(rs) == 0 {
+				rs = []sensor.Reading{{Fields: decode.Data{}}}
+			}
+			rs[len(rs)-1].Fields["stale"] = 1
+		}
+		if c.exporter != nil {
+			c.exporter.Update(s.Name, s.MAC, decode.Data{"last_seen_age": age.Seconds()})
+		}
+		readings = append(readings, flushed{s, rs, s.TopAdapter()})
+	}
+	members := make(map[string]zoneMember)
+	for _, s := range c.sensors {
+		for _, z := range zones {
+			if z.has(s.Name) {
+				members[s.Name] = newZoneMember(s)
+				break
+			}
+		}
+	}
+	c.mu.RUnlock()
+
+	sysNow := time.Now()
+	now, err := clock.Now()
+	if err != nil {
+		mainLog.Warnf("clock: %s, using system time", err)
+		now = sysNow
+	}
+	// receive times are by the system clock, so are moved onto clock's
+	offset := now.Sub(sysNow)
+	c.releaseHeld(ctx)
+	written := make(map[string]bool)
+	for _, f := range readings {
+		for _, r := range f.readings {
+			s, fields := f.s, r.Fields
+			if len(fields) == 0 {
+				continue
+			}
+			ts := now
+			if !r.Time.IsZero() {
+				ts = r.Time.Add(offset)
+			}
+			if c.tagAdapter && f.adapter != "" {
+				fields["adapter"] = f.adapter
+			}
+			writeLog.Infof("%s %+v", s.Name, fields)
+			c.latestMu.Lock()
+			c.latest[s.Name] = lastReading{ts, fields}
+			c.latestMu.Unlock()
+			c.write(ctx, s.Name, fields, ts)
+			written[s.Name] = true
+		}
+	}
+	for _, z := range zones {
+		since := false
+		for name := range written {
+			since = since || z.has(name)
+		}
+		if !since {
+			continue
+		}
+		fields := z.aggregate(members, sysNow)
+		if fields == nil {
+			continue
+		}
+		writeLog.Infof("zone %s %+v", z.name, fields)
+		c.write(ctx, z.name, fields, now)
+	}
+	if err := c.outputs.Flush(ctx); err != nil {
+		writeLog.Errorf("write: %s", err)
+	}
+	if c.statePath != "" {
+		c.mu.RLock()
+		err := saveState(c.statePath, c.sensors)
+		c.mu.RUnlock()
+		if err != nil {
+			mainLog.Errorf("state: %s", err)
+		}
+	}
+}
+
+func (c *collector) flushLoop(ctx context.Context) {
+	c.flushMu.Lock()
+	c.mu.RLock()
+	c.schedule(time.Now(), nil)
+	c.mu.RUnlock()
+	c.flushMu.Unlock()
+	timer := time.NewTimer(time.Until(c.nextDue()))
+	defer timer.Stop()
+	// Keepalives are sent from here, rather than their own goroutine, so
+	// that systemd restarts the daemon if flushing hangs.
+	var keepalive <-chan time.Time
+	if d := sdWatchdogInterval(); d > 0 {
+		t := time.NewTicker(d)
+		defer t.Stop()
+		keepalive = t.C
+	}
+	wait := func(next time.Time) {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+	}
+	// set once Telegraf asks for flushes, which it then decides the timing
+	// of
+	triggered := false
+	for {
+		select {
+		case <-timer.C:
+			if triggered {
+				wait(time.Now().Add(c.interval))
+				continue
+			}
+			// don't abandon a flush midway when shutting down
+			wait(c.flushDue(context.Background(), time.Now()))
+			atomic.StoreInt64(&c.lastFlush, time.Now().UnixNano())
+		case <-c.trigger:
+			triggered = true
+			c.flush(context.Background())
+			atomic.StoreInt64(&c.lastFlush, time.Now().UnixNano())
+		case <-c.rescheduled:
+			wait(c.nextDue())
+		case <-keepalive:
+			sdNotify("WATCHDOG=1")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// nextDue returns when the next sensor is due to be flushed.
+func (c *collector) nextDue() time.Time {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	next := time.Now().Add(c.interval)
+	for _, due := range c.due {
+		if due.Before(next) {
+			next = due
+		}
+	}
+	return next
+}
+
+// shutdown writes out whatever the sensors have buffered and closes the
+// outputs, giving up after timeout.
+func (c *collector) shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sdNotify("STOPPING=1")
+	mainLog.Infof("flushing before exit")
+	c.flush(ctx)
+	c.flushMu.Lock()
+	if len(c.held) > 0 {
+		mainLog.Warnf("clock: dropping %d points held awaiting synchronisation", len(c.held))
+	}
+	c.flushMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outputs.Close(ctx)
+}
+
+// scan runs a scan with a until ctx is cancelled, restarting it if it fails
+// and reopening the adapter if it wedges.
+func (c *collector) scan(ctx context.Context, a *adapter) {
+	backoff := minScanBackoff
+	wait := func() bool {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false
+		}
+		if backoff *= 2; backoff > maxScanBackoff {
+			backoff = maxScanBackoff
+		}
+		return true
+	}
+	reopen := false
+	for {
+		if reopen {
+			if err := a.reopen(); err != nil {
+				bleLog.Errorf("%s: reopening adapter failed, retrying in %s: %s", a.name, backoff, err)
+				if !wait() {
+					return
+				}
+				continue
+			}
+			reopen = false
+		}
+
+		scanCtx, cancelScan := context.WithCancel(ctx)
+		atomic.StoreInt64(&a.lastAdv, time.Now().UnixNano())
+		var wedged int32
+		if c.watchdog > 0 {
+			go func() {
+				ticker := time.NewTicker(c.watchdog / 10)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						last := time.Unix(0, atomic.LoadInt64(&a.lastAdv))
+						if time.Since(last) > c.watchdog {
+							atomic.StoreInt32(&wedged, 1)
+							cancelScan()
+							return
+						}
+					case <-scanCtx.Done():
+						return
 					}
 				}
+			}()
+		}
+
+		bleLog.Infof("%s: starting scan", a.name)
+		started := time.Now()
+		atomic.StoreInt32(&a.scanning, 1)
+		err := a.device().Scan(scanCtx, a.allowDup, func(adv ble.Advertisement) {
+			atomic.StoreInt64(&a.lastAdv, time.Now().UnixNano())
+			if !c.captureFails {
+				c.captureAdv(adv)
+			}
+			if c.advFilter(adv) {
+				c.advHandler(a.name, adv)
+			}
+		})
+		atomic.StoreInt32(&a.scanning, 0)
+		cancelScan()
+		if ctx.Err() != nil {
+			return
+		}
+
+		scanRestarts.Add(a.name, 1)
+		if time.Since(started) > maxScanBackoff {
+			backoff = minScanBackoff // it had been working
+		}
+		if atomic.LoadInt32(&wedged) == 1 {
+			bleLog.Warnf("%s: no advertisements for %s, reopening adapter", a.name, c.watchdog)
+			reopen = true
+			backoff = minScanBackoff
+			continue
+		}
+		bleLog.Errorf("%s: scan stopped, restarting in %s: %v", a.name, backoff, err)
+		if !wait() {
+			return
+		}
+	}
+}
+
+// run scans for advertisements with each adapter until ctx is cancelled, then
+// shuts down.
+func (c *collector) run(ctx context.Context, adapters []*adapter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	atomic.StoreInt64(&c.lastFlush, time.Now().UnixNano())
+	c.mu.Lock()
+	c.outputs.Configure(c.devices())
+	c.outputs.Start()
+	c.mu.Unlock()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if c.once {
+			// shutdown does the one flush
+			select {
+			case <-time.After(c.interval):
+				cancel()
+			case <-ctx.Done():
 			}
+			return
 		}
+		c.flushLoop(ctx)
 	}()
+	if c.configPath != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.reloadOnSignal(ctx)
+		}()
+	}
+	if len(adapters) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.pollLoop(ctx, adapters[0])
+		}()
+	}
+
+	var scans sync.WaitGroup
+	for _, a := range adapters {
+		scans.Add(1)
+		go func(a *adapter) {
+			defer scans.Done()
+			c.scan(ctx, a)
+		}(a)
+	}
+	sdNotify("READY=1")
+	scans.Wait()
+	cancel()
+	wg.Wait()
+	c.shutdown(c.shutdownTimeout)
+	return nil
+}
+
+// lastSeen returns the seconds since each sensor was last heard from, for
+// /debug/vars.
+func (c *collector) lastSeen() interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := time.Now()
+	ages := make(map[string]float64)
+	for _, s := range c.sensors {
+		ages[s.Name] = now.Sub(s.LastHeard()).Round(time.Second).Seconds()
+	}
+	return ages
+}
+
+// lastHeard returns when each sensor was last heard from, for the
+// dashboard.
+func (c *collector) lastHeard() map[string]time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	seen := make(map[string]time.Time, len(c.sensors))
+	for _, s := range c.sensors {
+		seen[s.Name] = s.LastHeard()
+	}
+	return seen
+}
+
+// devices describes the configured sensors to the outputs; c.mu must be
+// held.
+func (c *collector) devices() []output.Device {
+	devices := make([]output.Device, 0, len(c.sensors))
+	for _, s := range c.sensors {
+		devices = append(devices, output.Device{Name: s.Name, MAC: s.MAC, Model: s.Model, Profile: s.Output})
+	}
+	for _, z := range c.zones {
+		devices = append(devices, output.Device{Name: z.name, Model: "zone", Profile: z.profile, Zone: true})
+	}
+	return devices
+}
+
+// reloadOnSignal reloads the configuration on each SIGHUP until ctx is
+// cancelled.
+func (c *collector) reloadOnSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			mainLog.Infof("received SIGHUP, reloading %s", c.configPath)
+			sdNotify("RELOADING=1")
+			conf, err := loadConfig(c.configPath)
+			if err == nil {
+				err = c.reload(conf)
+			}
+			if err != nil {
+				mainLog.Errorf("reload: %s; keeping the current configuration", err)
+			}
+			sdNotify("READY=1")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload applies conf to the running collector. Sensors are added, removed
+// or reconfigured, keeping the readings they've gathered this interval and
+// their flush schedule unless their interval changed, and
+// the InfluxDB output is rebuilt if the database or buffer settings changed.
+// Other settings only take effect on restart.
+func (c *collector) reload(conf *Config) error {
+	sensors, err := newSensors(conf)
+	if err != nil {
+		return err
+	}
+	clock, err := newClock(conf)
+	if err != nil {
+		return err
+	}
+	zones, err := newZones(conf, sensors)
+	if err != nil {
+		return err
+	}
+	reconnect := !c.dryRun && (conf.Database != c.conf.Database || conf.Buffer != c.conf.Buffer || conf.Hourly != c.conf.Hourly ||
+		conf.Units != c.conf.Units || conf.Timeout != c.conf.Timeout)
+	var influx *output.Influx
+	if reconnect {
+		if influx, err = newInflux(conf); err != nil {
+			return err
+		}
+	}
 
-	log.Print("starting scan")
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	ctx := ble.WithSigHandler(context.WithCancel(context.Background()))
-	ble.Scan(ctx, true, advHandler, advFilter)
+	for mac, s := range sensors {
+		if old, ok := c.sensors[mac]; ok {
+			s.Adopt(old)
+		} else {
+			mainLog.Infof("reload: adding %s (%s)", s.Name, mac)
+		}
+	}
+	added := make(map[string]*sensorConfig)
+	for mac, sc := range c.added {
+		if s, ok := sensors[mac]; ok {
+			mainLog.Infof("reload: %s (%s), added through the API, is now configured", s.Name, mac)
+			continue
+		}
+		if sensorNamed(sensors, sc.Name) {
+			mainLog.Warnf("reload: removing %s (%s), added through the API, as its name is now configured", sc.Name, mac)
+			continue
+		}
+		s, err := newConfiguredSensor(conf, *sc)
+		if err != nil {
+			mainLog.Warnf("reload: removing %s (%s), added through the API: %s", sc.Name, mac, err)
+			continue
+		}
+		if old, ok := c.sensors[mac]; ok {
+			s.Adopt(old)
+		}
+		sensors[mac] = s
+		added[mac] = sc
+	}
+	accepted := make(map[string]bool)
+	for mac, old := range c.sensors {
+		if _, ok := sensors[mac]; ok {
+			continue
+		}
+		if c.accepted[mac] && conf.AcceptUnknown {
+			if s, err := newUnknownSensor(conf, mac); err == nil {
+				s.Adopt(old)
+				sensors[mac] = s
+				accepted[mac] = true
+				continue
+			}
+		}
+		mainLog.Infof("reload: removing %s (%s)", old.Name, mac)
+	}
+	old := c.sensors
+	c.accepted = accepted
+	c.added = added
+	c.rpaMu.Lock()
+	c.rpas = make(map[string]string)
+	c.rpaMu.Unlock()
+	c.sensors = sensors
+	c.disabled, _ = disabledSensors(conf)
+	c.zones = zones
+	c.clock = clock
+	c.schedule(time.Now(), old)
+	select {
+	case c.rescheduled <- struct{}{}:
+	default:
+	}
+
+	if reconnect {
+		mainLog.Infof("reload: database settings changed, reconnecting")
+		if c.influx != nil {
+			if influx != nil {
+				influx.TakeOver(c.influx)
+			} else {
+				ctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+				c.influx.Close(ctx)
+				cancel()
+			}
+		}
+		c.influx = influx
+		if influx != nil {
+			c.outputs.Set("influxdb", output.WithUnits(influx, conf.unitsFor(conf.Database.Units)))
+		} else {
+			c.outputs.Set("influxdb", nil)
+		}
+	}
+	c.outputs.SetTimeout(conf.writeTimeout())
+	c.outputs.Configure(c.devices())
+	c.outputs.Start()
+	c.conf = conf
+	mainLog.Infof("reload: %d sensors configured", len(sensors))
+	return nil
+}
+
+// withSignals returns a context cancelled on SIGINT or SIGTERM. A second
+// signal terminates the process immediately.
+func withSignals(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			mainLog.Infof("received %s, shutting down", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
+
+func runDiscover() error {
+	scan := defaultScan
+	scan.passive = passiveScan
+	d, err := newDevice(scan.options()...)
+	if err != nil {
+		return err
+	}
+	defer d.Stop()
+
+	ctx, cancel := withSignals(context.Background())
+	defer cancel()
+	return discover(ctx, d, discoverFor, discoverTOML)
+}
+
+func run() error {
+	var conf *Config
+	var err error
+	if envMode {
+		conf, err = loadEnvConfig()
+	} else {
+		conf, err = loadConfig(configFile)
+	}
+	if err != nil {
+		return err
+	}
+	if addr := debugAddr(conf.Debug); addr != "" {
+		go func() {
+			mainLog.Errorf("debug: %s", serveDebug(conf.Debug, addr))
+		}()
+	}
+	// the adapters need root, but the outputs' files, such as the SQLite
+	// database, are created as the user they're written as
+	adapters, err := newAdapters(conf)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, a := range adapters {
+			a.stop()
+		}
+	}()
+	if conf.User != "" {
+		if err := dropPrivileges(conf.User, conf.Group); err != nil {
+			return err
+		}
+		mainLog.Infof("adapters open, running as %s", conf.User)
+	}
+	// Telegraf gets the dry run's line protocol on stdout, and nothing else
+	c, err := newCollector(conf, dryRun || telegrafMode)
+	if err != nil {
+		return err
+	}
+	if telegrafMode {
+		c.outputs.Set("stdout", nil)
+	}
+	if !envMode {
+		c.configPath = configFile
+	}
+	c.once = once
+	if captureFile != "" {
+		if c.capture, err = openCapture(captureFile); err != nil {
+			return err
+		}
+		defer c.capture.Close()
+		c.captureFails = captureFails
+		mainLog.Infof("capturing advertisements to %s", captureFile)
+	}
+	if dumpUnknown != "" {
+		if c.unknown, err = openUnknownDump(dumpUnknown); err != nil {
+			return err
+		}
+		defer c.unknown.Close()
+	}
+	expvar.Publish("last_seen_secs", expvar.Func(c.lastSeen))
+	if c.exporter != nil {
+		addr := conf.Exporter.Listen
+		if addr == "" {
+			addr = ":9110"
+		}
+		go func() {
+			mainLog.Errorf("exporter: %s", c.exporter.Serve(addr))
+		}()
+	}
+	if c.dash != nil {
+		addr := conf.Dashboard.Listen
+		if addr == "" {
+			addr = ":8080"
+		}
+		go func() {
+			mainLog.Errorf("dashboard: %s", c.dash.Serve(addr))
+		}()
+	}
+	c.adapters = adapters
+	http.HandleFunc("/healthz", c.serveHealth)
+	http.HandleFunc("/readyz", c.serveReady)
+	http.Handle("/stream", c.stream)
+	if conf.Health.Listen != "" {
+		go func() {
+			mainLog.Errorf("health: %s", c.serveHealthListener(conf.Health.Listen))
+		}()
+	}
+
+	ctx, cancel := withSignals(context.Background())
+	defer cancel()
+	if conf.Ingest.Listen != "" {
+		go func() {
+			mainLog.Errorf("ingest: %s", c.serveIngest(conf.Ingest))
+		}()
+	}
+	if conf.Ingest.UDP != "" {
+		go func() {
+			if err := c.serveIngestUDP(ctx, conf.Ingest); err != nil {
+				mainLog.Errorf("ingest: %s", err)
+			}
+		}()
+	}
+	if conf.API.Listen != "" {
+		go func() {
+			mainLog.Errorf("api: %s", c.serveAPI(conf.API))
+		}()
+	}
+	if telegrafMode {
+		mainLog.Infof("telegraf mode: flushing when Telegraf signals")
+		go c.telegrafTriggers(ctx, cancel, os.Stdin)
+	}
+	if c.relay != nil {
+		mainLog.Infof("relay mode: forwarding advertisements as %s", c.relay.conf.Receiver)
+		go c.relay.run(ctx)
+	}
+	return c.run(ctx, adapters)
 }
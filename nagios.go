@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+var (
+	checkSensor string
+	checkField  string
+	checkWarn   string
+	checkCrit   string
+	checkURL    string
+	checkFor    time.Duration
+	checkMaxAge time.Duration
+)
+
+// The Nagios plugin exit statuses.
+const (
+	nagiosOK = iota
+	nagiosWarning
+	nagiosCritical
+	nagiosUnknown
+)
+
+var nagiosStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// nagiosRange is a threshold in the Nagios plugin range format: "10" alerts
+// outside 0 to 10, "10:" below 10, "~:10" above 10, "10:20" outside 10 to 20,
+// and a leading @ inverts any of them.
+type nagiosRange struct {
+	spec     string
+	min, max float64
+	inside   bool
+}
+
+func parseNagiosRange(s string) (*nagiosRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	r := &nagiosRange{spec: s, max: math.Inf(1)}
+	if strings.HasPrefix(s, "@") {
+		r.inside = true
+		s = s[1:]
+	}
+	if s == "" {
+		return nil, fmt.Errorf("bad range %q", r.spec)
+	}
+	lo, hi := "0", s
+	if i := strings.Index(s, ":"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	var err error
+	switch lo {
+	case "~":
+		r.min = math.Inf(-1)
+	default:
+		if r.min, err = strconv.ParseFloat(lo, 64); err != nil {
+			return nil, fmt.Errorf("bad range %q", r.spec)
+		}
+	}
+	if hi != "" {
+		if r.max, err = strconv.ParseFloat(hi, 64); err != nil {
+			return nil, fmt.Errorf("bad range %q", r.spec)
+		}
+	}
+	if r.min > r.max {
+		return nil, fmt.Errorf("bad range %q: start is after end", r.spec)
+	}
+	return r, nil
+}
+
+// alerts reports whether v is outside the range, or inside it for an @
+// range.
+func (r *nagiosRange) alerts(v float64) bool {
+	if r == nil {
+		return false
+	}
+	in := v >= r.min && v <= r.max
+	return in == r.inside
+}
+
+func (r *nagiosRange) String() string {
+	if r == nil {
+		return ""
+	}
+	return r.spec
+}
+
+// runCheck reads a sensor, from the daemon at -url or else by scanning, and
+// prints a Nagios plugin result for the field, returning its exit status.
+func runCheck() int {
+	unknown := func(format string, a ...interface{}) int {
+		fmt.Printf("MIJIAMON UNKNOWN - %s\n", fmt.Sprintf(format, a...))
+		return nagiosUnknown
+	}
+	if checkSensor == "" {
+		return unknown("no -sensor given")
+	}
+	warn, err := parseNagiosRange(checkWarn)
+	if err != nil {
+		return unknown("-warn: %s", err)
+	}
+	crit, err := parseNagiosRange(checkCrit)
+	if err != nil {
+		return unknown("-crit: %s", err)
+	}
+	var fields decode.Data
+	if checkURL != "" {
+		fields, err = checkDaemon(checkURL, checkSensor, checkMaxAge)
+	} else {
+		fields, err = scanForReading(checkSensor, checkField, checkFor)
+	}
+	if err != nil {
+		return unknown("%s", err)
+	}
+	v, ok := numericField(fields[checkField])
+	if !ok {
+		return unknown("%s has no %s reading", checkSensor, checkField)
+	}
+	state := nagiosOK
+	switch {
+	case crit.alerts(v):
+		state = nagiosCritical
+	case warn.alerts(v):
+		state = nagiosWarning
+	}
+	fmt.Printf("MIJIAMON %s - %s %s %g | %s\n", nagiosStates[state], checkSensor, checkField, v,
+		perfdata(fields, checkField, warn, crit))
+	return state
+}
+
+// perfdata formats the numeric fields as Nagios performance data, with the
+// thresholds on the checked field.
+func perfdata(fields decode.Data, checked string, warn, crit *nagiosRange) string {
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		if _, ok := numericField(fields[k]); ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for i, k := range names {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		v, _ := numericField(fields[k])
+		fmt.Fprintf(&b, "%s=%g", k, v)
+		if unit := perfUnits[k]; unit != "" {
+			b.WriteString(unit)
+		}
+		if k == checked && (warn != nil || crit != nil) {
+			fmt.Fprintf(&b, ";%s;%s", warn, crit)
+		}
+	}
+	return b.String()
+}
+
+// perfUnits are the units of the fields with one Nagios knows.
+var perfUnits = map[string]string{
+	"battery_pct": "%",
+	"humidity":    "%",
+}
+
+func numericField(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// checkDaemon returns sensor's last reading from the /healthz of the daemon
+// at url, failing if it's older than maxAge.
+func checkDaemon(url, sensor string, maxAge time.Duration) (decode.Data, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(url, "/") + "/healthz")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// a 503 still describes the sensors
+	var st status
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, fmt.Errorf("%s: %s", resp.Request.URL, err)
+	}
+	ss, ok := st.Sensors[sensor]
+	if !ok {
+		return nil, fmt.Errorf("the daemon has no sensor %s", sensor)
+	}
+	if ss.Reading == nil {
+		return nil, fmt.Errorf("no reading from %s yet", sensor)
+	}
+	if age := time.Since(ss.Reading.Time); maxAge > 0 && age > maxAge {
+		return nil, fmt.Errorf("last reading from %s was %s ago", sensor, age.Round(time.Second))
+	}
+	return ss.Reading.Fields, nil
+}
+
+// scanForReading scans for up to d for a reading of field from sensor, as
+// configured in the config file.
+func scanForReading(name, field string, d time.Duration) (decode.Data, error) {
+	var conf *Config
+	var err error
+	if envMode {
+		conf, err = loadEnvConfig()
+	} else {
+		conf, err = loadConfig(configFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sensors, err := newSensors(conf)
+	if err != nil {
+		return nil, err
+	}
+	var mac string
+	for m, s := range sensors {
+		if s.Name == name {
+			mac = m
+		}
+	}
+	s, ok := sensors[mac]
+	if !ok {
+		return nil, fmt.Errorf("no sensor %s configured", name)
+	}
+	scan, err := conf.scanSettings("hci0")
+	if err != nil {
+		return nil, err
+	}
+	dev, err := newDevice(scan.options()...)
+	if err != nil {
+		return nil, err
+	}
+	defer dev.Stop()
+
+	ctx, cancel := withSignals(context.Background())
+	defer cancel()
+	ctx, timeout := context.WithTimeout(ctx, d)
+	defer timeout()
+	found := make(chan decode.Data, 1)
+	err = dev.Scan(ctx, true, func(a ble.Advertisement) {
+		addr := a.Addr().String()
+		if hw, _ := net.ParseMAC(addr); addr != mac && !s.Resolves(hw) {
+			return
+		}
+		s.Seen(a.RSSI())
+		for _, sd := range a.ServiceData() {
+			if s.ProcessAdv(sd.UUID.String(), sd.Data) == nil {
+				continue
+			}
+			// flushed per advertisement, as only the one field matters
+			if fields := s.Flush(); fields[field] != nil {
+				select {
+				case found <- fields:
+					cancel()
+				default:
+				}
+			}
+		}
+	})
+	select {
+	case fields := <-found:
+		return fields, nil
+	default:
+	}
+	if err != nil && err != context.DeadlineExceeded && err != context.Canceled {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no %s reading from %s within %s", field, name, d)
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestNagiosRange(t *testing.T) {
+	for _, tc := range []struct {
+		spec   string
+		alerts []float64
+		ok     []float64
+	}{
+		{"", nil, []float64{-100, 0, 100}},
+		{"10", []float64{-0.1, 10.1}, []float64{0, 5, 10}},
+		{"10:", []float64{-5, 9.9}, []float64{10, 1000}},
+		{"~:10", []float64{10.1}, []float64{-1000, 0, 10}},
+		{"-5.5:20", []float64{-5.6, 20.1}, []float64{-5.5, 0, 20}},
+		{"@10:20", []float64{10, 15, 20}, []float64{9.9, 20.1}},
+		{"@~:0", []float64{-1, 0}, []float64{0.1}},
+		{"5:5", []float64{4.9, 5.1}, []float64{5}},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			r, err := parseNagiosRange(tc.spec)
+			if err != nil {
+				t.Fatalf("parseNagiosRange(%q) = %s", tc.spec, err)
+			}
+			if r.String() != tc.spec {
+				t.Errorf("String() = %q, want %q", r, tc.spec)
+			}
+			for _, v := range tc.alerts {
+				if !r.alerts(v) {
+					t.Errorf("alerts(%g) = false, want true", v)
+				}
+			}
+			for _, v := range tc.ok {
+				if r.alerts(v) {
+					t.Errorf("alerts(%g) = true, want false", v)
+				}
+			}
+		})
+	}
+
+	for _, spec := range []string{"x", "10:x", "x:10", "@", "20:10", "~:~"} {
+		if _, err := parseNagiosRange(spec); err == nil {
+			t.Errorf("parseNagiosRange(%q) = nil error, want one", spec)
+		}
+	}
+}
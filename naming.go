@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultNameTemplate names sensors configured without a name, unless
+// name_template says otherwise.
+const defaultNameTemplate = "{type}-{mac_suffix}"
+
+var nameVar = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+
+// nameSensors names the sensors configured without a name from the name
+// template.
+func nameSensors(conf *Config) error {
+	for i, s := range conf.Sensors {
+		if s.Name != "" {
+			continue
+		}
+		name, err := sensorName(conf, s)
+		if err != nil {
+			return err
+		}
+		conf.Sensors[i].Name = name
+	}
+	return nil
+}
+
+// sensorName returns the name of the sensor s, which hasn't one configured,
+// from the name template. {mac} is its MAC address without colons,
+// {mac_suffix} the last six digits of it, {type} its type (or "sensor" if
+// it's detected), and any other {tag} the value of one of its tags.
+func sensorName(conf *Config, s sensorConfig) (string, error) {
+	tmpl := conf.NameTemplate
+	if tmpl == "" {
+		tmpl = defaultNameTemplate
+	}
+	mac := strings.ToLower(strings.Replace(s.Mac, ":", "", -1))
+	typ := s.Type
+	if typ == "" && len(s.Types) > 0 {
+		typ = s.Types[0]
+	}
+	if typ == "" || typ == "auto" {
+		typ = "sensor"
+	}
+	var err error
+	name := nameVar.ReplaceAllStringFunc(tmpl, func(v string) string {
+		switch k := v[1 : len(v)-1]; k {
+		case "mac":
+			return mac
+		case "mac_suffix":
+			if len(mac) < 6 {
+				return mac
+			}
+			return mac[len(mac)-6:]
+		case "type":
+			return nameToken(typ)
+		default:
+			t, ok := s.Tags[k]
+			if !ok {
+				t, ok = conf.Tags[k]
+			}
+			if !ok && err == nil {
+				err = fmt.Errorf("sensor %s: name_template %s: no tag %s", s.Mac, tmpl, k)
+			}
+			return t
+		}
+	})
+	return name, err
+}
+
+// nameToken lowercases s and drops the characters other than letters and
+// digits, turning a type such as LYWSDCGQ/01ZM into lywsdcgq01zm.
+func nameToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return -1
+	}, s)
+}
@@ -0,0 +1,240 @@
+// Package alert evaluates threshold rules against sensor readings and sends
+// notifications when they fire and resolve.
+package alert
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// Log receives the package's messages, e.g. about failed notifications.
+var Log = decode.Discard
+
+// RuleConfig configures a rule.
+type RuleConfig struct {
+	// e.g. "temperature > 30 for 10m" or "battery_pct < 15"; the
+	// comparison is one of <, <=, >, >=, == or !=.
+	Rule    string
+	Sensors []string // the sensors it applies to, by name; defaults to all
+}
+
+// Config configures alerting.
+type Config struct {
+	Rules []RuleConfig
+	// Minimum time between notifications for the same rule and sensor;
+	// the alert is still tracked, so an alert firing during this time is
+	// reported when it's next notified. Defaults to 1h.
+	Cooldown string
+	Webhooks []WebhookConfig
+	Pushover PushoverConfig
+	SMTP     SMTPConfig
+}
+
+// Rule is a parsed rule.
+type Rule struct {
+	Text      string
+	Field     string
+	Op        string
+	Threshold float64
+	For       time.Duration
+	sensors   map[string]bool
+}
+
+var ops = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// ParseRule parses a rule like "temperature > 30 for 10m".
+func ParseRule(text string) (Rule, error) {
+	f := strings.Fields(text)
+	if len(f) != 3 && len(f) != 5 {
+		return Rule{}, fmt.Errorf("rule %q: want <field> <op> <value> [for <duration>]", text)
+	}
+	r := Rule{Text: text, Field: f[0], Op: f[1]}
+	if _, ok := ops[r.Op]; !ok {
+		return Rule{}, fmt.Errorf("rule %q: unknown comparison %s", text, r.Op)
+	}
+	var err error
+	if r.Threshold, err = strconv.ParseFloat(f[2], 64); err != nil {
+		return Rule{}, fmt.Errorf("rule %q: bad value %s", text, f[2])
+	}
+	if len(f) == 5 {
+		if f[3] != "for" {
+			return Rule{}, fmt.Errorf("rule %q: want for <duration>, got %s", text, f[3])
+		}
+		if r.For, err = time.ParseDuration(f[4]); err != nil {
+			return Rule{}, fmt.Errorf("rule %q: %s", text, err)
+		}
+	}
+	return r, nil
+}
+
+// Alert describes a rule firing or resolving for a sensor.
+type Alert struct {
+	Rule     string    `json:"rule"`
+	Sensor   string    `json:"sensor"`
+	Field    string    `json:"field"`
+	Value    float64   `json:"value"`
+	Resolved bool      `json:"resolved"`
+	Since    time.Time `json:"since"` // when the condition first held
+	Time     time.Time `json:"time"`
+}
+
+// Message returns a one-line description of a.
+func (a Alert) Message() string {
+	if a.Resolved {
+		return fmt.Sprintf("%s: resolved, %s is %g (%s)", a.Sensor, a.Field, a.Value, a.Rule)
+	}
+	return fmt.Sprintf("%s: %s is %g (%s)", a.Sensor, a.Field, a.Value, a.Rule)
+}
+
+// Title returns a short summary of a, for notifications with a subject.
+func (a Alert) Title() string {
+	state := "FIRING"
+	if a.Resolved {
+		state = "RESOLVED"
+	}
+	return fmt.Sprintf("[%s] %s %s", state, a.Sensor, a.Field)
+}
+
+// Notifier sends alerts somewhere.
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+type key struct {
+	rule   int
+	sensor string
+}
+
+type state struct {
+	since        time.Time // when the condition started holding
+	firing       bool
+	notified     bool // the firing was notified, so its resolution should be
+	lastNotified time.Time
+}
+
+// Manager evaluates rules against each reading written to it and notifies
+// when they fire and resolve. It implements output.Output.
+type Manager struct {
+	rules     []Rule
+	cooldown  time.Duration
+	notifiers []Notifier
+
+	mu     sync.Mutex
+	states map[key]*state
+}
+
+// New returns a manager for conf.
+func New(conf Config) (*Manager, error) {
+	m := &Manager{cooldown: time.Hour, states: make(map[key]*state)}
+	if conf.Cooldown != "" {
+		var err error
+		if m.cooldown, err = time.ParseDuration(conf.Cooldown); err != nil {
+			return nil, fmt.Errorf("alerts cooldown: %s", err)
+		}
+	}
+	for _, rc := range conf.Rules {
+		r, err := ParseRule(rc.Rule)
+		if err != nil {
+			return nil, err
+		}
+		if len(rc.Sensors) > 0 {
+			r.sensors = make(map[string]bool)
+			for _, s := range rc.Sensors {
+				r.sensors[s] = true
+			}
+		}
+		m.rules = append(m.rules, r)
+	}
+	for _, w := range conf.Webhooks {
+		m.notifiers = append(m.notifiers, &Webhook{w})
+	}
+	if conf.Pushover.Token != "" {
+		m.notifiers = append(m.notifiers, &Pushover{conf.Pushover})
+	}
+	if conf.SMTP.Host != "" {
+		m.notifiers = append(m.notifiers, &SMTP{conf.SMTP})
+	}
+	return m, nil
+}
+
+func value(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// Write evaluates the rules against a reading from the sensor called name.
+func (m *Manager) Write(_ context.Context, name string, fields decode.Data, ts time.Time) error {
+	var alerts []Alert
+	m.mu.Lock()
+	for i, r := range m.rules {
+		if r.sensors != nil && !r.sensors[name] {
+			continue
+		}
+		v, ok := value(fields[r.Field])
+		if !ok {
+			continue
+		}
+		k := key{i, name}
+		st, ok := m.states[k]
+		if !ok {
+			st = &state{}
+			m.states[k] = st
+		}
+		a := Alert{Rule: r.Text, Sensor: name, Field: r.Field, Value: v, Time: ts}
+		if !ops[r.Op](v, r.Threshold) {
+			if st.firing && st.notified {
+				a.Resolved, a.Since = true, st.since
+				alerts = append(alerts, a)
+			}
+			st.since, st.firing, st.notified = time.Time{}, false, false
+			continue
+		}
+		if st.since.IsZero() {
+			st.since = ts
+		}
+		if st.notified || ts.Sub(st.since) < r.For {
+			continue
+		}
+		st.firing = true
+		if ts.Sub(st.lastNotified) < m.cooldown {
+			continue
+		}
+		st.notified, st.lastNotified = true, ts
+		a.Since = st.since
+		alerts = append(alerts, a)
+	}
+	m.mu.Unlock()
+	for _, a := range alerts {
+		Log.Warnf("alert: %s", a.Message())
+		go m.notify(a)
+	}
+	return nil
+}
+
+func (m *Manager) notify(a Alert) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, n := range m.notifiers {
+		if err := n.Notify(ctx, a); err != nil {
+			Log.Errorf("alert: %T: %s", n, err)
+		}
+	}
+}
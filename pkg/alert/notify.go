@@ -0,0 +1,108 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// WebhookConfig configures a webhook, which is POSTed each alert as JSON.
+type WebhookConfig struct {
+	URL string
+}
+
+// Webhook posts alerts as JSON, with a message field describing them.
+type Webhook struct {
+	conf WebhookConfig
+}
+
+func (w *Webhook) Notify(ctx context.Context, a Alert) error {
+	b, err := json.Marshal(struct {
+		Alert
+		Message string `json:"message"`
+	}{a, a.Message()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.conf.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(req)
+}
+
+// PushoverConfig configures Pushover notifications.
+type PushoverConfig struct {
+	Token string // the application's API token
+	User  string // the user or group key
+}
+
+// Pushover sends alerts with the Pushover API.
+type Pushover struct {
+	conf PushoverConfig
+}
+
+func (p *Pushover) Notify(ctx context.Context, a Alert) error {
+	form := url.Values{
+		"token":   {p.conf.Token},
+		"user":    {p.conf.User},
+		"title":   {a.Title()},
+		"message": {a.Message()},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.pushover.net/1/messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return do(req)
+}
+
+func do(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// SMTPConfig configures email notifications.
+type SMTPConfig struct {
+	Host string
+	Port int // defaults to 587
+	User string
+	Pass string
+	From string
+	To   []string
+}
+
+// SMTP emails alerts, authenticating if a user is set.
+type SMTP struct {
+	conf SMTPConfig
+}
+
+func (s *SMTP) Notify(_ context.Context, a Alert) error {
+	port := s.conf.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if s.conf.User != "" {
+		auth = smtp.PlainAuth("", s.conf.User, s.conf.Pass, s.conf.Host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n",
+		s.conf.From, strings.Join(s.conf.To, ", "), a.Title(), a.Message())
+	addr := net.JoinHostPort(s.conf.Host, strconv.Itoa(port))
+	return smtp.SendMail(addr, auth, s.conf.From, s.conf.To, []byte(msg))
+}
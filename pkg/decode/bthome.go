@@ -0,0 +1,190 @@
+package decode
+
+import (
+	"crypto/aes"
+	"errors"
+	"fmt"
+)
+
+// BTHome v2 device information flags.
+const (
+	bthomeFlagEncrypted = 0x01
+	bthomeVersion       = 2
+)
+
+// bthomeObjectSizes gives the payload length of each BTHome v2 object, which
+// is needed to walk an advertisement; 0x53 and 0x54 are length-prefixed.
+var bthomeObjectSizes = map[byte]int{
+	0x00: 1, 0x01: 1, 0x02: 2, 0x03: 2, 0x04: 3, 0x05: 3, 0x06: 2, 0x07: 2,
+	0x08: 2, 0x09: 1, 0x0a: 3, 0x0b: 3, 0x0c: 2, 0x0d: 2, 0x0e: 2, 0x0f: 1,
+	0x10: 1, 0x11: 1, 0x12: 2, 0x13: 2, 0x14: 2, 0x15: 1, 0x16: 1, 0x17: 1,
+	0x18: 1, 0x19: 1, 0x1a: 1, 0x1b: 1, 0x1c: 1, 0x1d: 1, 0x1e: 1, 0x1f: 1,
+	0x20: 1, 0x21: 1, 0x22: 1, 0x23: 1, 0x24: 1, 0x25: 1, 0x26: 1, 0x27: 1,
+	0x28: 1, 0x29: 1, 0x2a: 1, 0x2b: 1, 0x2c: 1, 0x2d: 1, 0x2e: 1, 0x2f: 1,
+	0x3a: 1, 0x3c: 2, 0x3d: 2, 0x3e: 4, 0x3f: 2, 0x40: 2, 0x41: 2, 0x42: 3,
+	0x43: 2, 0x44: 2, 0x45: 2, 0x46: 1, 0x47: 2, 0x48: 2, 0x49: 2, 0x4a: 2,
+	0x4b: 3, 0x4c: 4, 0x4d: 4, 0x4e: 4, 0x4f: 4, 0x50: 4, 0x51: 2, 0x52: 2,
+	0xf0: 2, 0xf1: 4, 0xf2: 3,
+}
+
+// bthomeObject describes how a BTHome v2 measurement object's value, a
+// little-endian integer, is decoded: into field, divided by div, or as an
+// int if div is 0.
+type bthomeObject struct {
+	field  string
+	signed bool
+	div    float64
+}
+
+// bthomeObjects are the measurement objects decoded, including the ones pvvx
+// firmware sends.
+var bthomeObjects = map[byte]bthomeObject{
+	0x00: {"packet_counter", false, 0},
+	0x01: {"battery_pct", false, 0},
+	0x02: {"temperature", true, 100},
+	0x03: {"humidity", false, 100},
+	0x04: {"pressure", false, 100},
+	0x05: {"illuminance", false, 100},
+	0x08: {"dew_point", true, 100},
+	0x09: {"count", false, 0},
+	0x0c: {"battery_mv", false, 0}, // voltage, in mV
+	0x0d: {"pm2_5", false, 0},
+	0x0e: {"pm10", false, 0},
+	0x10: {"power", false, 0},
+	0x11: {"opening", false, 0},
+	0x12: {"co2", false, 0},
+	0x13: {"tvoc", false, 0},
+	0x14: {"moisture", false, 100},
+	0x15: {"battery_low", false, 0},
+	0x1a: {"door", false, 0},
+	0x20: {"water_leak", false, 0},
+	0x21: {"motion", false, 0},
+	0x29: {"smoke", false, 0},
+	0x2d: {"window", false, 0},
+	0x2e: {"humidity", false, 1},
+	0x2f: {"moisture", false, 1},
+	0x3d: {"count", false, 0},
+	0x3e: {"count", false, 0},
+	0x45: {"temperature", true, 10},
+}
+
+// bthomeWalk calls f with the ID and value of each object in BTHome v2
+// object data b, stopping at the first it can't walk past.
+func bthomeWalk(b []byte, f func(id byte, v []byte)) {
+	for i := 0; i < len(b); {
+		id := b[i]
+		n, ok := bthomeObjectSizes[id]
+		if id == 0x53 || id == 0x54 {
+			if i+1 >= len(b) {
+				break
+			}
+			n, ok = int(b[i+1])+1, true
+		}
+		if !ok || i+1+n > len(b) {
+			break
+		}
+		f(id, b[i+1:i+1+n])
+		i += 1 + n
+	}
+}
+
+func bthomeInfo(d Data, id byte, v []byte) {
+	switch id {
+	case 0xf0:
+		d["device_type_id"] = int(uint16(v[0]) | uint16(v[1])<<8)
+	case 0xf1:
+		d["firmware_version"] = fmt.Sprintf("%d.%d.%d.%d", v[3], v[2], v[1], v[0])
+	case 0xf2:
+		d["firmware_version"] = fmt.Sprintf("%d.%d.%d", v[2], v[1], v[0])
+	}
+}
+
+// BTHomeInfo decodes the device information objects in fcd2 (BTHome v2)
+// service data.
+func BTHomeInfo(b []byte) Data {
+	// pvvx firmware in BTHome v2 mode appends device information objects,
+	// e.g. 40 f0 01 00 f1 00 01 04 04 is device type 1, firmware 4.4.1.0.
+	// Encrypted payloads aren't handled.
+	if len(b) < 1 || b[0]&bthomeFlagEncrypted != 0 || b[0]>>5 != bthomeVersion {
+		return Data{}
+	}
+	d := Data{}
+	bthomeWalk(b[1:], func(id byte, v []byte) { bthomeInfo(d, id, v) })
+	return d
+}
+
+// NewBTHome returns a processor for fcd2 (BTHome v2) service data from the
+// device with address mac, decrypting it with key if it's encrypted.
+func NewBTHome(key, mac []byte) Processor {
+	return func(b []byte) Data {
+		objs, err := BTHomeObjects(b, key, mac)
+		if err != nil {
+			Log.Debugf("bthome: %s", err)
+			return Data{}
+		}
+		d := Data{}
+		bthomeWalk(objs, func(id byte, v []byte) {
+			o, ok := bthomeObjects[id]
+			if !ok {
+				bthomeInfo(d, id, v)
+				return
+			}
+			var u uint64
+			for i := len(v) - 1; i >= 0; i-- {
+				u = u<<8 | uint64(v[i])
+			}
+			n := int64(u)
+			if o.signed && len(v) < 8 && u&(1<<(8*uint(len(v))-1)) != 0 {
+				n -= 1 << (8 * uint(len(v)))
+			}
+			if o.div == 0 {
+				d[o.field] = int(n)
+			} else {
+				d[o.field] = float64(n) / o.div
+			}
+		})
+		return d
+	}
+}
+
+// BTHomeObjects returns the plaintext object data of BTHome v2 service data,
+// decrypting it with key, given the address mac of the device sending it, if
+// it's encrypted.
+func BTHomeObjects(b []byte, key, mac []byte) ([]byte, error) {
+	if len(b) < 1 {
+		return nil, errors.New("short frame")
+	}
+	info := b[0]
+	if info>>5 != bthomeVersion {
+		return nil, fmt.Errorf("unsupported BTHome version %d", info>>5)
+	}
+	if info&bthomeFlagEncrypted == 0 {
+		return b[1:], nil
+	}
+	if key == nil {
+		return nil, errors.New("encrypted frame but no bindkey configured")
+	}
+	if len(mac) != 6 {
+		return nil, errors.New("encrypted frame but no MAC address")
+	}
+	// objects, 4 byte counter, 4 byte MIC
+	if len(b) < 1+8 {
+		return nil, errors.New("short frame")
+	}
+	end := len(b) - 8
+	nonce := make([]byte, 0, 13)
+	nonce = append(nonce, mac...)
+	nonce = append(nonce, 0xd2, 0xfc, info)
+	nonce = append(nonce, b[end:end+4]...)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return ccmOpen(block, nonce, b[1:end], b[end+4:], nil)
+}
+
+func init() {
+	Register("bthome", func() map[string]Processor {
+		return map[string]Processor{"fcd2": NewBTHome(nil, nil)}
+	})
+}
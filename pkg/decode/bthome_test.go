@@ -0,0 +1,92 @@
+package decode
+
+import (
+	"reflect"
+	"testing"
+)
+
+// bthomeDeviceInfo is the device information pvvx firmware in BTHome v2 mode
+// advertises: device type 1, firmware 4.4.1.0.
+const bthomeDeviceInfo = "40 f0 01 00 f1 00 01 04 04"
+
+func TestBTHomeDeviceInfo(t *testing.T) {
+	want := Data{"device_type_id": 1, "firmware_version": "4.4.1.0"}
+	b := unhex(t, bthomeDeviceInfo)
+	if got := BTHomeInfo(b); !reflect.DeepEqual(got, want) {
+		t.Errorf("BTHomeInfo = %v, want %v", got, want)
+	}
+	if got := NewBTHome(nil, nil)(b); !reflect.DeepEqual(got, want) {
+		t.Errorf("BTHome processor = %v, want %v", got, want)
+	}
+	// the three byte firmware version object
+	if got, want := BTHomeInfo(unhex(t, "40 f2 02 01 03")), (Data{"firmware_version": "3.1.2"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("BTHomeInfo = %v, want %v", got, want)
+	}
+}
+
+func TestBTHomeObjects(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload string
+		want    Data
+	}{
+		{
+			"pvvx",
+			"40 00 2c 01 59 02 6608 03 5e11 0c 820b",
+			Data{"packet_counter": 44, "battery_pct": 89, "temperature": 21.5, "humidity": 44.46, "battery_mv": 2946},
+		},
+		{
+			"air quality",
+			"40 12 e204 0d 0c00 0e 1400 13 5e01",
+			Data{"co2": 1250, "pm2_5": 12, "pm10": 20, "tvoc": 350},
+		},
+		{
+			"negative temperature in tenths",
+			"40 45 9cff",
+			Data{"temperature": -10.0},
+		},
+		{
+			"stops at an unknown object",
+			"40 01 59 ff 0102 02 6608",
+			Data{"battery_pct": 89},
+		},
+		{"v1", "20 01 59", Data{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NewBTHome(nil, nil)(unhex(t, tc.payload)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("BTHome(%s) = %v, want %v", tc.payload, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBTHomeEncrypted(t *testing.T) {
+	// the temperature and humidity objects of the pvvx fixture, encrypted,
+	// then the counter 00112233 and the MIC
+	const frame = "41 6bc33e4ff524 33221100 21f0016f"
+	key := unhex(t, testBindkey)
+	mac := unhex(t, "a4c138123456")
+	want := Data{"temperature": 21.5, "humidity": 44.46}
+	if got := NewBTHome(key, mac)(unhex(t, frame)); !reflect.DeepEqual(got, want) {
+		t.Errorf("BTHome = %v, want %v", got, want)
+	}
+	for _, tc := range []struct {
+		name  string
+		frame string
+		key   []byte
+		mac   []byte
+	}{
+		{"no bindkey", frame, nil, mac},
+		{"no MAC", frame, key, nil},
+		{"another sensor's MAC", frame, key, unhex(t, "a4c138123457")},
+		{"wrong bindkey", frame, unhex(t, "00000000000000000000000000000000"), mac},
+		{"bad MIC", "41 6bc33e4ff524 33221100 21f0016e", key, mac},
+		{"altered counter", "41 6bc33e4ff524 34221100 21f0016f", key, mac},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NewBTHome(tc.key, tc.mac)(unhex(t, tc.frame)); len(got) != 0 {
+				t.Errorf("BTHome = %v, want nothing", got)
+			}
+		})
+	}
+}
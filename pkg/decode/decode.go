@@ -0,0 +1,295 @@
+// Package decode parses the service data advertised by Xiaomi Mijia and
+// compatible BLE sensors: the stock MiBeacon format, including encrypted
+// frames, BTHome v2, and the pvvx and atc1441 custom firmware formats.
+package decode
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// Data holds decoded readings, keyed by field name.
+type Data map[string]interface{}
+
+// Processor decodes the service data for a single UUID.
+type Processor func([]byte) Data
+
+// Logger receives log messages from this package and the others in pkg.
+type Logger interface {
+	Debugf(format string, a ...interface{})
+	Infof(format string, a ...interface{})
+	Warnf(format string, a ...interface{})
+	Errorf(format string, a ...interface{})
+}
+
+type discard struct{}
+
+func (discard) Debugf(string, ...interface{}) {}
+func (discard) Infof(string, ...interface{})  {}
+func (discard) Warnf(string, ...interface{})  {}
+func (discard) Errorf(string, ...interface{}) {}
+
+// Discard is a Logger that drops everything.
+var Discard Logger = discard{}
+
+// Log receives the package's debug messages, such as why a frame couldn't be
+// decoded.
+var Log = Discard
+
+// customField is a reading at a fixed offset in a custom firmware format.
+type customField struct {
+	name   string
+	off    int
+	size   int  // bytes: 1, 2 or 3
+	big    bool // big-endian rather than little-endian
+	signed bool
+	div    float64 // divide by this for a float; 0 for an int
+}
+
+// customFormats are the 181a formats of custom LYWSD03MMC firmware, keyed by
+// length. Each follows the 6 byte MAC address. Validate checks the
+// temperature, humidity, battery_pct and flags of those formats that have
+// them, and PacketID uses packet_counter.
+var customFormats = map[int][]customField{
+	// https://github.com/pvvx/ATC_MiThermometer custom format
+	15: {
+		{"temperature", 6, 2, false, true, 100},
+		{"humidity", 8, 2, false, false, 100},
+		{"battery_mv", 10, 2, false, false, 0},
+		{"battery_pct", 12, 1, false, false, 0},
+		{"packet_counter", 13, 1, false, false, 0},
+		{"flags", 14, 1, false, false, 0},
+	},
+	// https://github.com/atc1441/ATC_MiThermometer original format
+	13: {
+		{"temperature", 6, 2, true, true, 10},
+		{"humidity", 8, 1, false, false, 1},
+		{"battery_pct", 9, 1, false, false, 0},
+		{"battery_mv", 10, 2, true, false, 0},
+		{"packet_counter", 12, 1, false, false, 0},
+	},
+	// the atc1441 format with humidity in tenths, as built with
+	// USE_HUMI_X10, e.g. a4c138123456 00d7 01be 59 0b9a 2c: 21.5°C, 44.6%
+	14: {
+		{"temperature", 6, 2, true, true, 10},
+		{"humidity", 8, 2, true, false, 10},
+		{"battery_pct", 10, 1, false, false, 0},
+		{"battery_mv", 11, 2, true, false, 0},
+		{"packet_counter", 13, 1, false, false, 0},
+	},
+	// pvvx's format extended with a pressure sensor, in 0.1 hPa, e.g.
+	// 563412 38c1a4 6608 5e11 820b 59 9527 2c 04: 21.5°C, 44.46%, 1013.3 hPa
+	17: {
+		{"temperature", 6, 2, false, true, 100},
+		{"humidity", 8, 2, false, false, 100},
+		{"battery_mv", 10, 2, false, false, 0},
+		{"battery_pct", 12, 1, false, false, 0},
+		{"pressure", 13, 2, false, false, 10},
+		{"packet_counter", 15, 1, false, false, 0},
+		{"flags", 16, 1, false, false, 0},
+	},
+	// pvvx's format extended with a light sensor, in 0.01 lux, e.g.
+	// 563412 38c1a4 6608 5e11 820b 59 e8bd01 2c 04: 1141.52 lux
+	18: {
+		{"temperature", 6, 2, false, true, 100},
+		{"humidity", 8, 2, false, false, 100},
+		{"battery_mv", 10, 2, false, false, 0},
+		{"battery_pct", 12, 1, false, false, 0},
+		{"illuminance", 13, 3, false, false, 100},
+		{"packet_counter", 16, 1, false, false, 0},
+		{"flags", 17, 1, false, false, 0},
+	},
+	// pvvx's format with both, e.g.
+	// 563412 38c1a4 6608 5e11 820b 59 9527 e8bd01 2c 04
+	20: {
+		{"temperature", 6, 2, false, true, 100},
+		{"humidity", 8, 2, false, false, 100},
+		{"battery_mv", 10, 2, false, false, 0},
+		{"battery_pct", 12, 1, false, false, 0},
+		{"pressure", 13, 2, false, false, 10},
+		{"illuminance", 15, 3, false, false, 100},
+		{"packet_counter", 18, 1, false, false, 0},
+		{"flags", 19, 1, false, false, 0},
+	},
+}
+
+// customCounter returns the offset of the packet counter in custom format
+// service data b, if b is in one.
+func customCounter(b []byte) (int, bool) {
+	for _, f := range customFormats[len(b)] {
+		if f.name == "packet_counter" {
+			return f.off, true
+		}
+	}
+	return 0, false
+}
+
+// pvvxFlags are the bits of pvvx's flags field: the reed switch or contact
+// input on GPIO PA6, and the GPIO PA5 output with the events that drive it.
+var pvvxFlags = []struct {
+	name string
+	bit  uint
+}{
+	{"reed_switch", 0},
+	{"trigger_output", 1},
+	{"temp_trigger", 3},
+	{"humidity_trigger", 4},
+}
+
+func (f customField) value(b []byte) interface{} {
+	v := b[f.off : f.off+f.size]
+	var u uint32
+	for i := range v {
+		if f.big {
+			u = u<<8 | uint32(v[i])
+		} else {
+			u = u<<8 | uint32(v[len(v)-1-i])
+		}
+	}
+	n := int64(u)
+	if f.signed && u&(1<<(8*uint(f.size)-1)) != 0 {
+		n -= 1 << (8 * uint(f.size))
+	}
+	if f.div == 0 {
+		return int(n)
+	}
+	return float64(n) / f.div
+}
+
+// LYWSD03MMC decodes the 181a service data sent by custom firmware for the
+// LYWSD03MMC.
+func LYWSD03MMC(b []byte) Data {
+	fields, ok := customFormats[len(b)]
+	if !ok {
+		return Data{}
+	}
+	d := Data{}
+	for _, f := range fields {
+		d[f.name] = f.value(b)
+	}
+	if flags, ok := d["flags"].(int); ok {
+		for _, f := range pvvxFlags {
+			d[f.name] = flags >> f.bit & 0x01
+		}
+	}
+	return d
+}
+
+// LYWSDCGQ decodes the fe95 service data sent by the LYWSDCGQ/01ZM, plain
+// MiBeacon with its temperature, humidity and battery objects.
+func LYWSDCGQ(b []byte) Data {
+	return NewMiBeacon(nil, nil)(b)
+}
+
+// sensorTypes maps each supported sensor type to a function returning its
+// processors, keyed by service data UUID.
+var sensorTypes = make(map[string]func() map[string]Processor)
+
+// Register adds a sensor type, whose processors are returned by processors.
+func Register(typ string, processors func() map[string]Processor) {
+	if _, ok := sensorTypes[typ]; ok {
+		panic("sensor type " + typ + " registered twice")
+	}
+	sensorTypes[typ] = processors
+}
+
+func init() {
+	Register("LYWSD03MMC", func() map[string]Processor {
+		return map[string]Processor{
+			"181a": LYWSD03MMC,
+			"fcd2": NewBTHome(nil, nil),   // pvvx in BTHome v2 mode
+			"fe95": NewMiBeacon(nil, nil), // stock firmware
+		}
+	})
+	Register("LYWSDCGQ/01ZM", func() map[string]Processor {
+		return map[string]Processor{"fe95": NewMiBeacon(nil, nil)}
+	})
+}
+
+// Processors returns the processors for a sensor type, keyed by service data
+// UUID.
+func Processors(typ string) (map[string]Processor, error) {
+	f, ok := sensorTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown sensor type %s", typ)
+	}
+	return f(), nil
+}
+
+// Merge combines the processors for several sensor types so that firmware
+// splitting its data across service UUIDs can be handled as one sensor.
+func Merge(types []string) (map[string]Processor, error) {
+	ret := make(map[string]Processor)
+	owner := make(map[string]string)
+	for _, t := range types {
+		ps, err := Processors(t)
+		if err != nil {
+			return nil, err
+		}
+		for uuid, p := range ps {
+			if o, ok := owner[uuid]; ok {
+				return nil, fmt.Errorf("types %s and %s both decode UUID %s", o, t, uuid)
+			}
+			owner[uuid] = t
+			ret[uuid] = p
+		}
+	}
+	return ret, nil
+}
+
+// InferType guesses the sensor type sending service data b on uuid, or
+// returns "" if it isn't recognised.
+func InferType(uuid string, b []byte) string {
+	switch uuid {
+	case "181a":
+		if _, ok := customFormats[len(b)]; ok {
+			return "LYWSD03MMC"
+		}
+	case "fe95":
+		return miProductType(b)
+	case "fdcd":
+		if len(b) >= 2 {
+			return qingpingDeviceTypes[b[1]]
+		}
+	case "fcd2":
+		if len(b) >= 1 && b[0]>>5 == bthomeVersion {
+			return "bthome"
+		}
+	}
+	return ""
+}
+
+// PacketID identifies the measurement carried by service data b sent on
+// uuid, so repeats of it can be recognised: the packet or frame counter for
+// formats with one, or else the whole payload.
+func PacketID(uuid string, b []byte) string {
+	if uuid == "181a" {
+		if off, ok := customCounter(b); ok {
+			return "counter:" + string(b[off])
+		}
+	}
+	switch {
+	case uuid == "fe95" && len(b) >= 5:
+		return "counter:" + string(b[4])
+	case uuid == "fcd2" && len(b) >= 9 && b[0]&bthomeFlagEncrypted != 0:
+		return "counter:" + string(b[len(b)-8:len(b)-4])
+	case uuid == "fcd2" && len(b) >= 3 && b[1] == 0x00: // packet ID object
+		return "counter:" + string(b[2])
+	}
+	return string(b)
+}
+
+// FormatHex formats b as space-separated hex bytes.
+func FormatHex(b []byte) string {
+	h := hex.EncodeToString(b)
+	out := ""
+	i := 0
+	for i < len(h) {
+		out += h[i : i+2]
+		i += 2
+		if i != len(h) {
+			out += " "
+		}
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package decode
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// unhex decodes s, hex with optional spaces.
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatalf("bad fixture %q: %s", s, err)
+	}
+	return b
+}
+
+func TestCustomFormats(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload string
+		want    Data
+	}{
+		{
+			"pvvx",
+			"563412 38c1a4 6608 5e11 820b 59 2c 04",
+			Data{
+				"temperature": 21.5, "humidity": 44.46, "battery_mv": 2946, "battery_pct": 89,
+				"packet_counter": 44, "flags": 4,
+				"reed_switch": 0, "trigger_output": 0, "temp_trigger": 0, "humidity_trigger": 0,
+			},
+		},
+		{
+			"atc1441",
+			"a4c138123456 00d7 2c 59 0b9a 2c",
+			Data{"temperature": 21.5, "humidity": 44.0, "battery_pct": 89, "battery_mv": 2970, "packet_counter": 44},
+		},
+		{
+			"atc1441 humidity in tenths",
+			"a4c138123456 00d7 01be 59 0b9a 2c",
+			Data{"temperature": 21.5, "humidity": 44.6, "battery_pct": 89, "battery_mv": 2970, "packet_counter": 44},
+		},
+		{
+			"pvvx with pressure",
+			"563412 38c1a4 6608 5e11 820b 59 9527 2c 04",
+			Data{
+				"temperature": 21.5, "humidity": 44.46, "battery_mv": 2946, "battery_pct": 89,
+				"pressure": 1013.3, "packet_counter": 44, "flags": 4,
+				"reed_switch": 0, "trigger_output": 0, "temp_trigger": 0, "humidity_trigger": 0,
+			},
+		},
+		{
+			"pvvx with illuminance",
+			"563412 38c1a4 6608 5e11 820b 59 e8bd01 2c 04",
+			Data{
+				"temperature": 21.5, "humidity": 44.46, "battery_mv": 2946, "battery_pct": 89,
+				"illuminance": 1141.52, "packet_counter": 44, "flags": 4,
+				"reed_switch": 0, "trigger_output": 0, "temp_trigger": 0, "humidity_trigger": 0,
+			},
+		},
+		{
+			"pvvx with pressure and illuminance",
+			"563412 38c1a4 6608 5e11 820b 59 9527 e8bd01 2c 04",
+			Data{
+				"temperature": 21.5, "humidity": 44.46, "battery_mv": 2946, "battery_pct": 89,
+				"pressure": 1013.3, "illuminance": 1141.52, "packet_counter": 44, "flags": 4,
+				"reed_switch": 0, "trigger_output": 0, "temp_trigger": 0, "humidity_trigger": 0,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := unhex(t, tc.payload)
+			if got := LYWSD03MMC(b); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("LYWSD03MMC(%s) = %v, want %v", tc.payload, got, tc.want)
+			}
+			if typ := InferType("181a", b); typ != "LYWSD03MMC" {
+				t.Errorf("InferType = %q, want LYWSD03MMC", typ)
+			}
+			if id, want := PacketID("181a", b), "counter:\x2c"; id != want {
+				t.Errorf("PacketID = %q, want %q", id, want)
+			}
+		})
+	}
+}
+
+func TestLYWSDCGQ(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload string
+		want    Data
+	}{
+		{"temperature and humidity", "5020 aa01 b1 563412 38c1a4 0d10 04 d700 be01", Data{"temperature": 21.5, "humidity": 44.6}},
+		{"temperature", "5020 aa01 b2 563412 38c1a4 0410 02 d700", Data{"temperature": 21.5}},
+		{"humidity", "5020 aa01 b3 563412 38c1a4 0610 02 be01", Data{"humidity": 44.6}},
+		{"battery", "5020 aa01 b4 563412 38c1a4 0a10 01 59", Data{"battery_pct": 89}},
+		{"short", "5020 aa01", Data{}},
+		{"truncated object", "5020 aa01 b1 563412 38c1a4 0d10 04 d7", Data{}},
+		{"no objects", "3020 aa01 b1 563412 38c1a4", Data{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := LYWSDCGQ(unhex(t, tc.payload)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("LYWSDCGQ(%s) = %v, want %v", tc.payload, got, tc.want)
+			}
+		})
+	}
+}
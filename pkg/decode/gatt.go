@@ -0,0 +1,75 @@
+package decode
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// GATT characteristics read when polling a sensor over a connection rather
+// than waiting for its advertisements.
+const (
+	// stock LYWSD03MMC firmware: temperature, humidity and battery
+	// voltage, sent as a notification; the LYWSD02 sends only the first
+	// two
+	MiTempHumidityChar = "ebe0ccc17a0a4b0c8a1a6ff2997da3a6"
+	// the LYWSD02's battery level, in percent
+	MiBatteryChar = "ebe0ccc47a0a4b0c8a1a6ff2997da3a6"
+	// the LYWSD02's clock; see LYWSD02Time
+	LYWSD02TimeChar = "ebe0ccb77a0a4b0c8a1a6ff2997da3a6"
+	// the standard environmental sensing and battery characteristics
+	// served by custom firmware
+	TemperatureChar = "2a6e"
+	HumidityChar    = "2a6f"
+	BatteryChar     = "2a19"
+)
+
+// MiTempHumidity decodes the MiTempHumidityChar value.
+func MiTempHumidity(b []byte) Data {
+	if len(b) < 3 {
+		return Data{}
+	}
+	d := Data{
+		"temperature": float64(int16(binary.LittleEndian.Uint16(b[0:2]))) / 100,
+		"humidity":    float64(b[2]),
+	}
+	if len(b) >= 5 {
+		d["battery_mv"] = int(binary.LittleEndian.Uint16(b[3:5]))
+	}
+	return d
+}
+
+// LYWSD02Time encodes t, in its location, for the LYWSD02TimeChar: the Unix
+// time and the offset of the time zone from UTC in whole hours, which is all
+// the clock has. The rest of the offset of a zone such as Asia/Kolkata is
+// added to the time, so that the clock still shows local time.
+func LYWSD02Time(t time.Time) []byte {
+	_, off := t.Zone()
+	b := make([]byte, 5)
+	binary.LittleEndian.PutUint32(b, uint32(t.Unix()+int64(off%3600)))
+	b[4] = byte(int8(off / 3600))
+	return b
+}
+
+// GATTTemperature decodes a temperature characteristic, in 0.01°C.
+func GATTTemperature(b []byte) Data {
+	if len(b) < 2 {
+		return Data{}
+	}
+	return Data{"temperature": float64(int16(binary.LittleEndian.Uint16(b))) / 100}
+}
+
+// GATTHumidity decodes a humidity characteristic, in 0.01%.
+func GATTHumidity(b []byte) Data {
+	if len(b) < 2 {
+		return Data{}
+	}
+	return Data{"humidity": float64(binary.LittleEndian.Uint16(b)) / 100}
+}
+
+// GATTBattery decodes a battery level characteristic, in percent.
+func GATTBattery(b []byte) Data {
+	if len(b) < 1 {
+		return Data{}
+	}
+	return Data{"battery_pct": int(b[0])}
+}
@@ -0,0 +1,328 @@
+package decode
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// MiBeacon frame control flags.
+const (
+	miFlagEncrypted  = 0x0008
+	miFlagMAC        = 0x0010
+	miFlagCapability = 0x0020
+	miFlagObject     = 0x0040
+)
+
+func init() {
+	// Devices which only speak MiBeacon; the objects each sends determine
+	// its fields. mibeacon covers any other device sending the standard
+	// objects.
+	for _, typ := range []string{
+		"mibeacon",
+		"MJYD02YL",  // motion-activated night light
+		"HHCCJCY01", // Flower Care plant sensor
+		"YM-K1501",  // smart kettle
+		"LYWSD02",   // E-ink clock with temperature and humidity
+	} {
+		Register(typ, func() map[string]Processor {
+			return map[string]Processor{"fe95": NewMiBeacon(nil, nil)}
+		})
+	}
+}
+
+// miProductTypes maps MiBeacon product IDs to sensor types.
+var miProductTypes = map[uint16]string{
+	0x0098: "HHCCJCY01",
+	0x0131: "YM-K1501",
+	0x01aa: "LYWSDCGQ/01ZM",
+	0x0347: "CGG1",
+	0x045b: "LYWSD02",
+	0x055b: "LYWSD03MMC",
+	0x07f6: "MJYD02YL",
+	0x16e4: "LYWSD02", // the LYWSD02MMC, which encrypts its frames
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+// miObjects decodes the value of each supported MiBeacon object type.
+var miObjects = map[uint16]func([]byte) Data{
+	0x000f: func(b []byte) Data {
+		if len(b) < 3 {
+			return nil
+		}
+		return Data{"motion": 1, "illuminance": uint24(b)}
+	},
+	0x1004: func(b []byte) Data {
+		if len(b) < 2 {
+			return nil
+		}
+		return Data{"temperature": float64(int16(binary.LittleEndian.Uint16(b))) / 10}
+	},
+	0x1005: func(b []byte) Data {
+		if len(b) < 2 {
+			return nil
+		}
+		return Data{"power": int(b[0]), "temperature": float64(b[1])}
+	},
+	0x1006: func(b []byte) Data {
+		if len(b) < 2 {
+			return nil
+		}
+		return Data{"humidity": float64(binary.LittleEndian.Uint16(b)) / 10}
+	},
+	0x1007: func(b []byte) Data {
+		if len(b) < 3 {
+			return nil
+		}
+		return Data{"illuminance": uint24(b)}
+	},
+	0x1008: func(b []byte) Data {
+		if len(b) < 1 {
+			return nil
+		}
+		return Data{"moisture": int(b[0])}
+	},
+	0x1009: func(b []byte) Data {
+		if len(b) < 2 {
+			return nil
+		}
+		return Data{"conductivity": int(binary.LittleEndian.Uint16(b))}
+	},
+	0x100a: func(b []byte) Data {
+		if len(b) < 1 {
+			return nil
+		}
+		return Data{"battery_pct": int(b[0])}
+	},
+	0x100d: func(b []byte) Data {
+		if len(b) < 4 {
+			return nil
+		}
+		return Data{
+			"temperature": float64(int16(binary.LittleEndian.Uint16(b[0:2]))) / 10,
+			"humidity":    float64(binary.LittleEndian.Uint16(b[2:4])) / 10,
+		}
+	},
+	0x1017: func(b []byte) Data {
+		if len(b) < 4 {
+			return nil
+		}
+		return Data{"motion": 0, "no_motion_secs": int(binary.LittleEndian.Uint32(b))}
+	},
+	0x1010: func(b []byte) Data {
+		if len(b) < 2 {
+			return nil
+		}
+		return Data{"formaldehyde": float64(binary.LittleEndian.Uint16(b)) / 100} // mg/m³
+	},
+	0x1013: func(b []byte) Data {
+		if len(b) < 1 {
+			return nil
+		}
+		return Data{"consumable_pct": int(b[0])}
+	},
+	0x1014: func(b []byte) Data {
+		if len(b) < 1 {
+			return nil
+		}
+		return Data{"water_leak": int(b[0])}
+	},
+	0x1015: func(b []byte) Data {
+		if len(b) < 1 {
+			return nil
+		}
+		return Data{"smoke": int(b[0])}
+	},
+	0x1018: func(b []byte) Data {
+		if len(b) < 1 {
+			return nil
+		}
+		return Data{"light": int(b[0])}
+	},
+	0x1019: func(b []byte) Data {
+		if len(b) < 1 {
+			return nil
+		}
+		// 0 open, 1 closed, 2 open too long, 3 opened while locked
+		return Data{"opening": int(b[0])}
+	},
+}
+
+// miProductType returns the sensor type of MiBeacon service data b: the
+// model's, if the product ID is known, or else mibeacon if the frame carries
+// objects.
+func miProductType(b []byte) string {
+	if len(b) < 4 {
+		return ""
+	}
+	if t, ok := miProductTypes[binary.LittleEndian.Uint16(b[2:4])]; ok {
+		return t
+	}
+	if binary.LittleEndian.Uint16(b[0:2])&miFlagObject != 0 {
+		return "mibeacon"
+	}
+	return ""
+}
+
+// NewMiBeacon returns a processor for MiBeacon service data from the device
+// with address mac, decrypting it with key if the frame is encrypted.
+func NewMiBeacon(key, mac []byte) Processor {
+	return func(b []byte) Data {
+		objs, err := MiBeaconObjects(b, key, mac)
+		if err != nil {
+			Log.Debugf("mibeacon: %s", err)
+			return Data{}
+		}
+		d := Data{}
+		for len(objs) >= 3 {
+			id := binary.LittleEndian.Uint16(objs[0:2])
+			n := int(objs[2])
+			if 3+n > len(objs) {
+				break
+			}
+			if f, ok := miObjects[id]; ok {
+				for k, v := range f(objs[3 : 3+n]) {
+					d[k] = v
+				}
+			}
+			objs = objs[3+n:]
+		}
+		return d
+	}
+}
+
+// MiBeaconObjects returns the plaintext object data of a MiBeacon frame from
+// the device with address mac, which is only needed to decrypt a frame that
+// doesn't include it. Only the v4/v5 encryption scheme used by current
+// devices is supported.
+func MiBeaconObjects(b []byte, key, mac []byte) ([]byte, error) {
+	if len(b) < 5 {
+		return nil, errors.New("short frame")
+	}
+	ctrl := binary.LittleEndian.Uint16(b[0:2])
+	if ctrl&miFlagObject == 0 {
+		return nil, nil
+	}
+	i := 5              // frame control, product ID, frame counter
+	var frameMAC []byte // as sent, least significant byte first
+	if ctrl&miFlagMAC != 0 {
+		if len(b) < i+6 {
+			return nil, errors.New("short frame")
+		}
+		frameMAC = b[i : i+6]
+		i += 6
+	}
+	if ctrl&miFlagCapability != 0 {
+		if len(b) < i+1 {
+			return nil, errors.New("short frame")
+		}
+		if b[i]&0x20 != 0 {
+			i += 2 // I/O capability
+		}
+		i++
+	}
+	if len(b) < i {
+		return nil, errors.New("short frame")
+	}
+	if ctrl&miFlagEncrypted == 0 {
+		return b[i:], nil
+	}
+	if version := ctrl >> 12; version < 4 {
+		return nil, errors.New("unsupported encryption version")
+	}
+	if key == nil {
+		return nil, errors.New("encrypted frame but no bindkey configured")
+	}
+	if frameMAC == nil {
+		if len(mac) != 6 {
+			return nil, errors.New("encrypted frame without MAC, and no MAC address")
+		}
+		frameMAC = make([]byte, 6)
+		for j := range mac {
+			frameMAC[5-j] = mac[j]
+		}
+	}
+	// payload, 3 byte extended frame counter, 4 byte MIC
+	if len(b) < i+7 {
+		return nil, errors.New("short frame")
+	}
+	end := len(b) - 7
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, frameMAC...)
+	nonce = append(nonce, b[2:5]...)
+	nonce = append(nonce, b[end:end+3]...)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return ccmOpen(block, nonce, b[i:end], b[end+3:], []byte{0x11})
+}
+
+// ccmOpen decrypts and authenticates ciphertext using AES-CCM (RFC 3610).
+func ccmOpen(block cipher.Block, nonce, ciphertext, tag, aad []byte) ([]byte, error) {
+	l := 15 - len(nonce)
+	if l < 2 || l > 8 || len(tag) < 4 || len(tag) > 16 || len(tag)%2 != 0 {
+		return nil, errors.New("ccm: invalid parameters")
+	}
+
+	// counter blocks A_i = flags | nonce | i
+	ctr := make([]byte, aes.BlockSize)
+	ctr[0] = byte(l - 1)
+	copy(ctr[1:], nonce)
+	s0 := make([]byte, aes.BlockSize)
+	block.Encrypt(s0, ctr)
+	ctr[aes.BlockSize-1] = 1
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, ctr).XORKeyStream(plaintext, ciphertext)
+
+	// CBC-MAC over B_0, the encoded AAD and the plaintext
+	b0 := make([]byte, aes.BlockSize)
+	b0[0] = byte(8*((len(tag)-2)/2) + (l - 1))
+	if len(aad) > 0 {
+		b0[0] |= 0x40
+	}
+	copy(b0[1:], nonce)
+	n := len(plaintext)
+	for i := aes.BlockSize - 1; i > len(nonce); i-- {
+		b0[i] = byte(n)
+		n >>= 8
+	}
+	mac := make([]byte, aes.BlockSize)
+	block.Encrypt(mac, b0)
+	cbc := func(data []byte) {
+		for len(data) > 0 {
+			k := aes.BlockSize
+			if len(data) < k {
+				k = len(data)
+			}
+			for j := 0; j < k; j++ {
+				mac[j] ^= data[j]
+			}
+			block.Encrypt(mac, mac)
+			data = data[k:]
+		}
+	}
+	if len(aad) > 0 {
+		if len(aad) >= 0xff00 {
+			return nil, errors.New("ccm: additional data too long")
+		}
+		a := make([]byte, 2, 2+len(aad))
+		binary.BigEndian.PutUint16(a, uint16(len(aad)))
+		cbc(append(a, aad...))
+	}
+	cbc(plaintext)
+
+	expected := make([]byte, len(tag))
+	for j := range expected {
+		expected[j] = mac[j] ^ s0[j]
+	}
+	if subtle.ConstantTimeCompare(expected, tag) != 1 {
+		return nil, errors.New("ccm: message authentication failed")
+	}
+	return plaintext, nil
+}
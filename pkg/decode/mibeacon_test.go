@@ -0,0 +1,102 @@
+package decode
+
+import (
+	"crypto/aes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// testBindkey is the LYWSD03MMC's bindkey in ble_monitor's Xiaomi parser
+// tests, which the fixtures made here are sealed with too.
+const testBindkey = "e9ea895fac7cca6d30532432a516f3a8"
+
+// TestCCMOpen checks ccmOpen against packet vector #1 of RFC 3610.
+func TestCCMOpen(t *testing.T) {
+	block, err := aes.NewCipher(unhex(t, "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := unhex(t, "00000003020100a0a1a2a3a4a5")
+	aad := unhex(t, "0001020304050607")
+	ct := unhex(t, "588c979a61c663d2f066d0c2c0f989806d5f6b61dac384")
+	tag := unhex(t, "17e8d12cfdf926e0")
+	want := unhex(t, "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e")
+	got, err := ccmOpen(block, nonce, ct, tag, aad)
+	if err != nil {
+		t.Fatalf("ccmOpen: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ccmOpen = %x, want %x", got, want)
+	}
+	tag[0] ^= 1
+	if _, err := ccmOpen(block, nonce, ct, tag, aad); err == nil {
+		t.Error("ccmOpen with a bad tag = nil error, want one")
+	}
+}
+
+func TestMiBeaconEncrypted(t *testing.T) {
+	key := unhex(t, testBindkey)
+	for _, tc := range []struct {
+		name  string
+		frame string
+		mac   string
+		want  Data
+	}{
+		{
+			// the encrypted LYWSD03MMC frame of ble_monitor's Xiaomi parser
+			// tests: v5 (product 055b), counter 50, with its MAC, the 1006
+			// humidity object, extended counter 000026 and the MIC
+			"published",
+			"5858 5b05 50 f4830238c1a4 95ef58763c 260000 97e2abb5",
+			"a4:c1:38:02:83:f4",
+			Data{"humidity": 46.7},
+		},
+		{
+			// the same frame without its MAC, which the nonce then takes from
+			// the sensor's configured address
+			"published without MAC",
+			"4858 5b05 50 95ef58763c 260000 97e2abb5",
+			"a4:c1:38:02:83:f4",
+			Data{"humidity": 46.7},
+		},
+		{
+			// counter 5, the 100d object for 21.5°C and 44.6%, then the
+			// extended counter 030201 and the MIC
+			"temperature and humidity",
+			"5858 5b05 05 56341238c1a4 a9c3fb4fd2754d 010203 5e2090c1",
+			"a4:c1:38:12:34:56",
+			Data{"temperature": 21.5, "humidity": 44.6},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mac, _ := net.ParseMAC(tc.mac)
+			if got := NewMiBeacon(key, mac)(unhex(t, tc.frame)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("MiBeacon = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	const frame = "5858 5b05 05 56341238c1a4 a9c3fb4fd2754d 010203 5e2090c1"
+	mac, _ := net.ParseMAC("a4:c1:38:12:34:56")
+	for _, tc := range []struct {
+		name  string
+		frame string
+		key   []byte
+		mac   []byte
+	}{
+		{"no bindkey", frame, nil, mac},
+		{"wrong bindkey", frame, unhex(t, "00000000000000000000000000000000"), mac},
+		{"bad MIC", "5858 5b05 05 56341238c1a4 a9c3fb4fd2754d 010203 5e2090c0", key, mac},
+		{"another sensor's MAC", "5858 5b05 05 57341238c1a4 a9c3fb4fd2754d 010203 5e2090c1", key, mac},
+		{"old encryption", "5830 5b05 05 56341238c1a4 a9c3fb4fd2754d 010203 5e2090c1", key, mac},
+		{"no MAC in the frame or configured", "4858 5b05 50 95ef58763c 260000 97e2abb5", key, nil},
+		{"another sensor's configured MAC", "4858 5b05 50 95ef58763c 260000 97e2abb5", key, mac},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NewMiBeacon(tc.key, tc.mac)(unhex(t, tc.frame)); len(got) != 0 {
+				t.Errorf("MiBeacon = %v, want nothing", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package decode
+
+import "encoding/binary"
+
+func init() {
+	// Qingping sensors advertise fdcd service data in their own format;
+	// flashed with pvvx firmware, they send the 181a custom format instead.
+	for _, typ := range []string{"CGG1", "CGDK2"} {
+		Register(typ, func() map[string]Processor {
+			return map[string]Processor{
+				"181a": LYWSD03MMC,
+				"fcd2": BTHomeInfo,
+				"fdcd": Qingping,
+				"fe95": NewMiBeacon(nil, nil), // CGG1 stock firmware also sends MiBeacon
+			}
+		})
+	}
+}
+
+// qingpingDeviceTypes maps Qingping device IDs to sensor types.
+var qingpingDeviceTypes = map[byte]string{
+	0x01: "CGG1",
+	0x07: "CGG1",
+	0x10: "CGDK2",
+}
+
+// Qingping decodes fdcd service data: a frame control byte, a device ID and
+// the MAC address, followed by type-length-value readings.
+func Qingping(b []byte) Data {
+	d := Data{}
+	for i := 8; i+2 <= len(b); {
+		typ, n := b[i], int(b[i+1])
+		v := b[i+2:]
+		if n > len(v) {
+			break
+		}
+		v = v[:n]
+		switch {
+		case typ == 0x01 && n == 4:
+			d["temperature"] = float64(int16(binary.LittleEndian.Uint16(v[0:2]))) / 10
+			d["humidity"] = float64(binary.LittleEndian.Uint16(v[2:4])) / 10
+		case typ == 0x02 && n == 1:
+			d["battery_pct"] = int(v[0])
+		case typ == 0x07 && n == 2:
+			d["pressure"] = float64(binary.LittleEndian.Uint16(v)) / 10 // hPa
+		}
+		i += 2 + n
+	}
+	return d
+}
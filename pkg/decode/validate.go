@@ -0,0 +1,65 @@
+package decode
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// The temperature range of the sensor chips in the LYWSD03MMC and its
+// relatives, in °C; outside it a custom format frame must be corrupt.
+const minChipTemp, maxChipTemp = -40, 125
+
+// pvvxUnusedFlags are the bits of pvvx's flags field that firmware leaves
+// clear.
+const pvvxUnusedFlags = 0xe0
+
+// Validate checks service data b sent on uuid by the sensor with MAC address
+// mac for consistency before it's decoded, returning why it's rejected if
+// it is. The pvvx and atc1441 custom formats carry no checksum, so a frame
+// is rejected if the MAC address it starts with isn't mac, or it holds values
+// none could; fields a format doesn't have aren't checked. Formats with no
+// checks, or that are authenticated when encrypted, always pass. mac can be
+// nil to skip its check.
+func Validate(uuid string, b []byte, mac net.HardwareAddr) error {
+	if uuid != "181a" {
+		return nil
+	}
+	fields, ok := customFormats[len(b)]
+	if !ok {
+		return nil
+	}
+	return validate(fields, b, mac)
+}
+
+// validate checks b, a custom format frame with fields, as Validate does.
+func validate(fields []customField, b []byte, mac net.HardwareAddr) error {
+	if len(mac) == 6 && !bytes.Equal(b[:6], mac) && !bytes.Equal(b[:6], reversed(mac)) {
+		return fmt.Errorf("frame is for MAC address %s", net.HardwareAddr(b[:6]))
+	}
+	d := Data{}
+	for _, f := range fields {
+		d[f.name] = f.value(b)
+	}
+	if t, ok := d["temperature"].(float64); ok && (t < minChipTemp || t > maxChipTemp) {
+		return fmt.Errorf("temperature %g is out of range", t)
+	}
+	if rh, ok := d["humidity"].(float64); ok && rh > 100 {
+		return fmt.Errorf("humidity %g is out of range", rh)
+	}
+	if pct, ok := d["battery_pct"].(int); ok && pct > 100 {
+		return fmt.Errorf("battery level %d is out of range", pct)
+	}
+	if flags, ok := d["flags"].(int); ok && flags&pvvxUnusedFlags != 0 {
+		return fmt.Errorf("unused flags %#x are set", flags&pvvxUnusedFlags)
+	}
+	return nil
+}
+
+func reversed(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
@@ -0,0 +1,48 @@
+package decode
+
+import (
+	"net"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	mac, _ := net.ParseMAC("a4:c1:38:12:34:56")
+	for _, tc := range []struct {
+		name    string
+		uuid    string
+		payload string
+		ok      bool
+	}{
+		{"pvvx", "181a", "563412 38c1a4 6608 5e11 820b 59 2c 04", true},
+		{"atc1441", "181a", "a4c138123456 00d7 2c 59 0b9a 2c", true},
+		{"pvvx with pressure", "181a", "563412 38c1a4 6608 5e11 820b 59 9527 2c 04", true},
+		{"another sensor's frame", "181a", "573412 38c1a4 6608 5e11 820b 59 2c 04", false},
+		{"temperature too high", "181a", "563412 38c1a4 1331 5e11 820b 59 2c 04", false}, // 125.31°C
+		{"temperature too low", "181a", "563412 38c1a4 0bf0 5e11 820b 59 2c 04", false},  // -40.53°C
+		{"humidity over 100", "181a", "563412 38c1a4 6608 1127 820b 59 2c 04", false},    // 100.01%
+		{"battery over 100", "181a", "563412 38c1a4 6608 5e11 820b 65 2c 04", false},     // 101%
+		{"unused flags set", "181a", "563412 38c1a4 6608 5e11 820b 59 2c 24", false},
+		{"atc1441 battery over 100", "181a", "a4c138123456 00d7 2c 65 0b9a 2c", false},
+		{"unknown length", "181a", "563412 38c1a4 6608", true},
+		{"other UUID", "fe95", "563412 38c1a4 6608 5e11 820b 59 2c ff", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Validate(tc.uuid, unhex(t, tc.payload), mac)
+			if tc.ok && err != nil {
+				t.Errorf("Validate(%s) = %s, want nil", tc.payload, err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("Validate(%s) = nil, want an error", tc.payload)
+			}
+		})
+	}
+}
+
+// TestValidateMissingFields checks a format without the fields that are
+// range checked passes rather than panicking.
+func TestValidateMissingFields(t *testing.T) {
+	fields := []customField{{"illuminance", 6, 3, false, false, 100}}
+	if err := validate(fields, unhex(t, "563412 38c1a4 e8bd01 000000 00000000"), nil); err != nil {
+		t.Errorf("validate = %s, want nil", err)
+	}
+}
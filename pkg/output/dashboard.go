@@ -0,0 +1,310 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// DashboardConfig configures the web dashboard.
+type DashboardConfig struct {
+	Enabled bool
+	Listen  string // defaults to :8080
+	Units   string // metric or imperial; see WithUnits
+	// How far back /api/sensors/<name>/history goes, as a duration like
+	// "6h"; defaults to a day.
+	History string
+	// The most readings kept per sensor for it, the oldest dropped first;
+	// defaults to 10000.
+	HistoryPoints int `toml:"history_points"`
+}
+
+// HistoryWindow returns how long readings are kept for.
+func (c DashboardConfig) HistoryWindow() (time.Duration, error) {
+	if c.History == "" {
+		return 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(c.History)
+	if err != nil {
+		return 0, fmt.Errorf("bad history: %s", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("history must be positive, not %s", d)
+	}
+	return d, nil
+}
+
+const (
+	// sparkWindow is how far back the dashboard's sparklines go.
+	sparkWindow = time.Hour
+	// sparkPoints caps the points kept per sensor, e.g. with a point per
+	// reading.
+	sparkPoints = 720
+)
+
+// sparkFields are the fields of the sparklines.
+var sparkFields = []string{"temperature", "humidity"}
+
+type dashPoint struct {
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+// dashRing is a ring buffer of a sensor's readings, growing to max points
+// and then overwriting the oldest.
+type dashRing struct {
+	points []dashPoint
+	max    int
+	next   int // where the next point goes once it's full
+}
+
+func (r *dashRing) add(p dashPoint) {
+	if len(r.points) < r.max {
+		r.points = append(r.points, p)
+		return
+	}
+	r.points[r.next] = p
+	r.next = (r.next + 1) % r.max
+}
+
+// since returns the points after t, in the order they were added.
+func (r *dashRing) since(t time.Time) []dashPoint {
+	out := []dashPoint{}
+	for _, part := range [][]dashPoint{r.points[r.next:], r.points[:r.next]} {
+		for _, p := range part {
+			if p.Time.After(t) {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
+
+type dashSensor struct {
+	Name     string      `json:"name"`
+	MAC      string      `json:"mac"`
+	Model    string      `json:"model"`
+	Time     time.Time   `json:"time"` // of the latest reading
+	Fields   decode.Data `json:"fields"`
+	LastSeen time.Time   `json:"last_seen"`
+	History  []dashPoint `json:"history"` // for the sparklines
+
+	ring *dashRing
+}
+
+// dashHistory is the body of /api/sensors/<name>/history.
+type dashHistory struct {
+	Name    string      `json:"name"`
+	MAC     string      `json:"mac"`
+	History []dashPoint `json:"history"`
+}
+
+// Dashboard serves a web page showing each sensor's latest readings with
+// sparklines of the last hour, and the same as JSON on /api/sensors. It keeps
+// each sensor's numeric fields for the history window in memory, served on
+// /api/sensors/<name>/history.
+type Dashboard struct {
+	// LastSeen, if set, returns when each sensor was last heard from, by
+	// name.
+	LastSeen func() map[string]time.Time
+
+	window    time.Duration
+	maxPoints int
+
+	mu      sync.Mutex
+	sensors map[string]*dashSensor
+}
+
+func NewDashboard(conf DashboardConfig) (*Dashboard, error) {
+	window, err := conf.HistoryWindow()
+	if err != nil {
+		return nil, err
+	}
+	if conf.HistoryPoints < 0 {
+		return nil, fmt.Errorf("history_points must be positive, not %d", conf.HistoryPoints)
+	}
+	if conf.HistoryPoints == 0 {
+		conf.HistoryPoints = 10000
+	}
+	return &Dashboard{window: window, maxPoints: conf.HistoryPoints, sensors: make(map[string]*dashSensor)}, nil
+}
+
+// Configure adds the configured sensors, keeping the readings of those
+// already known, and drops any no longer configured.
+func (d *Dashboard) Configure(devices []Device) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sensors := make(map[string]*dashSensor, len(devices))
+	for _, dev := range devices {
+		s, ok := d.sensors[dev.Name]
+		if !ok {
+			s = &dashSensor{Name: dev.Name, Fields: decode.Data{}, ring: &dashRing{max: d.maxPoints}}
+		}
+		s.MAC, s.Model = dev.MAC, dev.Model
+		sensors[dev.Name] = s
+	}
+	d.sensors = sensors
+}
+
+func (d *Dashboard) Write(_ context.Context, name string, fields decode.Data, ts time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.sensors[name]
+	if !ok {
+		return nil
+	}
+	if ts.After(s.Time) {
+		s.Time = ts
+	}
+	p := dashPoint{Time: ts, Values: make(map[string]float64)}
+	for k, v := range fields {
+		s.Fields[k] = v
+		switch n := v.(type) {
+		case float64:
+			p.Values[k] = n
+		case int:
+			p.Values[k] = float64(n)
+		}
+	}
+	if len(p.Values) > 0 {
+		s.ring.add(p)
+	}
+	return nil
+}
+
+// sparkline returns the last hour of s's sparkline fields, with at most
+// sparkPoints points.
+func sparkline(s *dashSensor) []dashPoint {
+	out := []dashPoint{}
+	for _, p := range s.ring.since(time.Now().Add(-sparkWindow)) {
+		v := make(map[string]float64)
+		for _, f := range sparkFields {
+			if n, ok := p.Values[f]; ok {
+				v[f] = n
+			}
+		}
+		if len(v) > 0 {
+			out = append(out, dashPoint{p.Time, v})
+		}
+	}
+	if len(out) > sparkPoints {
+		out = out[len(out)-sparkPoints:]
+	}
+	return out
+}
+
+func (d *Dashboard) snapshot() []dashSensor {
+	var seen map[string]time.Time
+	if d.LastSeen != nil {
+		seen = d.LastSeen()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]dashSensor, 0, len(d.sensors))
+	for _, s := range d.sensors {
+		c := *s
+		c.Fields = make(decode.Data, len(s.Fields))
+		for k, v := range s.Fields {
+			c.Fields[k] = v
+		}
+		c.History = sparkline(s)
+		c.LastSeen = seen[s.Name]
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// history returns the readings kept for the sensor with the name or MAC
+// address name after since, if there's such a sensor.
+func (d *Dashboard) history(name string, since time.Time) (dashHistory, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.sensors[name]
+	if !ok {
+		for _, o := range d.sensors {
+			if o.MAC != "" && o.MAC == strings.ToLower(name) {
+				s, ok = o, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return dashHistory{}, false
+	}
+	if cutoff := time.Now().Add(-d.window); since.Before(cutoff) {
+		since = cutoff
+	}
+	return dashHistory{s.Name, s.MAC, s.ring.since(since)}, true
+}
+
+// parseSince parses the since parameter of the history: a time in RFC 3339
+// format, or a duration before now, e.g. 2h. Empty is the whole window.
+func parseSince(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad since %q: want a time like 2006-01-02T15:04:05Z or a duration like 2h", v)
+	}
+	return t, nil
+}
+
+// Handler returns the handler serving the dashboard on /, its data on
+// /api/sensors and each sensor's history on /api/sensors/<name>/history.
+func (d *Dashboard) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sensors", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.snapshot())
+	})
+	mux.HandleFunc("/api/sensors/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/sensors/")
+		if !strings.HasSuffix(name, "/history") {
+			http.NotFound(w, r)
+			return
+		}
+		name = strings.TrimSuffix(name, "/history")
+		if r.Method != http.MethodGet {
+			http.Error(w, "GET history", http.StatusMethodNotAllowed)
+			return
+		}
+		since, err := parseSince(r.URL.Query().Get("since"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h, ok := d.history(name, since)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no sensor %s", name), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(dashboardHTML))
+	})
+	return mux
+}
+
+// Serve serves the dashboard at addr.
+func (d *Dashboard) Serve(addr string) error {
+	return http.ListenAndServe(addr, d.Handler())
+}
@@ -0,0 +1,69 @@
+package output
+
+// dashboardHTML is the dashboard page, which polls /api/sensors.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>mijiamon</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 1em; background: #f4f4f4; color: #222; }
+h1 { font-size: 1.2em; }
+#sensors { display: grid; grid-template-columns: repeat(auto-fill, minmax(16em, 1fr)); gap: 1em; }
+.card { background: #fff; border-radius: 8px; padding: 1em; box-shadow: 0 1px 3px rgba(0,0,0,.15); }
+.card h2 { font-size: 1em; margin: 0 0 .5em; }
+.big { font-size: 1.8em; }
+.row { display: flex; justify-content: space-between; align-items: center; }
+.meta { color: #777; font-size: .85em; }
+.stale { color: #c33; }
+svg { width: 100%; height: 2.5em; }
+</style>
+</head>
+<body>
+<h1>mijiamon</h1>
+<div id="sensors"></div>
+<script>
+function age(t) {
+  if (!t || t.startsWith("0001")) return "never";
+  var s = Math.round((Date.now() - new Date(t)) / 1000);
+  if (s < 60) return s + "s ago";
+  if (s < 3600) return Math.round(s / 60) + "m ago";
+  return Math.round(s / 3600) + "h ago";
+}
+function spark(history, field, colour) {
+  var pts = history.filter(function (p) { return field in p.values; });
+  if (pts.length < 2) return "";
+  var vs = pts.map(function (p) { return p.values[field]; });
+  var min = Math.min.apply(null, vs), max = Math.max.apply(null, vs), span = max - min || 1;
+  var t0 = Date.now() - 3600e3;
+  var d = pts.map(function (p, i) {
+    var x = Math.max(0, (new Date(p.time) - t0) / 3600e3 * 100);
+    var y = 38 - (vs[i] - min) / span * 36;
+    return (i ? "L" : "M") + x.toFixed(1) + " " + y.toFixed(1);
+  }).join(" ");
+  return '<svg viewBox="0 0 100 40" preserveAspectRatio="none"><path d="' + d +
+    '" fill="none" stroke="' + colour + '" stroke-width="1.5" vector-effect="non-scaling-stroke"/></svg>';
+}
+function fmt(v, digits) { return typeof v === "number" ? v.toFixed(digits) : "–"; }
+function render(sensors) {
+  document.getElementById("sensors").innerHTML = sensors.map(function (s) {
+    var f = s.fields, unit = f.units === "imperial" ? "°F" : "°C";
+    var stale = s.last_seen && Date.now() - new Date(s.last_seen) > 30 * 60e3;
+    return '<div class="card"><h2>' + s.name + '</h2>' +
+      '<div class="row"><span class="big">' + fmt(f.temperature, 1) + unit + '</span>' +
+      '<span class="big">' + fmt(f.humidity, 0) + '%</span></div>' +
+      spark(s.history, "temperature", "#d62") + spark(s.history, "humidity", "#28c") +
+      '<div class="meta">battery ' + fmt(f.battery_pct, 0) + '% · rssi ' + fmt(f.rssi, 0) + ' dBm</div>' +
+      '<div class="meta' + (stale ? ' stale' : '') + '">seen ' + age(s.last_seen) + '</div></div>';
+  }).join("");
+}
+function update() {
+  fetch("api/sensors").then(function (r) { return r.json(); }).then(render).catch(function () {});
+}
+update();
+setInterval(update, 15000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,186 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// FileConfig configures the file output.
+type FileConfig struct {
+	Dir    string // write files here; the file output is off if unset
+	Format string // json (the default) or csv
+	// Start a new file each day, named for it, unless set to "none".
+	Rotate string
+	// Also start a new file once the current one exceeds this many bytes;
+	// zero disables.
+	MaxSize int64  `toml:"max_size"`
+	Units   string // metric or imperial; see WithUnits
+}
+
+// File appends readings to files as newline-delimited JSON, one object per
+// reading, or CSV with a row per field. Files are appended to across
+// restarts.
+type File struct {
+	conf  FileConfig
+	ext   string
+	daily bool
+
+	mu    sync.Mutex
+	base  string // the current file's name without index or extension
+	index int
+	f     *os.File
+	size  int64
+}
+
+// NewFile returns a file output, creating its directory if need be.
+func NewFile(conf FileConfig) (*File, error) {
+	w := &File{conf: conf}
+	var err error
+	if w.ext, w.daily, err = fileLayout(conf); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// CheckFile returns an error if conf is invalid, without creating anything.
+func CheckFile(conf FileConfig) error {
+	_, _, err := fileLayout(conf)
+	return err
+}
+
+// fileLayout returns the extension of conf's files and whether they're
+// rotated daily.
+func fileLayout(conf FileConfig) (ext string, daily bool, err error) {
+	switch conf.Format {
+	case "", "json":
+		ext = ".jsonl"
+	case "csv":
+		ext = ".csv"
+	default:
+		return "", false, fmt.Errorf("unknown file format %s", conf.Format)
+	}
+	switch conf.Rotate {
+	case "", "daily":
+		daily = true
+	case "none":
+	default:
+		return "", false, fmt.Errorf("unknown file rotation %s", conf.Rotate)
+	}
+	return ext, daily, nil
+}
+
+func (w *File) path(index int) string {
+	name := w.base
+	if index > 0 {
+		name = fmt.Sprintf("%s.%d", name, index)
+	}
+	return filepath.Join(w.conf.Dir, name+w.ext)
+}
+
+// open opens the latest file for base, or the next one if index is past it.
+func (w *File) open(base string, index int) error {
+	if w.f != nil {
+		if err := w.f.Close(); err != nil {
+			Log.Errorf("file: %s", err)
+		}
+		w.f = nil
+	}
+	w.base = base
+	if index < 0 {
+		// pick up where a previous run left off
+		index = 0
+		for {
+			if _, err := os.Stat(w.path(index + 1)); err != nil {
+				break
+			}
+			index++
+		}
+	}
+	f, err := os.OpenFile(w.path(index), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.index, w.f, w.size = index, f, fi.Size()
+	if w.size == 0 && w.ext == ".csv" {
+		return w.write([]byte("time,name,field,value\n"))
+	}
+	return nil
+}
+
+func (w *File) write(b []byte) error {
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	return err
+}
+
+func (w *File) encode(name string, fields decode.Data, ts time.Time) ([]byte, error) {
+	if w.ext == ".jsonl" {
+		return jsonLine(name, fields, ts)
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	t := ts.Format(time.RFC3339Nano)
+	for _, k := range keys {
+		cw.Write([]string{t, name, k, fmt.Sprint(fields[k])})
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// Write appends a reading from the sensor called name.
+func (w *File) Write(_ context.Context, name string, fields decode.Data, ts time.Time) error {
+	b, err := w.encode(name, fields, ts)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	base := "mijiamon"
+	if w.daily {
+		base += "-" + ts.Format("2006-01-02")
+	}
+	switch {
+	case w.f == nil || base != w.base:
+		err = w.open(base, -1)
+	case w.conf.MaxSize > 0 && w.size > 0 && w.size+int64(len(b)) > w.conf.MaxSize:
+		err = w.open(base, w.index+1)
+	}
+	if err != nil {
+		return err
+	}
+	return w.write(b)
+}
+
+// Close closes the current file.
+func (w *File) Close(context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
@@ -0,0 +1,199 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// GraphiteConfig configures the Graphite output.
+type GraphiteConfig struct {
+	Address  string // host:port of Carbon; the output is off if unset
+	Protocol string // plaintext (the default, usually port 2003) or pickle (2004)
+	// The metric path, with {name}, {mac}, {measurement}, {field} and any
+	// {tag} replaced; defaults to mijiamon.{name}.{field}.
+	Template string
+	Units    string // metric or imperial; see WithUnits
+}
+
+var templateVar = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+
+// Graphite sends readings to Carbon over TCP, with a metric per field named
+// by a path template. The connection is reopened on the next write after an
+// error.
+type Graphite struct {
+	conf GraphiteConfig
+
+	mu      sync.Mutex
+	devices map[string]Device // keyed by name
+	conn    net.Conn
+}
+
+// NewGraphite returns a Graphite output.
+func NewGraphite(conf GraphiteConfig) (*Graphite, error) {
+	switch conf.Protocol {
+	case "", "plaintext", "pickle":
+	default:
+		return nil, fmt.Errorf("unknown protocol %s, want plaintext or pickle", conf.Protocol)
+	}
+	if conf.Template == "" {
+		conf.Template = "mijiamon.{name}.{field}"
+	}
+	if !strings.Contains(conf.Template, "{field}") {
+		return nil, fmt.Errorf("template %s doesn't include {field}", conf.Template)
+	}
+	return &Graphite{conf: conf, devices: make(map[string]Device)}, nil
+}
+
+func (g *Graphite) Configure(devices []Device) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.devices = make(map[string]Device, len(devices))
+	for _, d := range devices {
+		g.devices[d.Name] = d
+	}
+}
+
+// graphiteMetric is a field's value at a time.
+type graphiteMetric struct {
+	path  string
+	value float64
+	ts    time.Time
+}
+
+// path returns the metric path for field of device d.
+func (g *Graphite) path(d Device, field string) string {
+	return templateVar.ReplaceAllStringFunc(g.conf.Template, func(v string) string {
+		var s string
+		switch k := v[1 : len(v)-1]; k {
+		case "name":
+			s = d.Name
+		case "mac":
+			s = strings.Replace(d.MAC, ":", "", -1)
+		case "measurement":
+			s = d.Profile.Measurement
+		case "field":
+			s = field
+		default:
+			s = d.Profile.Tags[k]
+		}
+		return graphiteNode(s)
+	})
+}
+
+// graphiteNode makes s safe to use as a node of a metric path.
+func graphiteNode(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == ' ' || r == '/' || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func (g *Graphite) Write(ctx context.Context, name string, fields decode.Data, ts time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	d, ok := g.devices[name]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var metrics []graphiteMetric
+	for _, k := range keys {
+		var f float64
+		switch v := fields[k].(type) {
+		case float64:
+			f = v
+		case int:
+			f = float64(v)
+		default:
+			continue
+		}
+		metrics = append(metrics, graphiteMetric{g.path(d, k), f, ts})
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+	var b []byte
+	if g.conf.Protocol == "pickle" {
+		b = graphitePickle(metrics)
+	} else {
+		var buf bytes.Buffer
+		for _, m := range metrics {
+			fmt.Fprintf(&buf, "%s %s %d\n", m.path, strconv.FormatFloat(m.value, 'f', -1, 64), m.ts.Unix())
+		}
+		b = buf.Bytes()
+	}
+	return g.send(ctx, b)
+}
+
+// send writes b, connecting first if need be; g.mu must be held.
+func (g *Graphite) send(ctx context.Context, b []byte) error {
+	if g.conn == nil {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", g.conf.Address)
+		if err != nil {
+			return err
+		}
+		g.conn = conn
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(10 * time.Second)
+	}
+	g.conn.SetWriteDeadline(deadline)
+	if _, err := g.conn.Write(b); err != nil {
+		g.conn.Close()
+		g.conn = nil
+		return err
+	}
+	return nil
+}
+
+// graphitePickle encodes metrics for Carbon's pickle receiver: a 4-byte
+// length, then a protocol 2 pickle of [(path, (timestamp, value)), ...].
+func graphitePickle(metrics []graphiteMetric) []byte {
+	var p bytes.Buffer
+	p.Write([]byte{0x80, 2, ']', '('}) // PROTO 2, EMPTY_LIST, MARK
+	for _, m := range metrics {
+		p.WriteByte('X') // BINUNICODE
+		binary.Write(&p, binary.LittleEndian, uint32(len(m.path)))
+		p.WriteString(m.path)
+		p.WriteByte('J') // BININT
+		binary.Write(&p, binary.LittleEndian, int32(m.ts.Unix()))
+		p.WriteByte('G') // BINFLOAT
+		binary.Write(&p, binary.BigEndian, math.Float64bits(m.value))
+		p.Write([]byte{0x86, 0x86}) // TUPLE2, TUPLE2
+	}
+	p.Write([]byte{'e', '.'}) // APPENDS, STOP
+	b := make([]byte, 4, 4+p.Len())
+	binary.BigEndian.PutUint32(b, uint32(p.Len()))
+	return append(b, p.Bytes()...)
+}
+
+func (g *Graphite) Close(context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.conn == nil {
+		return nil
+	}
+	err := g.conn.Close()
+	g.conn = nil
+	return err
+}
@@ -0,0 +1,83 @@
+package output
+
+import (
+	"strings"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// hourlyStat accumulates the values of a field over an hour.
+type hourlyStat struct {
+	min, max, sum float64
+	n             int
+}
+
+// hourly accumulates a sensor's readings over the current hour.
+type hourly struct {
+	hour  time.Time
+	stats map[string]*hourlyStat
+	units string // see Convert
+}
+
+// add adds a reading taken at ts, returning the previous hour's summary if
+// ts starts a new hour.
+func (h *hourly) add(fields decode.Data, ts time.Time) (decode.Data, time.Time) {
+	var summary decode.Data
+	var at time.Time
+	hour := ts.Truncate(time.Hour)
+	if !hour.Equal(h.hour) {
+		summary, at = h.summary(), h.hour
+		h.hour, h.stats = hour, make(map[string]*hourlyStat)
+	}
+	if u, ok := fields["units"].(string); ok {
+		h.units = u
+	}
+	for k, v := range fields {
+		// already extremes of the interval
+		if strings.HasSuffix(k, "_min") || strings.HasSuffix(k, "_max") {
+			continue
+		}
+		var f float64
+		switch n := v.(type) {
+		case float64:
+			f = n
+		case int:
+			f = float64(n)
+		default:
+			continue
+		}
+		s, ok := h.stats[k]
+		if !ok {
+			s = &hourlyStat{min: f, max: f}
+			h.stats[k] = s
+		}
+		if f < s.min {
+			s.min = f
+		}
+		if f > s.max {
+			s.max = f
+		}
+		s.sum += f
+		s.n++
+	}
+	return summary, at
+}
+
+// summary returns the min, max and mean of each field, or nil if there
+// were no readings.
+func (h *hourly) summary() decode.Data {
+	if len(h.stats) == 0 {
+		return nil
+	}
+	d := decode.Data{}
+	for k, s := range h.stats {
+		d[k+"_min"] = s.min
+		d[k+"_max"] = s.max
+		d[k+"_mean"] = s.sum / float64(s.n)
+	}
+	if h.units != "" {
+		d["units"] = h.units
+	}
+	return d
+}
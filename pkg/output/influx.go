@@ -0,0 +1,259 @@
+package output
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// InfluxConfig configures the InfluxDB output.
+type InfluxConfig struct {
+	URL       string
+	Token     string // or user:pass for InfluxDB 1.8
+	Org       string
+	MaxPoints int    // buffered for retry per writer; defaults to 10000
+	BufferDir string // persist the retry buffers here if set
+	// Spool every point to BufferDir before sending it, rather than only
+	// those awaiting retry, and keep them all however many there are.
+	Spool   bool
+	TLS     *tls.Config
+	Timeout time.Duration // for each request; zero for none
+	// Also write each sensor's hourly min, max and mean to a separate
+	// measurement, by default its own measurement suffixed _hourly.
+	Hourly            bool
+	HourlyMeasurement string
+}
+
+// writerKey identifies the writer serving a bucket at a given precision.
+type writerKey struct {
+	bucket    string
+	precision time.Duration
+}
+
+// Influx writes readings to InfluxDB, with a RetryWriter for each bucket and
+// precision the sensors use. Readings are sent in one request per writer
+// when it's flushed.
+type Influx struct {
+	conf   InfluxConfig
+	client influxdb2.Client
+
+	mu       sync.Mutex
+	profiles map[string]Profile // keyed by sensor name
+	writers  map[writerKey]*RetryWriter
+	ctx      context.Context
+	stop     context.CancelFunc
+	// lines inherited from a replaced output, awaiting their writer
+	inherited map[writerKey][]string
+	hourly    map[string]*hourly // keyed by sensor name
+}
+
+// NewInflux returns an InfluxDB output; call Configure and then Start.
+func NewInflux(conf InfluxConfig) *Influx {
+	if conf.MaxPoints == 0 {
+		conf.MaxPoints = 10000
+	}
+	return &Influx{
+		conf:      conf,
+		client:    influxdb2.NewClientWithOptions(conf.URL, conf.Token, influxdb2.DefaultOptions().SetTLSConfig(conf.TLS)),
+		profiles:  make(map[string]Profile),
+		writers:   make(map[writerKey]*RetryWriter),
+		inherited: make(map[writerKey][]string),
+		hourly:    make(map[string]*hourly),
+	}
+}
+
+// Configure creates a writer for each bucket and precision used by devices
+// that doesn't already have one.
+func (o *Influx) Configure(devices []Device) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.profiles = make(map[string]Profile)
+	for _, d := range devices {
+		o.profiles[d.Name] = d.Profile
+		key := writerKey{d.Profile.Bucket, d.Profile.Precision}
+		if _, ok := o.writers[key]; ok {
+			continue
+		}
+		var path string
+		if o.conf.BufferDir != "" {
+			name := fmt.Sprintf("%s-%s.lp", key.bucket, PrecisionName(key.precision))
+			path = filepath.Join(o.conf.BufferDir, name)
+		}
+		var w *RetryWriter
+		if o.conf.Spool && path != "" {
+			var err error
+			w, err = NewSpoolWriter(o.client.HTTPService(), o.conf.Org, key.bucket, key.precision, o.conf.MaxPoints, strings.TrimSuffix(path, ".lp")+".spool")
+			if err != nil {
+				Log.Errorf("influxdb: %s, buffering points for bucket %s in memory", err, key.bucket)
+			}
+		}
+		if w == nil {
+			w = NewRetryWriter(o.client.HTTPService(), o.conf.Org, key.bucket, key.precision, o.conf.MaxPoints, path)
+		}
+		w.Timeout = o.conf.Timeout
+		if lines, ok := o.inherited[key]; ok {
+			w.Requeue(lines)
+			delete(o.inherited, key)
+		}
+		o.writers[key] = w
+		if o.ctx != nil {
+			go w.Run(o.ctx)
+		}
+	}
+	for key, lines := range o.inherited {
+		if len(lines) > 0 {
+			Log.Warnf("influxdb: dropping %d points buffered for bucket %s", len(lines), key.bucket)
+		}
+	}
+	o.inherited = make(map[writerKey][]string)
+}
+
+// Start runs the writers' retry loops.
+func (o *Influx) Start() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.ctx != nil {
+		return
+	}
+	o.ctx, o.stop = context.WithCancel(context.Background())
+	for _, w := range o.writers {
+		go w.Run(o.ctx)
+	}
+}
+
+// Write adds a reading from the sensor called name to its bucket's batch.
+func (o *Influx) Write(_ context.Context, name string, fields decode.Data, ts time.Time) error {
+	o.mu.Lock()
+	p, ok := o.profiles[name]
+	w := o.writers[writerKey{p.Bucket, p.Precision}]
+	var summary decode.Data
+	var hour time.Time
+	if ok && o.conf.Hourly {
+		h, ok := o.hourly[name]
+		if !ok {
+			h = &hourly{}
+			o.hourly[name] = h
+		}
+		summary, hour = h.add(fields, ts)
+	}
+	o.mu.Unlock()
+	if !ok || w == nil {
+		return nil // removed by a reload
+	}
+	if summary != nil {
+		hp := p
+		hp.Measurement = o.conf.HourlyMeasurement
+		if hp.Measurement == "" {
+			hp.Measurement = p.Measurement + "_hourly"
+		}
+		w.Add(hp.Point(name, summary, hour))
+	}
+	w.Add(p.Point(name, fields, ts))
+	return nil
+}
+
+// Flush sends each writer's batch, returning the first error.
+func (o *Influx) Flush(ctx context.Context) error {
+	o.mu.Lock()
+	writers := make([]*RetryWriter, 0, len(o.writers))
+	for _, w := range o.writers {
+		writers = append(writers, w)
+	}
+	o.mu.Unlock()
+	var first error
+	for _, w := range writers {
+		if err := w.Flush(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// LastWrite returns when points were last written successfully to any
+// bucket.
+func (o *Influx) LastWrite() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var last time.Time
+	for _, w := range o.writers {
+		if t := w.LastWrite(); t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// Buffered returns the number of points awaiting retry.
+func (o *Influx) Buffered() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for _, w := range o.writers {
+		n += w.Buffered()
+	}
+	for _, lines := range o.inherited {
+		n += len(lines)
+	}
+	return n
+}
+
+// halt stops the writers' retry loops; o.mu must be held.
+func (o *Influx) halt() {
+	if o.stop != nil {
+		o.stop()
+		o.stop = nil
+	}
+}
+
+// TakeOver stops old, which o is replacing, and adopts the points it still
+// has buffered; they're written once o is configured with their bucket.
+func (o *Influx) TakeOver(old *Influx) {
+	old.mu.Lock()
+	old.halt()
+	pending := old.inherited
+	for key, w := range old.writers {
+		pending[key] = append(pending[key], w.Drain()...)
+	}
+	old.writers = make(map[writerKey]*RetryWriter)
+	hourly := old.hourly
+	old.mu.Unlock()
+	old.client.Close()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.conf.Hourly {
+		o.hourly = hourly
+	}
+	for key, lines := range pending {
+		o.inherited[key] = append(o.inherited[key], lines...)
+	}
+}
+
+// Close makes a final attempt to write any buffered points, until ctx is
+// done, and closes the client.
+func (o *Influx) Close(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.halt()
+	for _, w := range o.writers {
+		w.Flush(ctx)
+		if w.Buffered() > 0 {
+			w.Retry(ctx)
+		}
+		if n := w.Buffered(); n > 0 && w.Spooling() {
+			Log.Infof("influxdb: exiting with %d points spooled", n)
+		} else if n > 0 {
+			Log.Warnf("influxdb: exiting with %d points unwritten", n)
+		}
+		w.Close()
+	}
+	o.client.Close()
+	return nil
+}
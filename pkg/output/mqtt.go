@@ -0,0 +1,213 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// MQTTConfig configures the MQTT output.
+type MQTTConfig struct {
+	Broker   string // e.g. tcp://localhost:1883; MQTT output is off if unset
+	ClientID string `toml:"client_id"` // defaults to mijiamon
+	User     string
+	Pass     string
+	PassFile string `toml:"pass_file"` // read Pass from here
+	Topic    string // topic prefix; defaults to mijiamon
+	Retain   bool   // retain state messages
+	// Publish Home Assistant MQTT discovery config for each sensor.
+	Discovery       bool
+	DiscoveryPrefix string `toml:"discovery_prefix"` // defaults to homeassistant
+	Units           string // metric or imperial; see WithUnits
+}
+
+// haEntities describes the Home Assistant entity created for each field.
+var haEntities = []struct {
+	field       string
+	name        string
+	deviceClass string
+	unit        string
+}{
+	{"temperature", "Temperature", "temperature", "°C"},
+	{"humidity", "Humidity", "humidity", "%"},
+	{"battery_pct", "Battery", "battery", "%"},
+}
+
+// MQTT publishes each sensor's readings as a JSON object to
+// <topic>/<name>, with <topic>/status reporting whether the daemon is
+// running.
+type MQTT struct {
+	conf   MQTTConfig
+	client mqtt.Client
+
+	mu        sync.Mutex
+	sensors   []Device // announced to Home Assistant on each connect
+	connected bool
+}
+
+// NewMQTT returns an MQTT output; call Configure and then Start.
+func NewMQTT(conf MQTTConfig) *MQTT {
+	if conf.ClientID == "" {
+		conf.ClientID = "mijiamon"
+	}
+	if conf.Topic == "" {
+		conf.Topic = "mijiamon"
+	}
+	if conf.DiscoveryPrefix == "" {
+		conf.DiscoveryPrefix = "homeassistant"
+	}
+	m := &MQTT{conf: conf}
+	opts := mqtt.NewClientOptions().
+		AddBroker(conf.Broker).
+		SetClientID(conf.ClientID).
+		SetUsername(conf.User).
+		SetPassword(conf.Pass).
+		SetAutoReconnect(true).
+		SetWill(m.statusTopic(), "offline", 1, true).
+		SetOnConnectHandler(func(mqtt.Client) {
+			Log.Infof("mqtt: connected to %s", conf.Broker)
+			m.publish(m.statusTopic(), "online", true)
+			m.mu.Lock()
+			sensors := m.sensors
+			m.mu.Unlock()
+			m.discover(sensors)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			Log.Warnf("mqtt: connection lost: %s", err)
+		})
+	m.client = mqtt.NewClient(opts)
+	return m
+}
+
+// Start connects in the background; messages published before the
+// connection is up are dropped.
+func (m *MQTT) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.connected {
+		m.client.Connect()
+		m.connected = true
+	}
+}
+
+func (m *MQTT) statusTopic() string {
+	return m.conf.Topic + "/status"
+}
+
+func (m *MQTT) stateTopic(name string) string {
+	return m.conf.Topic + "/" + name
+}
+
+func (m *MQTT) publish(topic string, payload interface{}, retain bool) {
+	if !m.client.IsConnectionOpen() {
+		return
+	}
+	t := m.client.Publish(topic, 1, retain, payload)
+	if t.WaitTimeout(5*time.Second) && t.Error() != nil {
+		Log.Errorf("mqtt: publish %s: %s", topic, t.Error())
+	}
+}
+
+// Write publishes a reading from the sensor called name.
+func (m *MQTT) Write(_ context.Context, name string, fields decode.Data, _ time.Time) error {
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	m.publish(m.stateTopic(name), b, m.conf.Retain)
+	return nil
+}
+
+// Configure records the configured sensors and, if discovery is enabled,
+// publishes their Home Assistant config and removes that of any sensors no
+// longer configured.
+func (m *MQTT) Configure(sensors []Device) {
+	m.mu.Lock()
+	old := m.sensors
+	m.sensors = sensors
+	m.mu.Unlock()
+	if !m.conf.Discovery {
+		return
+	}
+	current := make(map[string]bool)
+	for _, s := range sensors {
+		current[s.MAC] = true
+	}
+	go func() {
+		for _, s := range old {
+			if !current[s.MAC] {
+				for _, e := range haEntities {
+					m.publish(m.configTopic(s, e.field), "", true)
+				}
+			}
+		}
+		m.discover(sensors)
+	}()
+}
+
+func haID(s Device) string {
+	if s.Zone {
+		return "mijiamon_zone_" + s.Name
+	}
+	return "mijiamon_" + strings.Replace(s.MAC, ":", "", -1)
+}
+
+func (m *MQTT) configTopic(s Device, field string) string {
+	return fmt.Sprintf("%s/sensor/%s/%s/config", m.conf.DiscoveryPrefix, haID(s), field)
+}
+
+func (m *MQTT) discover(sensors []Device) {
+	if !m.conf.Discovery {
+		return
+	}
+	for _, s := range sensors {
+		id := haID(s)
+		device := map[string]interface{}{
+			"identifiers":  []string{id},
+			"connections":  [][]string{{"mac", s.MAC}},
+			"name":         s.Name,
+			"manufacturer": "Xiaomi",
+			"model":        s.Model,
+		}
+		if s.Zone {
+			delete(device, "connections")
+			device["manufacturer"] = "mijiamon"
+		}
+		for _, e := range haEntities {
+			unit := e.unit
+			if unit == "°C" && m.conf.Units == Imperial {
+				unit = "°F"
+			}
+			config := map[string]interface{}{
+				"name":                fmt.Sprintf("%s %s", s.Name, e.name),
+				"unique_id":           id + "_" + e.field,
+				"device_class":        e.deviceClass,
+				"unit_of_measurement": unit,
+				"state_class":         "measurement",
+				"state_topic":         m.stateTopic(s.Name),
+				"value_template":      fmt.Sprintf("{{ value_json.%s }}", e.field),
+				"availability_topic":  m.statusTopic(),
+				"device":              device,
+			}
+			b, err := json.Marshal(config)
+			if err != nil {
+				Log.Errorf("mqtt: %s", err)
+				continue
+			}
+			m.publish(m.configTopic(s, e.field), b, true)
+		}
+	}
+}
+
+// Close marks the daemon offline and disconnects.
+func (m *MQTT) Close(context.Context) error {
+	m.publish(m.statusTopic(), "offline", true)
+	m.client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,290 @@
+package output
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// NATSConfig configures the NATS output.
+type NATSConfig struct {
+	URL      string // e.g. nats://localhost:4222; the output is off if unset
+	Subject  string // subject prefix; defaults to mijiamon
+	User     string
+	Pass     string
+	PassFile string `toml:"pass_file"` // read Pass from here
+	Token    string // instead of user and pass
+	// Also publish each decoded advertisement, as it's received, to
+	// <subject>.adv.<name>.
+	Advertisements bool
+	TLS            TLSConfig
+}
+
+// NATS publishes each reading as a JSON message to <subject>.<name>. It
+// speaks the NATS client protocol itself, connecting when it's first
+// written to and again, should the connection drop, on the next write.
+type NATS struct {
+	conf NATSConfig
+	addr string
+	tls  *tls.Config // nil without TLS
+
+	mu      sync.Mutex
+	conn    net.Conn
+	w       *bufio.Writer
+	retryAt time.Time         // don't reconnect before this, after failing to
+	devices map[string]Device // keyed by name
+}
+
+// natsReconnectDelay is how long after failing to connect the next attempt
+// is made, so that publishing advertisements doesn't try for every one.
+const natsReconnectDelay = 10 * time.Second
+
+// errNATSDown is returned by publishes while waiting to reconnect.
+var errNATSDown = errors.New("not connected")
+
+// natsMessage is a reading as published.
+type natsMessage struct {
+	Time   time.Time         `json:"time"`
+	Name   string            `json:"name"`
+	MAC    string            `json:"mac,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	Fields decode.Data       `json:"fields"`
+}
+
+// NewNATS returns a NATS output.
+func NewNATS(conf NATSConfig) (*NATS, error) {
+	if conf.Subject == "" {
+		conf.Subject = "mijiamon"
+	}
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	n := &NATS{conf: conf, addr: u.Host, devices: make(map[string]Device)}
+	switch u.Scheme {
+	case "nats", "tls":
+	default:
+		return nil, fmt.Errorf("unknown scheme %s, want nats or tls", u.Scheme)
+	}
+	if u.Port() == "" {
+		n.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil && conf.User == "" {
+		n.conf.User = u.User.Username()
+		n.conf.Pass, _ = u.User.Password()
+	}
+	if u.Scheme == "tls" || conf.TLS.Enabled() {
+		if n.tls, err = conf.TLS.Build(); err != nil {
+			return nil, err
+		}
+		n.tls.ServerName = u.Hostname()
+	}
+	return n, nil
+}
+
+func (n *NATS) Configure(devices []Device) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.devices = make(map[string]Device, len(devices))
+	for _, d := range devices {
+		n.devices[d.Name] = d
+	}
+}
+
+// Write publishes a reading from the sensor called name.
+func (n *NATS) Write(ctx context.Context, name string, fields decode.Data, ts time.Time) error {
+	n.mu.Lock()
+	d, ok := n.devices[name]
+	n.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	b, err := json.Marshal(natsMessage{ts, name, d.MAC, d.Profile.Tags, fields})
+	if err != nil {
+		return err
+	}
+	return n.publish(ctx, n.conf.Subject+"."+natsToken(name), b)
+}
+
+// PublishAdvertisement publishes an advertisement from the sensor called
+// name, decoded to v, if advertisements are to be published.
+func (n *NATS) PublishAdvertisement(name string, v interface{}) {
+	if !n.conf.Advertisements {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		Log.Errorf("nats: %s", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.publish(ctx, n.conf.Subject+".adv."+natsToken(name), b); err != nil && err != errNATSDown {
+		Log.Warnf("nats: publishing advertisement from %s: %s", name, err)
+	}
+}
+
+// natsToken replaces the characters a subject token can't hold with
+// underscores.
+func natsToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '*' || r == '>' || r <= ' ' {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func (n *NATS) publish(ctx context.Context, subject string, payload []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		if time.Now().Before(n.retryAt) {
+			return errNATSDown
+		}
+		if err := n.connect(ctx); err != nil {
+			n.retryAt = time.Now().Add(natsReconnectDelay)
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	n.conn.SetWriteDeadline(deadline)
+	fmt.Fprintf(n.w, "PUB %s %d\r\n", subject, len(payload))
+	n.w.Write(payload)
+	n.w.WriteString("\r\n")
+	if err := n.w.Flush(); err != nil {
+		n.drop()
+		return err
+	}
+	return nil
+}
+
+// connect connects and authenticates, waiting for the server to answer a
+// PING to know it accepted the connection; n.mu must be held.
+func (n *NATS) connect(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	r := bufio.NewReader(conn)
+	// the server speaks first, with an INFO, before any TLS handshake
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	if n.tls != nil {
+		tc := tls.Client(conn, n.tls)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn, r = tc, bufio.NewReader(tc)
+	}
+	opts := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "mijiamon",
+		"lang":     "go",
+		"version":  "1",
+		"protocol": 1,
+	}
+	if n.conf.Token != "" {
+		opts["auth_token"] = n.conf.Token
+	} else if n.conf.User != "" {
+		opts["user"], opts["pass"] = n.conf.User, n.conf.Pass
+	}
+	b, err := json.Marshal(opts)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", b); err != nil {
+		conn.Close()
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return errors.New(strings.Trim(strings.TrimPrefix(line, "-ERR "), "'"))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	Log.Infof("nats: connected to %s", n.addr)
+	n.conn, n.w = conn, bufio.NewWriter(conn)
+	go n.read(conn, r)
+	return nil
+}
+
+// read answers the server's PINGs on conn, which it uses to tell the client
+// is alive, until the connection fails.
+func (n *NATS) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			n.mu.Lock()
+			if n.conn == conn {
+				Log.Warnf("nats: connection lost: %s", err)
+				n.drop()
+			}
+			n.mu.Unlock()
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			n.mu.Lock()
+			if n.conn == conn {
+				conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+				n.w.WriteString("PONG\r\n")
+				n.w.Flush()
+			}
+			n.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			Log.Warnf("nats: %s", line)
+		}
+	}
+}
+
+// drop closes the connection; n.mu must be held.
+func (n *NATS) drop() {
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn, n.w = nil, nil
+	}
+}
+
+// Close disconnects.
+func (n *NATS) Close(context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.drop()
+	return nil
+}
@@ -0,0 +1,348 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// OTLPConfig configures the OpenTelemetry metrics output.
+type OTLPConfig struct {
+	// The collector's OTLP/HTTP endpoint, e.g. http://collector:4318;
+	// the output is off if unset.
+	URL     string
+	Headers map[string]string // sent with each export, e.g. an API key
+	// How often to export, as a duration like "30s"; defaults to a minute.
+	Interval string
+	// Resource attributes added for every sensor, e.g. host.name.
+	Attributes map[string]string
+	TLS        TLSConfig
+}
+
+// ExportInterval returns how often metrics are exported.
+func (c OTLPConfig) ExportInterval() (time.Duration, error) {
+	if c.Interval == "" {
+		return time.Minute, nil
+	}
+	d, err := time.ParseDuration(c.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("bad interval: %s", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("interval must be positive, not %s", d)
+	}
+	return d, nil
+}
+
+// otlpUnits are the UCUM units of the fields that have one.
+var otlpUnits = map[string]string{
+	"temperature": "Cel",
+	"dew_point":   "Cel",
+	"heat_index":  "Cel",
+	"humidity":    "%",
+	"battery_pct": "%",
+	"battery_mv":  "mV",
+	"pressure":    "hPa",
+	"rssi":        "dBm",
+}
+
+// OTLP exports readings to an OpenTelemetry collector as gauges named
+// mijia.<field>, over OTLP/HTTP with JSON encoding. Each sensor is a
+// resource, with its tags, name and MAC address as attributes. Exports run
+// every interval, independently of flushes, with the latest value of each
+// field written since the last; a failed export isn't retried.
+type OTLP struct {
+	conf     OTLPConfig
+	client   *http.Client
+	interval time.Duration
+
+	mu      sync.Mutex
+	devices map[string]Device               // keyed by name
+	latest  map[string]map[string]otlpPoint // by sensor name and field
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type otlpPoint struct {
+	v    interface{} // float64 or int
+	ts   time.Time
+	tags map[string]string // fields written as tags, e.g. adapter
+}
+
+// NewOTLP returns an OTLP output; call Start to begin exporting.
+func NewOTLP(conf OTLPConfig) (*OTLP, error) {
+	interval, err := conf.ExportInterval()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.TLS.Enabled() {
+		tlsConf, err := conf.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConf
+	}
+	return &OTLP{
+		conf:     conf,
+		client:   &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		interval: interval,
+		devices:  make(map[string]Device),
+		latest:   make(map[string]map[string]otlpPoint),
+	}, nil
+}
+
+func (o *OTLP) Configure(devices []Device) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.devices = make(map[string]Device, len(devices))
+	for _, d := range devices {
+		o.devices[d.Name] = d
+	}
+	for name := range o.latest {
+		if _, ok := o.devices[name]; !ok {
+			delete(o.latest, name)
+		}
+	}
+}
+
+// Write records the numeric fields of a reading from the sensor called name
+// for the next export.
+func (o *OTLP) Write(_ context.Context, name string, fields decode.Data, ts time.Time) error {
+	tags := make(map[string]string)
+	for k, v := range fields {
+		if s, ok := v.(string); ok && TagFields[k] {
+			tags[k] = s
+		}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.devices[name]; !ok {
+		return nil
+	}
+	points, ok := o.latest[name]
+	if !ok {
+		points = make(map[string]otlpPoint)
+		o.latest[name] = points
+	}
+	for k, v := range fields {
+		switch v.(type) {
+		case float64, int:
+			points[k] = otlpPoint{v, ts, tags}
+		}
+	}
+	return nil
+}
+
+// Start exports every interval until the output is closed.
+func (o *OTLP) Start() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stop != nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	o.stop, o.done = stop, done
+	go func() {
+		defer close(done)
+		t := time.NewTicker(o.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-stop:
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), o.client.Timeout)
+			if err := o.export(ctx); err != nil {
+				Log.Warnf("otlp: %s", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// Close stops exporting, making a final export of anything written since
+// the last.
+func (o *OTLP) Close(ctx context.Context) error {
+	o.mu.Lock()
+	stop, done := o.stop, o.done
+	o.stop = nil
+	o.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return o.export(ctx)
+}
+
+// export sends the points written since the last export.
+func (o *OTLP) export(ctx context.Context) error {
+	o.mu.Lock()
+	latest := o.latest
+	o.latest = make(map[string]map[string]otlpPoint)
+	devices := make(map[string]Device, len(latest))
+	for name := range latest {
+		devices[name] = o.devices[name]
+	}
+	o.mu.Unlock()
+	if len(latest) == 0 {
+		return nil
+	}
+	req := otlpRequest{}
+	names := make([]string, 0, len(latest))
+	for name := range latest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		req.ResourceMetrics = append(req.ResourceMetrics, o.resourceMetrics(devices[name], latest[name]))
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return o.post(ctx, body)
+}
+
+// resourceMetrics returns the resource for d with a gauge for each of its
+// points.
+func (o *OTLP) resourceMetrics(d Device, points map[string]otlpPoint) otlpResourceMetrics {
+	attrs := map[string]string{"service.name": "mijiamon"}
+	for k, v := range o.conf.Attributes {
+		attrs[k] = v
+	}
+	for k, v := range d.Profile.Tags {
+		attrs[k] = v
+	}
+	attrs["sensor.name"] = d.Name
+	if d.MAC != "" {
+		attrs["sensor.mac"] = d.MAC
+	}
+	rm := otlpResourceMetrics{Resource: otlpResource{Attributes: otlpAttributes(attrs)}}
+	sm := otlpScopeMetrics{Scope: otlpScope{Name: "mijiamon"}}
+	fields := make([]string, 0, len(points))
+	for k := range points {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for _, k := range fields {
+		p := points[k]
+		dp := otlpDataPoint{
+			Attributes:   otlpAttributes(p.tags),
+			TimeUnixNano: strconv.FormatInt(p.ts.UnixNano(), 10),
+		}
+		switch v := p.v.(type) {
+		case float64:
+			dp.AsDouble = &v
+		case int:
+			dp.AsInt = strconv.Itoa(v)
+		}
+		sm.Metrics = append(sm.Metrics, otlpMetric{
+			Name:  "mijia." + k,
+			Unit:  otlpUnits[baseField(k)],
+			Gauge: otlpGauge{DataPoints: []otlpDataPoint{dp}},
+		})
+	}
+	rm.ScopeMetrics = []otlpScopeMetrics{sm}
+	return rm
+}
+
+func (o *OTLP) post(ctx context.Context, body []byte) error {
+	url := strings.TrimSuffix(o.conf.URL, "/") + "/v1/metrics"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mijiamon")
+	for k, v := range o.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s: %s %s", req.URL.Host, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// The OTLP messages, in the protobuf JSON mapping: 64-bit integers are
+// strings.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name  string    `json:"name"`
+	Unit  string    `json:"unit,omitempty"`
+	Gauge otlpGauge `json:"gauge"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano string         `json:"timeUnixNano"`
+	AsDouble     *float64       `json:"asDouble,omitempty"`
+	AsInt        string         `json:"asInt,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpAttributes returns attrs as key-values, sorted by key.
+func otlpAttributes(attrs map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, otlpKeyValue{k, otlpValue{attrs[k]}})
+	}
+	return kvs
+}
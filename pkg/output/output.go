@@ -0,0 +1,517 @@
+// Package output writes sensor readings to InfluxDB, Parquet files, MQTT, a
+// Prometheus exporter or remote_write receiver, and files.
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// Log receives the package's messages, e.g. about failed writes.
+var Log = decode.Discard
+
+// Settings control how readings are written. Global values are defaults
+// which each sensor can override.
+type Settings struct {
+	Measurement string
+	Bucket      string
+	Precision   string
+	Tags        map[string]string
+	Fields      map[string]string // field renames
+}
+
+// Profile is a sensor's resolved output settings: the global defaults with
+// any per-sensor overrides applied.
+type Profile struct {
+	Measurement string
+	Bucket      string
+	Precision   time.Duration
+	Tags        map[string]string
+	Fields      map[string]string
+}
+
+// Precisions maps the InfluxDB precision names to durations.
+var Precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// PrecisionName returns the InfluxDB name of precision d.
+func PrecisionName(d time.Duration) string {
+	for name, p := range Precisions {
+		if p == d {
+			return name
+		}
+	}
+	return d.String()
+}
+
+// Resolve applies the per-sensor settings o over the defaults def.
+func Resolve(def Settings, o Settings) (Profile, error) {
+	out := Profile{
+		Measurement: "environment",
+		Precision:   time.Nanosecond,
+		Tags:        make(map[string]string),
+		Fields:      make(map[string]string),
+	}
+	for _, c := range []Settings{def, o} {
+		if c.Measurement != "" {
+			out.Measurement = c.Measurement
+		}
+		if c.Bucket != "" {
+			out.Bucket = c.Bucket
+		}
+		if c.Precision != "" {
+			p, ok := Precisions[c.Precision]
+			if !ok {
+				return Profile{}, fmt.Errorf("unknown precision %s", c.Precision)
+			}
+			out.Precision = p
+		}
+		for k, v := range c.Tags {
+			out.Tags[k] = v
+		}
+		for k, v := range c.Fields {
+			out.Fields[k] = v
+		}
+	}
+	to := make(map[string]string, len(out.Fields))
+	for k, v := range out.Fields {
+		if o, ok := to[v]; ok {
+			if o > k {
+				o, k = k, o
+			}
+			return Profile{}, fmt.Errorf("fields %s and %s are both renamed to %s", o, k, v)
+		}
+		to[v] = k
+	}
+	return out, nil
+}
+
+// renameClashes records the renamed fields already logged as clashing with
+// a field written under its own name, by sensor name and field.
+var renameClashes = struct {
+	sync.Mutex
+	logged map[string]bool
+}{logged: make(map[string]bool)}
+
+// Point returns the InfluxDB point for a reading from the sensor called name.
+// A field renamed to the name of another that isn't renamed is dropped, and
+// logged the first time, rather than overwriting it.
+func (o Profile) Point(name string, fields decode.Data, ts time.Time) *write.Point {
+	tags := map[string]string{"name": name}
+	for k, v := range o.Tags {
+		if k != "name" {
+			tags[k] = v
+		}
+	}
+	renamed := make(map[string]interface{})
+	for k, v := range fields {
+		if s, ok := v.(string); ok && TagFields[k] {
+			tags[k] = s
+			continue
+		}
+		if r, ok := o.Fields[k]; ok {
+			_, clash := fields[r]
+			if _, moved := o.Fields[r]; clash && !moved {
+				renameClashes.Lock()
+				if key := name + "\x00" + k; !renameClashes.logged[key] {
+					renameClashes.logged[key] = true
+					Log.Warnf("%s: not writing %s renamed to %s, since %s is written too", name, k, r, r)
+				}
+				renameClashes.Unlock()
+				continue
+			}
+			k = r
+		}
+		renamed[k] = v
+	}
+	return influxdb2.NewPoint(o.Measurement, tags, renamed, ts)
+}
+
+// Output is somewhere readings are written.
+type Output interface {
+	Write(ctx context.Context, name string, fields decode.Data, ts time.Time) error
+}
+
+// Configurable outputs are told about the configured sensors before they
+// start, and again on each reload.
+type Configurable interface {
+	Configure(devices []Device)
+}
+
+// Starter outputs have background work to start once configured.
+type Starter interface {
+	Start()
+}
+
+// Batcher outputs collect the readings written during a flush and send them
+// together when Flush is called.
+type Batcher interface {
+	Flush(ctx context.Context) error
+}
+
+// batches reports whether o, unwrapped from WithUnits, is a Batcher.
+func batches(o Output) bool {
+	if c, ok := o.(*converted); ok {
+		o = c.o
+	}
+	_, ok := o.(Batcher)
+	return ok
+}
+
+// Closer outputs need to finish writing when the daemon stops.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// Device describes a configured sensor to the outputs.
+type Device struct {
+	Name    string
+	MAC     string
+	Model   string
+	Profile Profile
+	Zone    bool // a group of sensors combined, with no MAC address
+}
+
+// TagFields are fields written to InfluxDB as tags rather than fields.
+var TagFields = map[string]bool{
+	"adapter":  true,
+	"units":    true,
+	"restored": true,
+}
+
+// Fanout writes each reading to several outputs concurrently; a failing
+// output doesn't hold up or prevent writes to the others. Each output can
+// have its own queue and goroutine, so that it doesn't hold up the flush
+// either.
+type Fanout struct {
+	// Observe, if set, is called after each write to an output with how
+	// long it took and its result.
+	Observe func(output string, d time.Duration, err error)
+	// Queue, if set, returns the queue for the output called name, as it's
+	// added. Outputs without one are written synchronously.
+	Queue func(output string) QueueConfig
+	// Dropped, if set, is called when a full queue drops a write, and
+	// Queued with the queue's new length whenever it changes.
+	Dropped func(output string)
+	Queued  func(output string, n int)
+
+	mu      sync.Mutex
+	timeout time.Duration
+	names   []string
+	outputs map[string]Output
+	pipes   map[string]*pipeline
+	busy    map[string]bool // outputs with a synchronous write in progress
+}
+
+// stragglerGrace is how long past Timeout an output has to notice its
+// context is done.
+const stragglerGrace = time.Second
+
+func NewFanout() *Fanout {
+	return &Fanout{
+		outputs: make(map[string]Output),
+		pipes:   make(map[string]*pipeline),
+		busy:    make(map[string]bool),
+	}
+}
+
+// SetTimeout bounds each write to an output. A synchronous output that hasn't
+// returned shortly after is given up on, and skipped until it does.
+func (f *Fanout) SetTimeout(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.timeout = d
+}
+
+func (f *Fanout) getTimeout() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.timeout
+}
+
+// Set adds the output called name, replacing any existing one; a nil o
+// removes it. A replacement takes over the writes still queued for the
+// output it replaces.
+func (f *Fanout) Set(name string, o Output) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.outputs[name]; !ok && o != nil {
+		f.names = append(f.names, name)
+	}
+	var queued []job
+	if p, ok := f.pipes[name]; ok {
+		queued = p.stop()
+		delete(f.pipes, name)
+	}
+	if o == nil {
+		for i, n := range f.names {
+			if n == name {
+				f.names = append(f.names[:i], f.names[i+1:]...)
+				break
+			}
+		}
+		delete(f.outputs, name)
+		if len(queued) > 0 {
+			Log.Warnf("%s: dropping %d queued writes", name, len(queued))
+		}
+		return
+	}
+	f.outputs[name] = o
+	if f.Queue == nil {
+		return
+	}
+	if conf := f.Queue(name); conf.Size >= 0 {
+		p := newPipeline(f, name, o, conf)
+		p.inherit(queued)
+		f.pipes[name] = p
+	}
+}
+
+// pipelines returns the outputs' pipelines.
+func (f *Fanout) pipelines() []*pipeline {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ps := make([]*pipeline, 0, len(f.pipes))
+	for _, p := range f.pipes {
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+func (f *Fanout) each(fn func(name string, o Output)) {
+	f.mu.Lock()
+	names := append([]string(nil), f.names...)
+	outputs := make([]Output, len(names))
+	for i, n := range names {
+		outputs[i] = f.outputs[n]
+	}
+	f.mu.Unlock()
+	for i, n := range names {
+		fn(n, outputs[i])
+	}
+}
+
+// Write writes to every output concurrently, returning an error naming any
+// written synchronously that failed; queued writes' errors are logged. A
+// Batcher's writes are observed when it's flushed.
+func (f *Fanout) Write(ctx context.Context, name string, fields decode.Data, ts time.Time) error {
+	for _, p := range f.pipelines() {
+		p.push(job{name: name, fields: fields, ts: ts})
+	}
+	return f.all(ctx, func(ctx context.Context, o Output) (bool, error) {
+		return !batches(o), o.Write(ctx, name, fields, ts)
+	})
+}
+
+// Flush flushes each Batcher output concurrently, returning an error naming
+// any written synchronously that failed.
+func (f *Fanout) Flush(ctx context.Context) error {
+	for _, p := range f.pipelines() {
+		if batches(p.o) {
+			p.push(job{flush: true})
+		}
+	}
+	return f.all(ctx, func(ctx context.Context, o Output) (bool, error) {
+		if !batches(o) {
+			return false, nil
+		}
+		return true, o.(Batcher).Flush(ctx)
+	})
+}
+
+// all calls fn for every output concurrently, observing those for which it
+// returns true, and returns an error naming any that failed or timed out.
+func (f *Fanout) all(ctx context.Context, fn func(ctx context.Context, o Output) (observe bool, err error)) error {
+	timeout := f.getTimeout()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	type result struct {
+		name string
+		err  error
+	}
+	var (
+		errs    []string
+		pending = make(map[string]bool)
+		outputs = make(map[string]Output)
+	)
+	f.each(func(n string, o Output) { outputs[n] = o })
+	// buffered so that stragglers given up on don't block
+	results := make(chan result, len(outputs))
+	f.mu.Lock()
+	for n, o := range outputs {
+		if f.pipes[n] != nil {
+			continue
+		}
+		if f.busy[n] {
+			errs = append(errs, fmt.Sprintf("%s: still busy with an earlier write", n))
+			continue
+		}
+		f.busy[n] = true
+		pending[n] = true
+		go func(n string, o Output) {
+			start := time.Now()
+			observe, err := fn(ctx, o)
+			f.mu.Lock()
+			delete(f.busy, n)
+			f.mu.Unlock()
+			if observe && f.Observe != nil {
+				f.Observe(n, time.Since(start), err)
+			}
+			results <- result{n, err}
+		}(n, o)
+	}
+	f.mu.Unlock()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout + stragglerGrace)
+		defer t.Stop()
+		expired = t.C
+	}
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.name)
+			if r.err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", r.name, r.err))
+			}
+		case <-expired:
+			for n := range pending {
+				errs = append(errs, fmt.Sprintf("%s: timed out after %s", n, timeout))
+			}
+			pending = nil
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Configure passes devices to each Configurable output.
+func (f *Fanout) Configure(devices []Device) {
+	f.each(func(_ string, o Output) {
+		if c, ok := o.(Configurable); ok {
+			c.Configure(devices)
+		}
+	})
+}
+
+// Start starts each Starter output.
+func (f *Fanout) Start() {
+	f.each(func(_ string, o Output) {
+		if s, ok := o.(Starter); ok {
+			s.Start()
+		}
+	})
+}
+
+// Close writes out the queued writes and closes each Closer output, logging
+// any errors, until ctx is done.
+func (f *Fanout) Close(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, p := range f.pipelines() {
+		wg.Add(1)
+		go func(p *pipeline) {
+			defer wg.Done()
+			if n := p.drain(ctx); n > 0 {
+				Log.Warnf("%s: exiting with %d queued writes unwritten", p.name, n)
+			}
+		}(p)
+	}
+	wg.Wait()
+	f.each(func(n string, o Output) {
+		if c, ok := o.(Closer); ok {
+			if err := c.Close(ctx); err != nil {
+				Log.Errorf("%s: %s", n, err)
+			}
+		}
+	})
+	return nil
+}
+
+// JSON writes each reading as a line of JSON holding its time, the sensor's
+// name and the fields.
+type JSON struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{w: w}
+}
+
+func (j *JSON) Write(_ context.Context, name string, fields decode.Data, ts time.Time) error {
+	b, err := jsonLine(name, fields, ts)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.w.Write(b)
+	return err
+}
+
+func jsonLine(name string, fields decode.Data, ts time.Time) ([]byte, error) {
+	row := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		row[k] = v
+	}
+	row["time"] = ts.Format(time.RFC3339Nano)
+	row["name"] = name
+	b, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// LineProtocol writes each reading as the InfluxDB line protocol that would
+// be sent for it, for dry runs.
+type LineProtocol struct {
+	mu       sync.Mutex
+	w        io.Writer
+	profiles map[string]Profile
+}
+
+func NewLineProtocol(w io.Writer) *LineProtocol {
+	return &LineProtocol{w: w, profiles: make(map[string]Profile)}
+}
+
+func (l *LineProtocol) Configure(devices []Device) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.profiles = make(map[string]Profile, len(devices))
+	for _, d := range devices {
+		l.profiles[d.Name] = d.Profile
+	}
+}
+
+func (l *LineProtocol) Write(_ context.Context, name string, fields decode.Data, ts time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, ok := l.profiles[name]
+	if !ok {
+		return nil
+	}
+	_, err := io.WriteString(l.w, write.PointToLineProtocol(p.Point(name, fields, ts), p.Precision))
+	return err
+}
@@ -0,0 +1,289 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetRow is a superset of the fields sensors commonly produce; fields a
+// reading doesn't have are left null, and those without a column of their
+// own, e.g. temperature_raw, are written to other as a JSON object.
+type parquetRow struct {
+	Time            int64    `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Name            string   `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Mac             string   `parquet:"name=mac, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Temperature     *float64 `parquet:"name=temperature, type=DOUBLE, repetitiontype=OPTIONAL"`
+	TemperatureMin  *float64 `parquet:"name=temperature_min, type=DOUBLE, repetitiontype=OPTIONAL"`
+	TemperatureMax  *float64 `parquet:"name=temperature_max, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Humidity        *float64 `parquet:"name=humidity, type=DOUBLE, repetitiontype=OPTIONAL"`
+	HumidityMin     *float64 `parquet:"name=humidity_min, type=DOUBLE, repetitiontype=OPTIONAL"`
+	HumidityMax     *float64 `parquet:"name=humidity_max, type=DOUBLE, repetitiontype=OPTIONAL"`
+	DewPoint        *float64 `parquet:"name=dew_point, type=DOUBLE, repetitiontype=OPTIONAL"`
+	AbsHumidity     *float64 `parquet:"name=absolute_humidity, type=DOUBLE, repetitiontype=OPTIONAL"`
+	VPD             *float64 `parquet:"name=vpd, type=DOUBLE, repetitiontype=OPTIONAL"`
+	HeatIndex       *float64 `parquet:"name=heat_index, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Humidex         *float64 `parquet:"name=humidex, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Comfort         *string  `parquet:"name=comfort, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Pressure        *float64 `parquet:"name=pressure, type=DOUBLE, repetitiontype=OPTIONAL"`
+	BatteryPct      *int64   `parquet:"name=battery_pct, type=INT64, repetitiontype=OPTIONAL"`
+	BatteryMv       *int64   `parquet:"name=battery_mv, type=INT64, repetitiontype=OPTIONAL"`
+	BatteryDaysLeft *float64 `parquet:"name=battery_days_left, type=DOUBLE, repetitiontype=OPTIONAL"`
+	PacketCounter   *int64   `parquet:"name=packet_counter, type=INT64, repetitiontype=OPTIONAL"`
+	Flags           *int64   `parquet:"name=flags, type=INT64, repetitiontype=OPTIONAL"`
+	ReedSwitch      *int64   `parquet:"name=reed_switch, type=INT64, repetitiontype=OPTIONAL"`
+	Illuminance     *float64 `parquet:"name=illuminance, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Moisture        *float64 `parquet:"name=moisture, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Conductivity    *int64   `parquet:"name=conductivity, type=INT64, repetitiontype=OPTIONAL"`
+	Motion          *int64   `parquet:"name=motion, type=INT64, repetitiontype=OPTIONAL"`
+	NoMotionSecs    *int64   `parquet:"name=no_motion_secs, type=INT64, repetitiontype=OPTIONAL"`
+	Light           *int64   `parquet:"name=light, type=INT64, repetitiontype=OPTIONAL"`
+	Power           *int64   `parquet:"name=power, type=INT64, repetitiontype=OPTIONAL"`
+	CO2             *int64   `parquet:"name=co2, type=INT64, repetitiontype=OPTIONAL"`
+	PM25            *int64   `parquet:"name=pm2_5, type=INT64, repetitiontype=OPTIONAL"`
+	PM10            *int64   `parquet:"name=pm10, type=INT64, repetitiontype=OPTIONAL"`
+	TVOC            *int64   `parquet:"name=tvoc, type=INT64, repetitiontype=OPTIONAL"`
+	Count           *int64   `parquet:"name=count, type=INT64, repetitiontype=OPTIONAL"`
+	Opening         *int64   `parquet:"name=opening, type=INT64, repetitiontype=OPTIONAL"`
+	Door            *int64   `parquet:"name=door, type=INT64, repetitiontype=OPTIONAL"`
+	Window          *int64   `parquet:"name=window, type=INT64, repetitiontype=OPTIONAL"`
+	WaterLeak       *int64   `parquet:"name=water_leak, type=INT64, repetitiontype=OPTIONAL"`
+	Smoke           *int64   `parquet:"name=smoke, type=INT64, repetitiontype=OPTIONAL"`
+	BatteryLow      *int64   `parquet:"name=battery_low, type=INT64, repetitiontype=OPTIONAL"`
+	Rssi            *int64   `parquet:"name=rssi, type=INT64, repetitiontype=OPTIONAL"`
+	AdvCount        *int64   `parquet:"name=adv_count, type=INT64, repetitiontype=OPTIONAL"`
+	Stale           *int64   `parquet:"name=stale, type=INT64, repetitiontype=OPTIONAL"`
+	Implausible     *int64   `parquet:"name=implausible, type=INT64, repetitiontype=OPTIONAL"`
+	Sensors         *int64   `parquet:"name=sensors, type=INT64, repetitiontype=OPTIONAL"`
+	DeviceTypeID    *int64   `parquet:"name=device_type_id, type=INT64, repetitiontype=OPTIONAL"`
+	FirmwareVersion *string  `parquet:"name=firmware_version, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Other           *string  `parquet:"name=other, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+}
+
+// parquetColumns are the names of parquetRow's columns, from its tags.
+var parquetColumns = func() map[string]bool {
+	cols := make(map[string]bool)
+	t := reflect.TypeOf(parquetRow{})
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.SplitN(t.Field(i).Tag.Get("parquet"), ",", 2)[0]
+		cols[strings.TrimPrefix(tag, "name=")] = true
+	}
+	return cols
+}()
+
+// parquetOther returns the fields without a column of their own as a JSON
+// object, or nil if there are none.
+func parquetOther(fields decode.Data) *string {
+	other := make(map[string]interface{})
+	for k, v := range fields {
+		if !parquetColumns[k] {
+			other[k] = v
+		}
+	}
+	if len(other) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(other)
+	if err != nil {
+		return nil
+	}
+	s := string(b)
+	return &s
+}
+
+func parquetFloat(v interface{}) *float64 {
+	var f float64
+	switch n := v.(type) {
+	case float64:
+		f = n
+	case int:
+		f = float64(n)
+	default:
+		return nil
+	}
+	return &f
+}
+
+func parquetInt(v interface{}) *int64 {
+	var i int64
+	switch n := v.(type) {
+	case int:
+		i = int64(n)
+	case float64:
+		i = int64(n)
+	default:
+		return nil
+	}
+	return &i
+}
+
+func parquetString(v interface{}) *string {
+	s, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	return &s
+}
+
+func newParquetRow(name, mac string, fields decode.Data, ts time.Time) *parquetRow {
+	return &parquetRow{
+		Time:            ts.UnixNano() / int64(time.Millisecond),
+		Name:            name,
+		Mac:             mac,
+		Temperature:     parquetFloat(fields["temperature"]),
+		TemperatureMin:  parquetFloat(fields["temperature_min"]),
+		TemperatureMax:  parquetFloat(fields["temperature_max"]),
+		Humidity:        parquetFloat(fields["humidity"]),
+		HumidityMin:     parquetFloat(fields["humidity_min"]),
+		HumidityMax:     parquetFloat(fields["humidity_max"]),
+		DewPoint:        parquetFloat(fields["dew_point"]),
+		AbsHumidity:     parquetFloat(fields["absolute_humidity"]),
+		VPD:             parquetFloat(fields["vpd"]),
+		HeatIndex:       parquetFloat(fields["heat_index"]),
+		Humidex:         parquetFloat(fields["humidex"]),
+		Comfort:         parquetString(fields["comfort"]),
+		Pressure:        parquetFloat(fields["pressure"]),
+		BatteryPct:      parquetInt(fields["battery_pct"]),
+		BatteryMv:       parquetInt(fields["battery_mv"]),
+		BatteryDaysLeft: parquetFloat(fields["battery_days_left"]),
+		PacketCounter:   parquetInt(fields["packet_counter"]),
+		Flags:           parquetInt(fields["flags"]),
+		ReedSwitch:      parquetInt(fields["reed_switch"]),
+		Illuminance:     parquetFloat(fields["illuminance"]),
+		Moisture:        parquetFloat(fields["moisture"]),
+		Conductivity:    parquetInt(fields["conductivity"]),
+		Motion:          parquetInt(fields["motion"]),
+		NoMotionSecs:    parquetInt(fields["no_motion_secs"]),
+		Light:           parquetInt(fields["light"]),
+		Power:           parquetInt(fields["power"]),
+		CO2:             parquetInt(fields["co2"]),
+		PM25:            parquetInt(fields["pm2_5"]),
+		PM10:            parquetInt(fields["pm10"]),
+		TVOC:            parquetInt(fields["tvoc"]),
+		Count:           parquetInt(fields["count"]),
+		Opening:         parquetInt(fields["opening"]),
+		Door:            parquetInt(fields["door"]),
+		Window:          parquetInt(fields["window"]),
+		WaterLeak:       parquetInt(fields["water_leak"]),
+		Smoke:           parquetInt(fields["smoke"]),
+		BatteryLow:      parquetInt(fields["battery_low"]),
+		Rssi:            parquetInt(fields["rssi"]),
+		AdvCount:        parquetInt(fields["adv_count"]),
+		Stale:           parquetInt(fields["stale"]),
+		Implausible:     parquetInt(fields["implausible"]),
+		Sensors:         parquetInt(fields["sensors"]),
+		DeviceTypeID:    parquetInt(fields["device_type_id"]),
+		FirmwareVersion: parquetString(fields["firmware_version"]),
+		Other:           parquetOther(fields),
+	}
+}
+
+// parquetRotate is how long a file is written before it's finalised and the
+// day's next one started, bounding what a crash loses.
+const parquetRotate = time.Hour
+
+// ParquetWriter appends readings to Parquet files in dir named after their
+// day, starting a numbered sibling every parquetRotate. A file is only
+// readable once its footer is written, when it's rotated or the writer is
+// closed.
+type ParquetWriter struct {
+	dir    string
+	rotate time.Duration
+	mu     sync.Mutex
+	macs   map[string]string // keyed by sensor name
+	day    string            // the latest day written, which older points go in
+	opened time.Time         // when the current file was created
+	f      *os.File
+	pw     *writer.ParquetWriter
+}
+
+// NewParquetWriter returns a writer creating files in dir.
+func NewParquetWriter(dir string) *ParquetWriter {
+	return &ParquetWriter{dir: dir, rotate: parquetRotate, macs: make(map[string]string)}
+}
+
+// Configure records the address of each sensor, which is written with its
+// readings.
+func (w *ParquetWriter) Configure(devices []Device) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.macs = make(map[string]string)
+	for _, d := range devices {
+		w.macs[d.Name] = d.MAC
+	}
+}
+
+// create opens a new file for day. Parquet files can't be appended to, so a
+// restart or rotation during the day starts a numbered sibling.
+func (w *ParquetWriter) create(day string) error {
+	path := filepath.Join(w.dir, day+".parquet")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(w.dir, fmt.Sprintf("%s.%d.parquet", day, i))
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	pw, err := writer.NewParquetWriterFromWriter(f, new(parquetRow), 1)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	w.day, w.opened, w.f, w.pw = day, time.Now(), f, pw
+	return nil
+}
+
+func (w *ParquetWriter) closeFile() error {
+	if w.pw == nil {
+		return nil
+	}
+	err := w.pw.WriteStop()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f, w.pw = nil, nil
+	return err
+}
+
+// Write appends a reading from the sensor called name. A reading from a day
+// before the latest written, e.g. replayed from a queue, goes in the current
+// file rather than starting another.
+func (w *ParquetWriter) Write(_ context.Context, name string, fields decode.Data, ts time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	mac := w.macs[name]
+	day := ts.Format("2006-01-02")
+	if day < w.day {
+		day = w.day
+	}
+	if w.pw == nil || day != w.day || time.Since(w.opened) >= w.rotate {
+		if err := w.closeFile(); err != nil {
+			return err
+		}
+		if err := w.create(day); err != nil {
+			return err
+		}
+	}
+	return w.pw.Write(newParquetRow(name, mac, fields, ts))
+}
+
+// Close finalises the current file.
+func (w *ParquetWriter) Close(context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closeFile()
+}
@@ -0,0 +1,114 @@
+package output
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// readParquet returns the rows of the Parquet file at path.
+func readParquet(t *testing.T, path string) []parquetRow {
+	t.Helper()
+	fr, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, new(parquetRow), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+	rows := make([]parquetRow, pr.GetNumRows())
+	if err := pr.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	w := NewParquetWriter(dir)
+	w.Configure([]Device{{Name: "plant", MAC: "a4:c1:38:12:34:56"}})
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	// a BTHome reading with moisture in hundredths and a pvvx one's
+	// illuminance
+	fields := decode.Data{"temperature": 21.5, "moisture": 44.46, "illuminance": 1141.52, "co2": 1250, "temperature_raw": 21.44}
+	if err := w.Write(context.Background(), "plant", fields, ts); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rows := readParquet(t, filepath.Join(dir, "2026-01-02.parquet"))
+	if len(rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(rows))
+	}
+	r := rows[0]
+	if r.Name != "plant" || r.Mac != "a4:c1:38:12:34:56" || r.Time != ts.UnixNano()/int64(time.Millisecond) {
+		t.Errorf("got name %s, mac %s, time %d", r.Name, r.Mac, r.Time)
+	}
+	for _, c := range []struct {
+		name string
+		got  *float64
+		want float64
+	}{
+		{"temperature", r.Temperature, 21.5},
+		{"moisture", r.Moisture, 44.46},
+		{"illuminance", r.Illuminance, 1141.52},
+	} {
+		if c.got == nil || *c.got != c.want {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	if r.CO2 == nil || *r.CO2 != 1250 {
+		t.Errorf("co2 = %v, want 1250", r.CO2)
+	}
+	if r.Other == nil || *r.Other != `{"temperature_raw":21.44}` {
+		t.Errorf("other = %v, want temperature_raw", r.Other)
+	}
+	if r.Humidity != nil {
+		t.Errorf("humidity = %v, want null", *r.Humidity)
+	}
+}
+
+func TestParquetRotation(t *testing.T) {
+	dir := t.TempDir()
+	w := NewParquetWriter(dir)
+	ctx := context.Background()
+	day := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	write := func(ts time.Time) {
+		t.Helper()
+		if err := w.Write(ctx, "kitchen", decode.Data{"temperature": 21.5}, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(day)
+	// a point held over from the day before stays in the current file
+	write(day.Add(-13 * time.Hour))
+	// an hour on, the day's next file is started
+	w.opened = w.opened.Add(-w.rotate)
+	write(day.Add(time.Hour))
+	// and the next day starts its own
+	write(day.Add(24 * time.Hour))
+	if err := w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]int{
+		"2026-01-02.parquet":   2,
+		"2026-01-02.1.parquet": 1,
+		"2026-01-03.parquet":   1,
+	} {
+		if got := len(readParquet(t, filepath.Join(dir, file))); got != want {
+			t.Errorf("%s has %d rows, want %d", file, got, want)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.parquet")); len(files) != 3 {
+		t.Errorf("got files %v, want 3", files)
+	}
+}
@@ -0,0 +1,197 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// What a full queue does with another write.
+const (
+	DropOldest = "drop_oldest" // discard the oldest queued write
+	DropNewest = "drop_newest" // discard the new write
+	Block      = "block"       // wait for room, holding up the flush
+)
+
+// QueueConfig configures the queue in front of an output.
+type QueueConfig struct {
+	Size   int    // writes queued; defaults to 1000, negative writes synchronously
+	Policy string // when full: DropOldest (the default), DropNewest or Block
+}
+
+// Check returns an error if the configuration is invalid.
+func (c QueueConfig) Check() error {
+	switch c.Policy {
+	case "", DropOldest, DropNewest, Block:
+		return nil
+	}
+	return fmt.Errorf("unknown queue policy %s, want %s, %s or %s", c.Policy, DropOldest, DropNewest, Block)
+}
+
+// job is a write, or a Batcher's flush, waiting in a pipeline.
+type job struct {
+	name   string
+	fields decode.Data
+	ts     time.Time
+	flush  bool
+}
+
+// pipeline writes to an output from a bounded queue in its own goroutine,
+// so that a slow output only holds up itself.
+type pipeline struct {
+	name string
+	o    Output
+	conf QueueConfig
+	f    *Fanout // for Timeout and the callbacks
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	jobs   []job
+	closed bool
+	done   chan struct{}
+}
+
+func newPipeline(f *Fanout, name string, o Output, conf QueueConfig) *pipeline {
+	if conf.Size == 0 {
+		conf.Size = 1000
+	}
+	if conf.Policy == "" {
+		conf.Policy = DropOldest
+	}
+	p := &pipeline{name: name, o: o, conf: conf, f: f, done: make(chan struct{})}
+	p.cond = sync.NewCond(&p.mu)
+	go p.run()
+	return p
+}
+
+// push queues j, applying the queue's policy if it's full.
+func (p *pipeline) push(j job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.jobs) >= p.conf.Size && !p.closed {
+		switch p.conf.Policy {
+		case DropNewest:
+			p.dropped()
+			return
+		case Block:
+			p.cond.Wait()
+			continue
+		}
+		p.jobs = p.jobs[1:]
+		p.dropped()
+	}
+	if p.closed {
+		return
+	}
+	p.jobs = append(p.jobs, j)
+	p.queued()
+	p.cond.Broadcast()
+}
+
+// inherit queues the writes left by a pipeline p replaces, oldest first,
+// dropping the oldest beyond the queue's size.
+func (p *pipeline) inherit(jobs []job) {
+	if len(jobs) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.jobs = append(jobs, p.jobs...)
+	for len(p.jobs) > p.conf.Size {
+		p.jobs = p.jobs[1:]
+		p.dropped()
+	}
+	p.queued()
+	p.cond.Broadcast()
+}
+
+// dropped and queued report to the Fanout's callbacks; p.mu must be held.
+func (p *pipeline) dropped() {
+	if p.f.Dropped != nil {
+		p.f.Dropped(p.name)
+	}
+}
+
+func (p *pipeline) queued() {
+	if p.f.Queued != nil {
+		p.f.Queued(p.name, len(p.jobs))
+	}
+}
+
+func (p *pipeline) run() {
+	defer close(p.done)
+	for {
+		p.mu.Lock()
+		for len(p.jobs) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.jobs) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		j := p.jobs[0]
+		p.jobs = p.jobs[1:]
+		p.queued()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+		p.do(j)
+	}
+}
+
+// do runs j against the output, bounded by the Fanout's timeout.
+func (p *pipeline) do(j job) {
+	ctx := context.Background()
+	if t := p.f.getTimeout(); t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+	start := time.Now()
+	var err error
+	if j.flush {
+		err = p.o.(Batcher).Flush(ctx)
+	} else {
+		err = p.o.Write(ctx, j.name, j.fields, j.ts)
+	}
+	if p.f.Observe != nil && j.flush == batches(p.o) {
+		p.f.Observe(p.name, time.Since(start), err)
+	}
+	if err == nil {
+		return
+	}
+	if j.flush {
+		Log.Errorf("%s: %s", p.name, err)
+	} else {
+		Log.Errorf("%s: write %s: %s", p.name, j.name, err)
+	}
+}
+
+// stop stops accepting writes and returns those still queued, for a
+// replacement pipeline.
+func (p *pipeline) stop() []job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	jobs := p.jobs
+	p.jobs = nil
+	p.closed = true
+	p.cond.Broadcast()
+	return jobs
+}
+
+// drain stops accepting writes and waits until those queued are done or ctx
+// is, returning how many were abandoned.
+func (p *pipeline) drain(ctx context.Context) int {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	select {
+	case <-p.done:
+		return 0
+	case <-ctx.Done():
+	}
+	return len(p.stop())
+}
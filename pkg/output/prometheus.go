@@ -0,0 +1,148 @@
+package output
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var exporterGauges = map[string]prometheus.GaugeOpts{
+	"temperature": {
+		Name: "mijia_temperature_celsius",
+		Help: "Temperature in degrees Celsius.",
+	},
+	"humidity": {
+		Name: "mijia_humidity_percent",
+		Help: "Relative humidity in percent.",
+	},
+	"pressure": {
+		Name: "mijia_pressure_hpa",
+		Help: "Air pressure in hectopascals.",
+	},
+	"battery_pct": {
+		Name: "mijia_battery_percent",
+		Help: "Battery level in percent.",
+	},
+	"battery_mv": {
+		Name: "mijia_battery_millivolts",
+		Help: "Battery voltage in millivolts.",
+	},
+	"battery_days_left": {
+		Name: "mijia_battery_days_left",
+		Help: "Estimated days until the battery runs out.",
+	},
+	"reed_switch": {
+		Name: "mijia_reed_switch",
+		Help: "State of the reed switch or contact input.",
+	},
+	"rssi": {
+		Name: "mijia_rssi_dbm",
+		Help: "Received signal strength in dBm.",
+	},
+	"adv_count": {
+		Name: "mijia_advertisements",
+		Help: "Advertisements received in the last interval.",
+	},
+	"last_seen_age": {
+		Name: "mijia_last_seen_age_seconds",
+		Help: "Seconds since the sensor was last heard from.",
+	},
+}
+
+// Exporter publishes the most recently flushed readings as Prometheus gauges.
+type Exporter struct {
+	registry *prometheus.Registry
+	gauges   map[string]*prometheus.GaugeVec // keyed by field
+
+	mu   sync.Mutex
+	macs map[string]string // keyed by sensor name
+}
+
+// NewExporter returns an exporter with its own registry.
+func NewExporter() *Exporter {
+	e := &Exporter{
+		registry: prometheus.NewRegistry(),
+		gauges:   make(map[string]*prometheus.GaugeVec),
+		macs:     make(map[string]string),
+	}
+	for field, opts := range exporterGauges {
+		g := prometheus.NewGaugeVec(opts, []string{"name", "mac"})
+		e.registry.MustRegister(g)
+		e.gauges[field] = g
+	}
+	return e
+}
+
+// Configure records the configured sensors, dropping the gauges of any that
+// have been renamed or removed.
+func (e *Exporter) Configure(devices []Device) {
+	macs := make(map[string]string)
+	for _, d := range devices {
+		macs[d.Name] = d.MAC
+	}
+	e.mu.Lock()
+	old := e.macs
+	e.macs = macs
+	e.mu.Unlock()
+	for name, mac := range old {
+		if macs[name] != mac {
+			e.Remove(name, mac)
+		}
+	}
+}
+
+// Write updates the gauges with a reading from the sensor called name.
+func (e *Exporter) Write(_ context.Context, name string, fields decode.Data, _ time.Time) error {
+	e.mu.Lock()
+	mac, ok := e.macs[name]
+	e.mu.Unlock()
+	if ok {
+		e.Update(name, mac, fields)
+	}
+	return nil
+}
+
+// Update sets the gauges for the fields of a reading that have one.
+func (e *Exporter) Update(name, mac string, fields decode.Data) {
+	for field, v := range fields {
+		g, ok := e.gauges[field]
+		if !ok {
+			continue
+		}
+		var f float64
+		switch n := v.(type) {
+		case float64:
+			f = n
+		case int:
+			f = float64(n)
+		default:
+			continue
+		}
+		g.WithLabelValues(name, mac).Set(f)
+	}
+}
+
+// Remove drops the gauges for a sensor that's no longer configured.
+func (e *Exporter) Remove(name, mac string) {
+	for _, g := range e.gauges {
+		g.DeleteLabelValues(name, mac)
+	}
+}
+
+// Register adds collectors, such as the daemon's own metrics, to those
+// served.
+func (e *Exporter) Register(cs ...prometheus.Collector) {
+	e.registry.MustRegister(cs...)
+}
+
+// Serve serves the gauges on /metrics at addr.
+func (e *Exporter) Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{}))
+	return http.ListenAndServe(addr, mux)
+}
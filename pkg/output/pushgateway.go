@@ -0,0 +1,252 @@
+package output
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// PushgatewayConfig configures the Prometheus Pushgateway output.
+type PushgatewayConfig struct {
+	URL      string // e.g. http://pushgateway:9091; the output is off if unset
+	Job      string // defaults to mijiamon
+	User     string // basic auth, if set
+	Pass     string
+	PassFile string `toml:"pass_file"` // read Pass from here
+	// Grouping labels added to every sensor's group, e.g. instance to tell
+	// several collectors apart.
+	Grouping map[string]string
+	TLS      TLSConfig
+}
+
+// Pushgateway pushes each sensor's latest readings to a Prometheus
+// Pushgateway as gauges, named as for remote_write, in a group of its own
+// keyed by job and name. A sensor's group is replaced on each flush and
+// deleted when it's removed, so the Pushgateway doesn't serve it forever.
+type Pushgateway struct {
+	conf   PushgatewayConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	devices map[string]Device      // keyed by name
+	batch   map[string]decode.Data // each sensor's fields since the last Flush
+}
+
+// NewPushgateway returns a Pushgateway output.
+func NewPushgateway(conf PushgatewayConfig) (*Pushgateway, error) {
+	if conf.Job == "" {
+		conf.Job = "mijiamon"
+	}
+	for k := range conf.Grouping {
+		if k == "job" || k == "name" {
+			return nil, fmt.Errorf("grouping label %s is set for each sensor", k)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.TLS.Enabled() {
+		tlsConf, err := conf.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConf
+	}
+	return &Pushgateway{
+		conf:    conf,
+		client:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		devices: make(map[string]Device),
+		batch:   make(map[string]decode.Data),
+	}, nil
+}
+
+// Configure records the configured devices, deleting the groups of any that
+// have been removed.
+func (p *Pushgateway) Configure(devices []Device) {
+	p.mu.Lock()
+	old := p.devices
+	p.devices = make(map[string]Device, len(devices))
+	for _, d := range devices {
+		p.devices[d.Name] = d
+	}
+	var removed []string
+	for name := range old {
+		if _, ok := p.devices[name]; !ok {
+			removed = append(removed, name)
+			delete(p.batch, name)
+		}
+	}
+	p.mu.Unlock()
+	if len(removed) == 0 {
+		return
+	}
+	// not holding up the reload
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.client.Timeout)
+		defer cancel()
+		for _, name := range removed {
+			if err := p.do(ctx, "DELETE", name, nil); err != nil {
+				Log.Warnf("pushgateway: deleting %s: %s", name, err)
+			}
+		}
+	}()
+}
+
+// Write adds a reading from the sensor called name to its group, pushed by
+// the next Flush.
+func (p *Pushgateway) Write(_ context.Context, name string, fields decode.Data, _ time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.devices[name]; !ok {
+		return nil
+	}
+	b, ok := p.batch[name]
+	if !ok {
+		b = make(decode.Data)
+		p.batch[name] = b
+	}
+	for k, v := range fields {
+		b[k] = v
+	}
+	return nil
+}
+
+// Flush pushes the group of each sensor written since the last call,
+// returning the first error.
+func (p *Pushgateway) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	batch := p.batch
+	p.batch = make(map[string]decode.Data)
+	devices := make(map[string]Device, len(batch))
+	for name := range batch {
+		devices[name] = p.devices[name]
+	}
+	p.mu.Unlock()
+	names := make([]string, 0, len(batch))
+	for name := range batch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var first error
+	for _, name := range names {
+		body := exposition(devices[name], batch[name], p.conf.Grouping)
+		if body == "" {
+			continue
+		}
+		if err := p.do(ctx, "PUT", name, strings.NewReader(body)); err != nil && first == nil {
+			first = fmt.Errorf("pushing %s: %s", name, err)
+		}
+	}
+	return first
+}
+
+// exposition returns the gauges for the numeric fields of a reading from d,
+// in the Prometheus text format.
+func exposition(d Device, fields decode.Data, grouping map[string]string) string {
+	labels := make(map[string]string)
+	for k, v := range d.Profile.Tags {
+		labels[promName(k)] = v
+	}
+	for k, v := range fields {
+		if s, ok := v.(string); ok && TagFields[k] {
+			labels[promName(k)] = s
+		}
+	}
+	if d.MAC != "" {
+		labels["mac"] = d.MAC
+	}
+	// the grouping labels are added by the Pushgateway
+	delete(labels, "name")
+	delete(labels, "job")
+	for k := range grouping {
+		delete(labels, promName(k))
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var ls []string
+	for _, k := range names {
+		ls = append(ls, fmt.Sprintf("%s=%s", k, strconv.Quote(labels[k])))
+	}
+	set := ""
+	if len(ls) > 0 {
+		set = "{" + strings.Join(ls, ",") + "}"
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		var f float64
+		switch v := fields[k].(type) {
+		case float64:
+			f = v
+		case int:
+			f = float64(v)
+		default:
+			continue
+		}
+		metric := "mijia_" + promName(k)
+		if g, ok := exporterGauges[k]; ok {
+			metric = g.Name
+		}
+		fmt.Fprintf(&b, "# TYPE %s gauge\n%s%s %s\n", metric, metric, set, strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return b.String()
+}
+
+// groupURL returns the URL of the group of the sensor called name. Values
+// are base64 encoded, as the Pushgateway allows, so they can hold slashes.
+func (p *Pushgateway) groupURL(name string) string {
+	enc := func(v string) string {
+		if v == "" {
+			return "@base64/="
+		}
+		return "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(v))
+	}
+	u := strings.TrimSuffix(p.conf.URL, "/") + "/metrics/job" + enc(p.conf.Job) + "/name" + enc(name)
+	keys := make([]string, 0, len(p.conf.Grouping))
+	for k := range p.conf.Grouping {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		u += "/" + promName(k) + enc(p.conf.Grouping[k])
+	}
+	return u
+}
+
+func (p *Pushgateway) do(ctx context.Context, method, name string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, method, p.groupURL(name), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	req.Header.Set("User-Agent", "mijiamon")
+	if p.conf.User != "" {
+		req.SetBasicAuth(p.conf.User, p.conf.Pass)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s: %s %s", req.URL.Host, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
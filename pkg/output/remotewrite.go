@@ -0,0 +1,212 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// RemoteWriteConfig configures the Prometheus remote_write output.
+type RemoteWriteConfig struct {
+	URL      string // e.g. http://victoria:8428/api/v1/write; the output is off if unset
+	User     string // basic auth, if set
+	Pass     string
+	PassFile string `toml:"pass_file"` // read Pass from here
+	// Labels added to every series, e.g. to tell several collectors apart.
+	ExternalLabels map[string]string `toml:"external_labels"`
+	TLS            TLSConfig
+}
+
+// RemoteWrite sends readings to a Prometheus remote_write receiver such as
+// VictoriaMetrics, Mimir or Thanos. Fields the exporter has a gauge for get
+// its metric name; others are named mijia_<field>. Each series is labelled
+// with the sensor's name, MAC and tags.
+type RemoteWrite struct {
+	conf   RemoteWriteConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	devices map[string]Device // keyed by name
+}
+
+// NewRemoteWrite returns a remote_write output.
+func NewRemoteWrite(conf RemoteWriteConfig) (*RemoteWrite, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.TLS.Enabled() {
+		tlsConf, err := conf.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConf
+	}
+	return &RemoteWrite{
+		conf:    conf,
+		client:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		devices: make(map[string]Device),
+	}, nil
+}
+
+func (r *RemoteWrite) Configure(devices []Device) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.devices = make(map[string]Device, len(devices))
+	for _, d := range devices {
+		r.devices[d.Name] = d
+	}
+}
+
+func (r *RemoteWrite) Write(ctx context.Context, name string, fields decode.Data, ts time.Time) error {
+	r.mu.Lock()
+	d, ok := r.devices[name]
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	labels := make(map[string]string)
+	for k, v := range r.conf.ExternalLabels {
+		labels[promName(k)] = v
+	}
+	for k, v := range d.Profile.Tags {
+		labels[promName(k)] = v
+	}
+	for k, v := range fields {
+		if s, ok := v.(string); ok && TagFields[k] {
+			labels[promName(k)] = s
+		}
+	}
+	labels["name"], labels["mac"] = name, d.MAC
+
+	var series [][]byte
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var f float64
+		switch v := fields[k].(type) {
+		case float64:
+			f = v
+		case int:
+			f = float64(v)
+		default:
+			continue
+		}
+		metric := "mijia_" + promName(k)
+		if g, ok := exporterGauges[k]; ok {
+			metric = g.Name
+		}
+		series = append(series, encodeSeries(metric, labels, f, ts))
+	}
+	if len(series) == 0 {
+		return nil
+	}
+	return r.post(ctx, encodeWriteRequest(series))
+}
+
+func (r *RemoteWrite) post(ctx context.Context, msg []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", r.conf.URL, bytes.NewReader(snappy.Encode(nil, msg)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "mijiamon")
+	if r.conf.User != "" {
+		req.SetBasicAuth(r.conf.User, r.conf.Pass)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s: %s %s", req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// promName replaces the characters not allowed in a Prometheus metric or
+// label name with underscores.
+func promName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		ok := c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9'
+		if !ok {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// The remote_write protocol is protobuf; its few messages are encoded by
+// hand rather than pulling in the Prometheus module:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; } // ms since the epoch
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendBytes appends a length-delimited field.
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func encodeSeries(metric string, labels map[string]string, v float64, ts time.Time) []byte {
+	// receivers expect the labels sorted by name
+	names := make([]string, 0, len(labels)+1)
+	for k := range labels {
+		names = append(names, k)
+	}
+	names = append(names, "__name__")
+	sort.Strings(names)
+	var series []byte
+	for _, k := range names {
+		value := labels[k]
+		if k == "__name__" {
+			value = metric
+		}
+		var label []byte
+		label = appendBytes(label, 1, []byte(k))
+		label = appendBytes(label, 2, []byte(value))
+		series = appendBytes(series, 1, label)
+	}
+	sample := appendVarint(nil, 1<<3|1) // fixed64
+	sample = append(sample, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(sample[len(sample)-8:], math.Float64bits(v))
+	sample = appendVarint(sample, 2<<3|0) // varint
+	sample = appendVarint(sample, uint64(ts.UnixNano()/int64(time.Millisecond)))
+	return appendBytes(series, 2, sample)
+}
+
+func encodeWriteRequest(series [][]byte) []byte {
+	var b []byte
+	for _, s := range series {
+		b = appendBytes(b, 1, s)
+	}
+	return b
+}
@@ -0,0 +1,475 @@
+package output
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+const (
+	minRetryBackoff = 5 * time.Second
+	maxRetryBackoff = 10 * time.Minute
+	retryBatchSize  = 1000
+)
+
+// RetryWriter writes points to a bucket in batches, buffering those that fail
+// as line protocol and retrying them in order with exponential backoff.
+type RetryWriter struct {
+	// Timeout, if set, bounds each request, including retries.
+	Timeout time.Duration
+
+	svc       http.Service
+	url       string
+	precision time.Duration
+	max       int    // oldest points are dropped beyond this many
+	path      string // persist the buffer here if set
+	// write points ahead to here if set, rather than buffering those that
+	// fail in memory
+	spool *spool
+
+	// retrying is held by Retry throughout, so only one runs at a time;
+	// it takes mu only to pick each batch and to mark it sent
+	retrying sync.Mutex
+
+	mu        sync.Mutex
+	batch     []string // added since the last Flush
+	pending   []string
+	sending   int // of pending, from its front, being sent by Retry
+	backoff   time.Duration
+	wake      chan struct{}
+	lastWrite time.Time // last successful post
+}
+
+// NewRetryWriter returns a writer for bucket in org, keeping up to max points
+// for retry and persisting them to path if it's set.
+func NewRetryWriter(svc http.Service, org, bucket string, precision time.Duration, max int, path string) *RetryWriter {
+	params := url.Values{}
+	params.Set("org", org)
+	params.Set("bucket", bucket)
+	params.Set("precision", PrecisionName(precision))
+	r := &RetryWriter{
+		svc:       svc,
+		url:       svc.ServerAPIURL() + "write?" + params.Encode(),
+		precision: precision,
+		max:       max,
+		path:      path,
+		wake:      make(chan struct{}, 1),
+	}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			Log.Errorf("buffer: %s", err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line != "" {
+				r.pending = append(r.pending, line)
+			}
+		}
+		if len(r.pending) > 0 {
+			Log.Infof("buffer: loaded %d points from %s", len(r.pending), path)
+			r.backoff = minRetryBackoff
+			r.wake <- struct{}{}
+		}
+	}
+	return r
+}
+
+// NewSpoolWriter returns a writer for bucket in org that appends every point
+// to the spool at path before sending it, so none are lost however long the
+// server is unreachable. Points spooled by an earlier run are sent first.
+// Should writing to the spool fail, up to max points are buffered in memory
+// instead.
+func NewSpoolWriter(svc http.Service, org, bucket string, precision time.Duration, max int, path string) (*RetryWriter, error) {
+	s, err := openSpool(path)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRetryWriter(svc, org, bucket, precision, max, "")
+	r.spool = s
+	if s.n > 0 {
+		Log.Infof("spool: replaying %d points from %s", s.n, path)
+		r.backoff = minRetryBackoff
+		r.wake <- struct{}{}
+	}
+	return r, nil
+}
+
+// post writes lines directly rather than through the client's write APIs,
+// which keep their own retry queue.
+func (r *RetryWriter) post(ctx context.Context, lines ...string) error {
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	body := strings.NewReader(strings.Join(lines, "\n") + "\n")
+	err := r.svc.DoPostRequest(ctx, r.url, body, nil, func(resp *nethttp.Response) error {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp.Body.Close()
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// retryable reports whether a failed write might succeed later; points the
+// server rejects as invalid never will.
+func retryable(err error) bool {
+	if e, ok := err.(*http.Error); ok && e.StatusCode >= 400 && e.StatusCode < 500 {
+		return e.StatusCode == nethttp.StatusTooManyRequests
+	}
+	return true
+}
+
+// Add adds p to the batch sent by the next Flush.
+func (r *RetryWriter) Add(p *write.Point) {
+	line := strings.TrimSuffix(write.PointToLineProtocol(p, r.precision), "\n")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batch = append(r.batch, line)
+}
+
+// Flush sends the points added since the last call in one request, or
+// queues them behind any points already waiting to be retried.
+func (r *RetryWriter) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lines := r.batch
+	r.batch = nil
+	if len(lines) == 0 {
+		return nil
+	}
+	if r.spool != nil {
+		if err := r.spool.append(lines); err != nil {
+			// buffering them in memory instead
+			Log.Errorf("spool: %s", err)
+		} else {
+			return r.flushSpool(ctx, len(lines))
+		}
+	}
+	if len(r.pending) > 0 {
+		r.enqueue(lines...)
+		return nil
+	}
+	var rejected error
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > retryBatchSize {
+			n = retryBatchSize
+		}
+		err := r.post(ctx, lines[:n]...)
+		if err != nil && retryable(err) {
+			r.enqueue(lines...)
+			r.backoff = minRetryBackoff
+			select {
+			case r.wake <- struct{}{}:
+			default:
+			}
+			return err
+		}
+		if err != nil {
+			// the rest of the batch may well be valid
+			Log.Warnf("buffer: dropping %d rejected points: %s", n, err)
+			if rejected == nil {
+				rejected = err
+			}
+		} else {
+			r.lastWrite = time.Now()
+		}
+		lines = lines[n:]
+	}
+	return rejected
+}
+
+// flushSpool sends the n points just spooled, unless there are earlier ones
+// still to retry; r.mu must be held.
+func (r *RetryWriter) flushSpool(ctx context.Context, n int) error {
+	if len(r.pending) > 0 || r.spool.n > n {
+		return nil
+	}
+	for r.spool.n > 0 {
+		if _, err := r.postSpooled(ctx); err != nil {
+			if retryable(err) {
+				r.backoff = minRetryBackoff
+				select {
+				case r.wake <- struct{}{}:
+				default:
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// postSpooled sends the next batch of spooled points, returning how many
+// there were. They're marked delivered unless the write might succeed
+// later. r.mu must be held.
+func (r *RetryWriter) postSpooled(ctx context.Context) (int, error) {
+	lines, end, err := r.spool.next(retryBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(lines) == 0 {
+		r.spool.n = 0
+		return 0, nil
+	}
+	b := retryBatch{lines: lines, spool: r.spool, end: end}
+	err = r.post(ctx, lines...)
+	r.sent(b, err)
+	return len(lines), err
+}
+
+// retryBatch is a batch of buffered points being sent, taken from the
+// spool if it's set or else from the front of pending.
+type retryBatch struct {
+	lines []string
+	spool *spool
+	end   int64 // the spool offset following the lines
+}
+
+// nextBatch returns the next batch of buffered points to send; r.mu must be
+// held.
+func (r *RetryWriter) nextBatch() (retryBatch, error) {
+	if n := len(r.pending); n > 0 {
+		if n > retryBatchSize {
+			n = retryBatchSize
+		}
+		r.sending = n
+		return retryBatch{lines: append([]string(nil), r.pending[:n]...)}, nil
+	}
+	lines, end, err := r.spool.next(retryBatchSize)
+	if err != nil {
+		return retryBatch{}, err
+	}
+	if len(lines) == 0 {
+		r.spool.n = 0
+	}
+	return retryBatch{lines: lines, spool: r.spool, end: end}, nil
+}
+
+// sent records the outcome of sending b, removing its points from the
+// buffer unless the write might succeed later. Those dropped from pending,
+// or drained with the spool, while b was being sent are already gone. r.mu
+// must be held.
+func (r *RetryWriter) sent(b retryBatch, err error) {
+	if err == nil {
+		r.lastWrite = time.Now()
+	}
+	done := err == nil || !retryable(err)
+	if b.spool == nil {
+		n := r.sending
+		r.sending = 0
+		if done {
+			r.pending = r.pending[n:]
+			r.persist()
+		}
+	} else if done && b.spool == r.spool {
+		if aerr := r.spool.advance(b.end, len(b.lines)); aerr != nil {
+			Log.Errorf("spool: %s", aerr)
+		}
+	}
+}
+
+// buffered returns the number of points waiting to be retried; r.mu must be
+// held.
+func (r *RetryWriter) buffered() int {
+	n := len(r.pending)
+	if r.spool != nil {
+		n += r.spool.n
+	}
+	return n
+}
+
+func (r *RetryWriter) enqueue(lines ...string) {
+	r.pending = append(r.pending, lines...)
+	r.trim()
+	r.persist()
+}
+
+// trim drops the oldest pending points beyond r.max; r.mu must be held.
+func (r *RetryWriter) trim() {
+	if r.max <= 0 || len(r.pending) <= r.max {
+		return
+	}
+	n := len(r.pending) - r.max
+	r.pending = r.pending[n:]
+	if r.sending -= n; r.sending < 0 {
+		r.sending = 0
+	}
+}
+
+func (r *RetryWriter) persist() {
+	if r.path == "" {
+		return
+	}
+	var b strings.Builder
+	for _, line := range r.pending {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		Log.Errorf("buffer: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		Log.Errorf("buffer: %s", err)
+	}
+}
+
+// Drain removes and returns the buffered points, so they can be handed to a
+// replacement writer.
+func (r *RetryWriter) Drain() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lines := r.pending
+	if r.spool != nil {
+		spooled, err := r.spool.drain()
+		if err != nil {
+			Log.Errorf("spool: %s", err)
+		}
+		lines = append(lines, spooled...)
+		r.closeSpool()
+	}
+	lines = append(lines, r.batch...)
+	r.pending, r.batch, r.sending = nil, nil, 0
+	r.persist()
+	return lines
+}
+
+// Spooling reports whether points are being written to a spool.
+func (r *RetryWriter) Spooling() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.spool != nil
+}
+
+// Close closes the spool, if any, leaving the points in it to be sent by the
+// next run.
+func (r *RetryWriter) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeSpool()
+}
+
+// closeSpool closes the spool, if any; r.mu must be held.
+func (r *RetryWriter) closeSpool() {
+	if r.spool == nil {
+		return
+	}
+	if err := r.spool.close(); err != nil {
+		Log.Errorf("spool: %s", err)
+	}
+	r.spool = nil
+}
+
+// Requeue buffers lines taken from another writer for retry.
+func (r *RetryWriter) Requeue(lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backoff = minRetryBackoff
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	if r.spool != nil {
+		// their order doesn't matter, as each point has its timestamp
+		err := r.spool.append(lines)
+		if err == nil {
+			return
+		}
+		Log.Errorf("spool: %s", err)
+	}
+	// behind any Retry is sending
+	sending := r.pending[:r.sending:r.sending]
+	r.pending = append(append(sending, lines...), r.pending[r.sending:]...)
+	r.trim()
+	r.persist()
+}
+
+// Buffered returns the number of points waiting to be retried.
+func (r *RetryWriter) Buffered() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buffered()
+}
+
+// LastWrite returns when points were last written successfully.
+func (r *RetryWriter) LastWrite() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastWrite
+}
+
+// Retry drains the buffer until it's empty or a write fails. Points can be
+// added and flushed, behind those buffered, while it's sending them.
+func (r *RetryWriter) Retry(ctx context.Context) {
+	r.retrying.Lock()
+	defer r.retrying.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.buffered() > 0 {
+		b, err := r.nextBatch()
+		if err == nil && len(b.lines) == 0 {
+			continue
+		}
+		if err == nil {
+			r.mu.Unlock()
+			err = r.post(ctx, b.lines...)
+			r.mu.Lock()
+			r.sent(b, err)
+		}
+		if err != nil && !retryable(err) {
+			Log.Warnf("buffer: dropping %d rejected points: %s", len(b.lines), err)
+		} else if err != nil {
+			r.backoff *= 2
+			if r.backoff > maxRetryBackoff {
+				r.backoff = maxRetryBackoff
+			}
+			Log.Warnf("buffer: retry failed, %d points buffered, next attempt in %s: %s",
+				r.buffered(), r.backoff, err)
+			return
+		}
+	}
+	r.backoff = 0
+	Log.Infof("buffer: flushed")
+}
+
+// Run retries buffered points with backoff until ctx is cancelled.
+func (r *RetryWriter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-r.wake:
+		case <-ctx.Done():
+			return
+		}
+		for {
+			r.mu.Lock()
+			backoff, n := r.backoff, r.buffered()
+			r.mu.Unlock()
+			if n == 0 {
+				break
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			r.Retry(ctx)
+		}
+	}
+}
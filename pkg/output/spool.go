@@ -0,0 +1,133 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// spool is an append-only file of line protocol written ahead of being sent,
+// with a cursor file holding the offset of the first line not yet delivered.
+// It's truncated once every line is delivered, so grows for as long as the
+// server is unreachable.
+type spool struct {
+	path   string
+	f      *os.File
+	size   int64 // of the file
+	cursor int64 // offset of the first undelivered line
+	n      int   // undelivered lines
+}
+
+// openSpool opens the spool at path, creating it if needed, and recovers its
+// undelivered lines. A line torn by a crash while it was appended is
+// discarded.
+func openSpool(path string) (*spool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := int64(bytes.LastIndexByte(b, '\n') + 1)
+	if size < int64(len(b)) {
+		Log.Warnf("spool: discarding %d bytes of a torn line in %s", int64(len(b))-size, path)
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	s := &spool{path: path, f: f, size: size}
+	if c, err := ioutil.ReadFile(s.cursorPath()); err == nil {
+		s.cursor, _ = strconv.ParseInt(strings.TrimSpace(string(c)), 10, 64)
+	} else if !os.IsNotExist(err) {
+		f.Close()
+		return nil, err
+	}
+	if s.cursor < 0 || s.cursor > size || (s.cursor > 0 && b[s.cursor-1] != '\n') {
+		Log.Warnf("spool: ignoring invalid cursor %d for %s", s.cursor, path)
+		s.cursor = 0
+	}
+	s.n = bytes.Count(b[s.cursor:size], []byte{'\n'})
+	return s, nil
+}
+
+func (s *spool) cursorPath() string {
+	return s.path + ".cursor"
+}
+
+// append writes lines to the end of the spool, syncing them to disk.
+func (s *spool) append(lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	b := []byte(strings.Join(lines, "\n") + "\n")
+	if _, err := s.f.Write(b); err != nil {
+		// dropping what was written of the lines, which would otherwise
+		// end in a torn one
+		if terr := s.f.Truncate(s.size); terr != nil {
+			Log.Errorf("spool: %s", terr)
+		}
+		return err
+	}
+	s.size += int64(len(b))
+	s.n += len(lines)
+	return s.f.Sync()
+}
+
+// next returns up to max of the undelivered lines, and the offset following
+// them to pass to advance once they're delivered.
+func (s *spool) next(max int) ([]string, int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(s.f, s.cursor, s.size-s.cursor))
+	var lines []string
+	end := s.cursor
+	for len(lines) < max {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		end += int64(len(line))
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	return lines, end, nil
+}
+
+// advance marks the n lines before offset end delivered, truncating the
+// spool once they all are.
+func (s *spool) advance(end int64, n int) error {
+	s.cursor = end
+	s.n -= n
+	if s.cursor == s.size {
+		if err := s.f.Truncate(0); err != nil {
+			return err
+		}
+		s.cursor, s.size, s.n = 0, 0, 0
+	}
+	tmp := s.cursorPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(s.cursor, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.cursorPath())
+}
+
+// drain returns the undelivered lines, marking them delivered.
+func (s *spool) drain() ([]string, error) {
+	lines, end, err := s.next(s.n)
+	if err != nil {
+		return nil, err
+	}
+	return lines, s.advance(end, len(lines))
+}
+
+func (s *spool) close() error {
+	return s.f.Close()
+}
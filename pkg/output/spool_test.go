@@ -0,0 +1,114 @@
+package output
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// undelivered returns the lines of s not yet delivered.
+func undelivered(t *testing.T, s *spool) []string {
+	t.Helper()
+	lines, _, err := s.next(s.n + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != s.n {
+		t.Errorf("spool has %d undelivered lines, counted %d", len(lines), s.n)
+	}
+	return lines
+}
+
+func TestSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spool")
+	s, err := openSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.append([]string{"a", "b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	lines, end, err := s.next(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("next(2) = %q, want %q", lines, want)
+	}
+	if err := s.advance(end, len(lines)); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	// the cursor survives a restart
+	if s, err = openSpool(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := undelivered(t, s), []string{"c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reopened spool has %q undelivered, want %q", got, want)
+	}
+	lines, err = s.drain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"c"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("drain() = %q, want %q", lines, want)
+	}
+	s.close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 {
+		t.Errorf("delivered spool is %d bytes, want it truncated", fi.Size())
+	}
+}
+
+func TestOpenSpoolRecovery(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		spool  string
+		cursor string // no cursor file if empty
+		want   []string
+	}{
+		{"no cursor", "a\nb\n", "", []string{"a", "b"}},
+		{"cursor", "a\nb\n", "2\n", []string{"b"}},
+		{"torn line", "a\nb\nc", "", []string{"a", "b"}},
+		{"cursor before a torn line", "a\nb", "2", nil},
+		{"cursor in a torn line", "a\nbc", "3", []string{"a"}},
+		{"cursor mid-line", "ab\nc\n", "1", []string{"ab", "c"}},
+		{"cursor past the end", "a\nb\n", "10", []string{"a", "b"}},
+		{"negative cursor", "a\nb\n", "-2", []string{"a", "b"}},
+		{"garbage cursor", "a\nb\n", "x", []string{"a", "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.spool")
+			if err := ioutil.WriteFile(path, []byte(tc.spool), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tc.cursor != "" {
+				if err := ioutil.WriteFile(path+".cursor", []byte(tc.cursor), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s, err := openSpool(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.close()
+			if got := undelivered(t, s); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("undelivered lines = %q, want %q", got, tc.want)
+			}
+			// what's appended next isn't joined onto a torn line
+			if err := s.append([]string{"d"}); err != nil {
+				t.Fatal(err)
+			}
+			want := append(tc.want, "d")
+			if got := undelivered(t, s); !reflect.DeepEqual(got, want) {
+				t.Errorf("after append, undelivered lines = %q, want %q", got, want)
+			}
+		})
+	}
+}
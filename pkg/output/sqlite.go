@@ -0,0 +1,184 @@
+package output
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
+)
+
+// SQLiteConfig configures the SQLite history store.
+type SQLiteConfig struct {
+	Path string // database file; the output is off if unset
+	// How long readings are kept, as a duration like "720h"; defaults to
+	// 30 days.
+	Retention string
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS readings (
+	time  INTEGER NOT NULL, -- Unix nanoseconds
+	name  TEXT NOT NULL,
+	field TEXT NOT NULL,
+	value
+);
+CREATE INDEX IF NOT EXISTS readings_name_time ON readings (name, time);
+CREATE INDEX IF NOT EXISTS readings_time ON readings (time);
+`
+
+// pruneEvery is how often readings older than the retention are deleted.
+const pruneEvery = time.Hour
+
+// SQLite records every reading in a local SQLite database, a row per field,
+// so that readings can be inspected with mijiamon history even while the
+// network or InfluxDB is down.
+type SQLite struct {
+	db        *sql.DB
+	retention time.Duration
+
+	mu     sync.Mutex
+	pruned time.Time
+}
+
+// RetentionPeriod returns how long readings are kept.
+func (c SQLiteConfig) RetentionPeriod() (time.Duration, error) {
+	if c.Retention == "" {
+		return 30 * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(c.Retention)
+	if err != nil {
+		return 0, fmt.Errorf("bad retention: %s", err)
+	}
+	return d, nil
+}
+
+// NewSQLite opens, creating if need be, the database at conf.Path.
+func NewSQLite(conf SQLiteConfig) (*SQLite, error) {
+	retention, err := conf.RetentionPeriod()
+	if err != nil {
+		return nil, err
+	}
+	// WAL lets mijiamon history read while the daemon writes
+	db, err := sql.Open("sqlite3", "file:"+conf.Path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %s", conf.Path, err)
+	}
+	return &SQLite{db: db, retention: retention}, nil
+}
+
+func (s *SQLite) Write(ctx context.Context, name string, fields decode.Data, ts time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO readings (time, name, field, value) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for k, v := range fields {
+		if _, err := stmt.ExecContext(ctx, ts.UnixNano(), name, k, v); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.prune(ctx, ts)
+}
+
+// prune deletes the readings older than the retention, at most every
+// pruneEvery.
+func (s *SQLite) prune(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	due := now.Sub(s.pruned) >= pruneEvery
+	if due {
+		s.pruned = now
+	}
+	s.mu.Unlock()
+	if !due {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, "DELETE FROM readings WHERE time < ?", now.Add(-s.retention).UnixNano())
+	return err
+}
+
+// Row is the readings from a sensor at one time.
+type Row struct {
+	Time   time.Time
+	Name   string
+	Fields decode.Data
+}
+
+// History returns the readings since since, oldest first, from the sensor
+// called name or every sensor if name is "".
+func (s *SQLite) History(ctx context.Context, name string, since time.Time) ([]Row, error) {
+	q := "SELECT time, name, field, value FROM readings WHERE time >= ?"
+	args := []interface{}{since.UnixNano()}
+	if name != "" {
+		q += " AND name = ?"
+		args = append(args, name)
+	}
+	rows, err := s.db.QueryContext(ctx, q+" ORDER BY time, name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Row
+	for rows.Next() {
+		var (
+			ns          int64
+			name, field string
+			value       interface{}
+		)
+		if err := rows.Scan(&ns, &name, &field, &value); err != nil {
+			return nil, err
+		}
+		if n := len(out); n == 0 || out[n-1].Time.UnixNano() != ns || out[n-1].Name != name {
+			out = append(out, Row{Time: time.Unix(0, ns), Name: name, Fields: decode.Data{}})
+		}
+		switch v := value.(type) {
+		case int64:
+			value = int(v)
+		case []byte:
+			value = string(v)
+		}
+		out[len(out)-1].Fields[field] = value
+	}
+	return out, rows.Err()
+}
+
+// Names returns the names of the sensors with readings stored.
+func (s *SQLite) Names(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT name FROM readings")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var n string
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, rows.Err()
+}
+
+func (s *SQLite) Close(context.Context) error {
+	return s.db.Close()
+}
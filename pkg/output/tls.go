@@ -0,0 +1,44 @@
+package output
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// TLSConfig configures TLS for a connection to a server.
+type TLSConfig struct {
+	CA         string // PEM file of CAs to trust instead of the system's
+	Cert       string // PEM client certificate, with Key
+	Key        string
+	SkipVerify bool `toml:"skip_verify"` // don't verify the server's certificate
+}
+
+// Enabled reports whether any TLS settings are given.
+func (c TLSConfig) Enabled() bool {
+	return c != TLSConfig{}
+}
+
+// Build returns the tls.Config described by c.
+func (c TLSConfig) Build() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: c.SkipVerify}
+	if c.CA != "" {
+		b, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New(c.CA + ": no certificates found")
+		}
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
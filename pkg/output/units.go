@@ -0,0 +1,114 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// The unit systems readings can be written in. Readings are metric (°C and
+// hPa) until converted.
+const (
+	Metric   = "metric"
+	Imperial = "imperial"
+)
+
+// CheckUnits returns an error if units isn't a known unit system or "".
+func CheckUnits(units string) error {
+	switch units {
+	case "", Metric, Imperial:
+		return nil
+	}
+	return fmt.Errorf("unknown units %s, want metric or imperial", units)
+}
+
+// conversions convert each field, or its summaries such as temperature_max,
+// from metric to imperial.
+var conversions = map[string]func(float64) float64{
+	"temperature": celsiusToFahrenheit,
+	"dew_point":   celsiusToFahrenheit,
+	"heat_index":  celsiusToFahrenheit,
+	"pressure":    func(hpa float64) float64 { return hpa * 0.02953 }, // inHg
+}
+
+func celsiusToFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
+
+// Convert returns a copy of fields in the unit system units, with a units
+// field recording which; "" returns fields unchanged.
+func Convert(fields decode.Data, units string) decode.Data {
+	if units == "" {
+		return fields
+	}
+	out := make(decode.Data, len(fields)+1)
+	for k, v := range fields {
+		if f, ok := v.(float64); ok && units == Imperial {
+			if c, ok := conversions[baseField(k)]; ok {
+				v = c(f)
+			}
+		}
+		out[k] = v
+	}
+	out["units"] = units
+	return out
+}
+
+// baseField strips any summary suffix from field k.
+func baseField(k string) string {
+	for _, s := range []string{"_min", "_max", "_mean"} {
+		if strings.HasSuffix(k, s) {
+			return strings.TrimSuffix(k, s)
+		}
+	}
+	return k
+}
+
+// converted writes readings to an output in a unit system other than the
+// default.
+type converted struct {
+	o     Output
+	units string
+}
+
+// WithUnits returns o converting readings to units before writing them, or
+// o itself if units is "".
+func WithUnits(o Output, units string) Output {
+	if units == "" {
+		return o
+	}
+	return &converted{o, units}
+}
+
+func (c *converted) Write(ctx context.Context, name string, fields decode.Data, ts time.Time) error {
+	return c.o.Write(ctx, name, Convert(fields, c.units), ts)
+}
+
+func (c *converted) Configure(devices []Device) {
+	if o, ok := c.o.(Configurable); ok {
+		o.Configure(devices)
+	}
+}
+
+func (c *converted) Start() {
+	if o, ok := c.o.(Starter); ok {
+		o.Start()
+	}
+}
+
+func (c *converted) Flush(ctx context.Context) error {
+	if o, ok := c.o.(Batcher); ok {
+		return o.Flush(ctx)
+	}
+	return nil
+}
+
+func (c *converted) Close(ctx context.Context) error {
+	if o, ok := c.o.(Closer); ok {
+		return o.Close(ctx)
+	}
+	return nil
+}
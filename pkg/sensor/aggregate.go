@@ -0,0 +1,125 @@
+package sensor
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+var aggregateMethods = map[string]bool{
+	"mean": true,
+	"min":  true,
+	"max":  true,
+	"last": true,
+}
+
+// aggregate accumulates a field's values over a flush window. Integer fields
+// stay integers so their type in InfluxDB doesn't change.
+type aggregate struct {
+	n        int
+	sum      float64
+	min, max float64
+	last     interface{}
+	numeric  bool
+	isInt    bool
+}
+
+func (a *aggregate) add(v interface{}) {
+	var f float64
+	switch n := v.(type) {
+	case float64:
+		f = n
+		a.isInt = false
+	case int:
+		f = float64(n)
+		a.isInt = a.n == 0 || a.isInt
+	default:
+		a.numeric = false
+		a.last = v
+		a.n++
+		return
+	}
+	if a.n == 0 {
+		a.numeric = true
+		a.min, a.max = f, f
+	}
+	a.min = math.Min(a.min, f)
+	a.max = math.Max(a.max, f)
+	a.sum += f
+	a.last = v
+	a.n++
+}
+
+func (a *aggregate) typed(f float64) interface{} {
+	if a.isInt {
+		return int(math.Round(f))
+	}
+	return f
+}
+
+func (a *aggregate) value(method string) interface{} {
+	if !a.numeric {
+		return a.last
+	}
+	switch method {
+	case "mean":
+		return a.typed(a.sum / float64(a.n))
+	case "min":
+		return a.typed(a.min)
+	case "max":
+		return a.typed(a.max)
+	}
+	return a.last
+}
+
+// Aggregation says how each field is reduced to one value per flush. The zero
+// value takes the last value of every field.
+type Aggregation struct {
+	method   string            // default for fields not in fields
+	fields   map[string]string // per-field method
+	extremes map[string]bool   // also write <field>_min and <field>_max
+}
+
+// NewAggregation returns an Aggregation reducing fields with method (mean,
+// min, max or last, the default) unless given another in methods. Fields in
+// extremes also get <field>_min and <field>_max.
+func NewAggregation(method string, methods map[string]string, extremes []string) (Aggregation, error) {
+	agg := Aggregation{
+		method:   "last",
+		fields:   make(map[string]string),
+		extremes: make(map[string]bool),
+	}
+	if method != "" {
+		agg.method = method
+	}
+	if !aggregateMethods[agg.method] {
+		return Aggregation{}, fmt.Errorf("unknown aggregate method %s", agg.method)
+	}
+	for field, method := range methods {
+		if !aggregateMethods[method] {
+			return Aggregation{}, fmt.Errorf("unknown aggregate method %s for %s", method, field)
+		}
+		agg.fields[field] = method
+	}
+	for _, field := range extremes {
+		agg.extremes[field] = true
+	}
+	return agg, nil
+}
+
+func (agg Aggregation) apply(fields map[string]*aggregate) decode.Data {
+	d := make(decode.Data)
+	for k, a := range fields {
+		method, ok := agg.fields[k]
+		if !ok {
+			method = agg.method
+		}
+		d[k] = a.value(method)
+		if agg.extremes[k] && a.numeric {
+			d[k+"_min"] = a.value("min")
+			d[k+"_max"] = a.value("max")
+		}
+	}
+	return d
+}
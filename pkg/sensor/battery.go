@@ -0,0 +1,83 @@
+package sensor
+
+import (
+	"math"
+	"time"
+)
+
+// BatterySample is a battery level, in percent, at a point in time.
+type BatterySample struct {
+	Time time.Time
+	Pct  float64
+}
+
+const (
+	// batteryStep is the least time between the samples kept, so a long
+	// window stays small.
+	batteryStep = time.Hour
+	// batteryMinSpan is how much history is needed before estimating.
+	batteryMinSpan = 24 * time.Hour
+	// batteryReplaced is how far the level has to rise to be taken as the
+	// battery being replaced, starting the history again.
+	batteryReplaced = 20
+)
+
+// batteryTrend estimates how long a battery has left from a least-squares
+// fit of its level over a window.
+type batteryTrend struct {
+	samples []BatterySample
+}
+
+// add records level pct at t, dropping samples older than window.
+func (b *batteryTrend) add(t time.Time, pct float64, window time.Duration) {
+	if n := len(b.samples); n > 0 {
+		last := b.samples[n-1]
+		if pct-last.Pct >= batteryReplaced {
+			b.samples = nil
+		} else if t.Sub(last.Time) < batteryStep {
+			return
+		}
+	}
+	b.samples = append(b.samples, BatterySample{t, pct})
+	b.trim(t, window)
+}
+
+// trim drops the samples older than window as of t.
+func (b *batteryTrend) trim(t time.Time, window time.Duration) {
+	i := 0
+	for i < len(b.samples) && t.Sub(b.samples[i].Time) > window {
+		i++
+	}
+	b.samples = b.samples[i:]
+}
+
+// daysLeft returns the estimated days until the level reaches zero, or false
+// if there's too little history or the level isn't falling.
+func (b *batteryTrend) daysLeft() (float64, bool) {
+	n := len(b.samples)
+	if n < 3 || b.samples[n-1].Time.Sub(b.samples[0].Time) < batteryMinSpan {
+		return 0, false
+	}
+	t0 := b.samples[0].Time
+	var sx, sy, sxx, sxy float64
+	for _, s := range b.samples {
+		x := s.Time.Sub(t0).Hours() / 24
+		sx += x
+		sy += s.Pct
+		sxx += x * x
+		sxy += x * s.Pct
+	}
+	fn := float64(n)
+	den := fn*sxx - sx*sx
+	if den == 0 {
+		return 0, false
+	}
+	slope := (fn*sxy - sx*sy) / den // percent per day
+	if slope >= 0 {
+		return 0, false
+	}
+	intercept := (sy - slope*sx) / fn
+	now := b.samples[n-1].Time.Sub(t0).Hours() / 24
+	left := (intercept + slope*now) / -slope
+	return math.Max(0, math.Round(left*10)/10), true
+}
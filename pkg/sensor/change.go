@@ -0,0 +1,80 @@
+package sensor
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// ReportOnChange limits how often a field is written, to save storing a
+// point a minute for slow-moving values: it's only written once it has moved
+// by at least Delta from the value last written, or MaxInterval has passed.
+type ReportOnChange struct {
+	Delta       float64
+	MaxInterval time.Duration // zero writes the field only on change
+}
+
+// Check returns an error if the configuration is invalid.
+func (c ReportOnChange) Check() error {
+	if c.Delta < 0 {
+		return fmt.Errorf("delta must not be negative, not %g", c.Delta)
+	}
+	if c.MaxInterval < 0 {
+		return fmt.Errorf("max_interval must not be negative, not %s", c.MaxInterval)
+	}
+	return nil
+}
+
+// bookkeepingFields are written with every point, so a point left with only
+// these once its readings are held back by ReportOnChange isn't written.
+var bookkeepingFields = map[string]bool{
+	"rssi":      true,
+	"adv_count": true,
+}
+
+type reported struct {
+	v float64
+	t time.Time
+}
+
+// reportChanges removes the fields of d that ReportOnChange holds back at
+// t, and returns false if nothing worth writing is left; s.mu must be held.
+func (s *Sensor) reportChanges(d decode.Data, t time.Time) bool {
+	held := false
+	for k, v := range d {
+		c, ok := s.ReportOnChange[k]
+		if !ok {
+			continue
+		}
+		var f float64
+		switch n := v.(type) {
+		case float64:
+			f = n
+		case int:
+			f = float64(n)
+		default:
+			continue
+		}
+		last, ok := s.reported[k]
+		if ok && math.Abs(f-last.v) < c.Delta && (c.MaxInterval <= 0 || t.Sub(last.t) < c.MaxInterval) {
+			delete(d, k)
+			held = true
+			continue
+		}
+		if s.reported == nil {
+			s.reported = make(map[string]reported)
+		}
+		s.reported[k] = reported{f, t}
+	}
+	if !held {
+		return true
+	}
+	for k := range d {
+		if !bookkeepingFields[k] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package sensor
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// derivedMetrics compute extra fields from a sensor's temperature (°C) and
+// relative humidity (%).
+var derivedMetrics = map[string]func(t, rh float64) float64{
+	// Magnus formula with the coefficients of Sonntag (1990)
+	"dew_point": func(t, rh float64) float64 {
+		const a, b = 17.62, 243.12
+		g := math.Log(rh/100) + a*t/(b+t)
+		return b * g / (a - g)
+	},
+	// g/m³
+	"absolute_humidity": func(t, rh float64) float64 {
+		return 6.112 * math.Exp(17.67*t/(t+243.5)) * rh * 2.1674 / (273.15 + t)
+	},
+	// vapour pressure deficit in kPa, using the Tetens equation
+	"vpd": func(t, rh float64) float64 {
+		es := 0.6108 * math.Exp(17.27*t/(t+237.3))
+		return es * (1 - rh/100)
+	},
+	// the US National Weather Service's heat index, in °C
+	"heat_index": func(t, rh float64) float64 {
+		f := t*9/5 + 32
+		hi := 0.5 * (f + 61 + (f-68)*1.2 + rh*0.094)
+		if (hi+f)/2 >= 80 {
+			// the Rothfusz regression, with its adjustments
+			hi = -42.379 + 2.04901523*f + 10.14333127*rh - 0.22475541*f*rh -
+				6.83783e-3*f*f - 5.481717e-2*rh*rh + 1.22874e-3*f*f*rh +
+				8.5282e-4*f*rh*rh - 1.99e-6*f*f*rh*rh
+			switch {
+			case rh < 13 && f >= 80 && f <= 112:
+				hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(f-95))/17)
+			case rh > 85 && f >= 80 && f <= 87:
+				hi += (rh - 85) / 10 * (87 - f) / 5
+			}
+		}
+		return (hi - 32) * 5 / 9
+	},
+	// Environment Canada's humidex, from the dew point
+	"humidex": func(t, rh float64) float64 {
+		const a, b = 17.62, 243.12
+		g := math.Log(rh/100) + a*t/(b+t)
+		td := b * g / (a - g)
+		e := 6.11 * math.Exp(5417.753*(1/273.16-1/(273.15+td)))
+		return t + 0.5555*(e-10)
+	},
+}
+
+// The comfort zone: what the comfort metric reports as comfortable.
+const (
+	comfortMinTemp     = 20 // °C
+	comfortMaxTemp     = 26
+	comfortMinHumidity = 30 // %
+	comfortMaxHumidity = 60
+)
+
+// comfort classifies conditions as comfortable or, outside the comfort zone,
+// by what's wrong with them, temperature first.
+func comfort(t, rh float64) string {
+	switch {
+	case t < comfortMinTemp:
+		return "cold"
+	case t > comfortMaxTemp:
+		return "hot"
+	case rh < comfortMinHumidity:
+		return "dry"
+	case rh > comfortMaxHumidity:
+		return "humid"
+	}
+	return "comfortable"
+}
+
+// CheckDerived returns an error if any of names isn't a metric Derive knows.
+func CheckDerived(names []string) error {
+	for _, name := range names {
+		if _, ok := derivedMetrics[name]; !ok && name != "comfort" {
+			return fmt.Errorf("unknown derived metric %s", name)
+		}
+	}
+	return nil
+}
+
+// Derive adds the named metrics (dew_point, absolute_humidity, vpd,
+// heat_index, humidex and comfort) to fields, if it has both a temperature and
+// a humidity.
+func Derive(names []string, fields decode.Data) {
+	t, ok := fields["temperature"].(float64)
+	if !ok {
+		return
+	}
+	rh, ok := fields["humidity"].(float64)
+	if !ok || rh <= 0 {
+		return
+	}
+	for _, name := range names {
+		if name == "comfort" {
+			fields[name] = comfort(t, rh)
+			continue
+		}
+		fields[name] = math.Round(derivedMetrics[name](t, rh)*100) / 100
+	}
+}
@@ -0,0 +1,83 @@
+package sensor
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// Implausible counts values failing their Plausibility check, by sensor.
+var Implausible = expvar.NewMap("implausible")
+
+// Plausibility bounds a field's values, to catch corrupted advertisements
+// that decode to absurd readings such as -327 °C.
+type Plausibility struct {
+	Min, Max *float64 // unbounded if nil
+	// The most the value can change per minute from the last plausible
+	// one; zero is unlimited.
+	MaxRate float64
+	// Write implausible values, with implausible=1 in the point, rather
+	// than dropping them.
+	Flag bool
+}
+
+// Check returns an error if the configuration is invalid.
+func (p Plausibility) Check() error {
+	if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+		return fmt.Errorf("min %g is above max %g", *p.Min, *p.Max)
+	}
+	if p.MaxRate < 0 {
+		return fmt.Errorf("max_rate must not be negative, not %g", p.MaxRate)
+	}
+	return nil
+}
+
+// plausible is a field's last plausible value.
+type plausible struct {
+	v float64
+	t time.Time
+}
+
+// checkPlausible drops the values of d failing their Plausibility check, or
+// flags d with implausible=1 for those set to Flag; s.mu must be held.
+func (s *Sensor) checkPlausible(d decode.Data, now time.Time) {
+	for k, p := range s.Plausibility {
+		var v float64
+		switch n := d[k].(type) {
+		case float64:
+			v = n
+		case int:
+			v = float64(n)
+		default:
+			continue
+		}
+		why := ""
+		last, ok := s.plausible[k]
+		switch {
+		case p.Min != nil && v < *p.Min:
+			why = fmt.Sprintf("below %g", *p.Min)
+		case p.Max != nil && v > *p.Max:
+			why = fmt.Sprintf("above %g", *p.Max)
+		case p.MaxRate > 0 && ok && math.Abs(v-last.v) > p.MaxRate*now.Sub(last.t).Minutes():
+			why = fmt.Sprintf("changed from %g in %s", last.v, now.Sub(last.t).Round(time.Second))
+		}
+		if why == "" {
+			if s.plausible == nil {
+				s.plausible = make(map[string]plausible)
+			}
+			s.plausible[k] = plausible{v, now}
+			continue
+		}
+		Implausible.Add(s.Name, 1)
+		if p.Flag {
+			Log.Infof("%s: flagging implausible %s %g: %s", s.Name, k, v, why)
+			d["implausible"] = 1
+			continue
+		}
+		Log.Infof("%s: dropping implausible %s %g: %s", s.Name, k, v, why)
+		delete(d, k)
+	}
+}
@@ -0,0 +1,38 @@
+package sensor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"fmt"
+	"net"
+)
+
+// NewIRK returns the cipher for a 16 byte identity resolving key, given most
+// significant byte first as in the Bluetooth Core Specification's sample
+// data.
+func NewIRK(key []byte) (cipher.Block, error) {
+	if len(key) != 16 {
+		return nil, fmt.Errorf("IRK must be 16 bytes, not %d", len(key))
+	}
+	return aes.NewCipher(key)
+}
+
+// IsRPA reports whether hw, a random address, is resolvable: its two most
+// significant bits are 01.
+func IsRPA(hw net.HardwareAddr) bool {
+	return len(hw) == 6 && hw[0]>>6 == 0x01
+}
+
+// Resolves reports whether the resolvable private address hw was generated
+// from the sensor's IRK: whether its lower 24 bits are the hash of its upper
+// 24 (the Core Specification's ah function).
+func (s *Sensor) Resolves(hw net.HardwareAddr) bool {
+	if s.IRK == nil || !IsRPA(hw) {
+		return false
+	}
+	var r [16]byte
+	copy(r[13:], hw[:3])
+	s.IRK.Encrypt(r[:], r[:])
+	return subtle.ConstantTimeCompare(r[13:], hw[3:]) == 1
+}
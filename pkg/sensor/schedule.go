@@ -0,0 +1,160 @@
+package sensor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is when a sensor is active, as cron-style expressions; it's
+// active during any minute matching one of them. A nil Schedule is always
+// active.
+type Schedule []cronExpr
+
+// cronExpr is a parsed cron expression: the minutes, hours, days of the
+// month, months and days of the week it matches.
+type cronExpr struct {
+	fields [5]uint64 // bit n set for each value n matched
+	// whether the day of the month and week were *, as when both are
+	// restricted a day matching either matches, as in cron
+	domStar, dowStar bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+	names    []string // for the values from min
+}{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// ParseSchedule parses exprs, each five fields as in crontab(5): minute,
+// hour, day of month, month and day of week, e.g. "* 8-17 * * mon-fri" for
+// office hours or "* * * oct-apr *" for the heating season. Unlike in cron,
+// a range can wrap around, as that one does.
+func ParseSchedule(exprs []string) (Schedule, error) {
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	s := make(Schedule, 0, len(exprs))
+	for _, e := range exprs {
+		c, err := parseCron(e)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", e, err)
+		}
+		s = append(s, c)
+	}
+	return s, nil
+}
+
+func parseCron(e string) (cronExpr, error) {
+	parts := strings.Fields(e)
+	if len(parts) != len(cronFields) {
+		return cronExpr{}, fmt.Errorf("want %d fields, not %d", len(cronFields), len(parts))
+	}
+	var c cronExpr
+	for i, p := range parts {
+		bits, err := parseCronField(strings.ToLower(p), i)
+		if err != nil {
+			return cronExpr{}, fmt.Errorf("%s: %s", cronFields[i].name, err)
+		}
+		c.fields[i] = bits
+	}
+	// Sunday is 0 or 7
+	if c.fields[4]&(1<<7) != 0 {
+		c.fields[4] |= 1
+	}
+	c.domStar, c.dowStar = parts[2] == "*", parts[4] == "*"
+	return c, nil
+}
+
+// parseCronField parses the comma-separated list of values, ranges and
+// steps of field i.
+func parseCronField(p string, i int) (uint64, error) {
+	f := cronFields[i]
+	value := func(s string) (int, error) {
+		for j, n := range f.names {
+			if s == n {
+				return f.min + j, nil
+			}
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("bad value %q", s)
+		}
+		if v < f.min || v > f.max {
+			return 0, fmt.Errorf("%d is outside %d-%d", v, f.min, f.max)
+		}
+		return v, nil
+	}
+	var bits uint64
+	for _, item := range strings.Split(p, ",") {
+		step := 1
+		if j := strings.IndexByte(item, '/'); j >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[j+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step %q", item[j+1:])
+			}
+			item = item[:j]
+		}
+		lo, hi := f.min, f.max
+		switch j := strings.IndexByte(item, '-'); {
+		case item == "*":
+		case j >= 0:
+			var err error
+			if lo, err = value(item[:j]); err != nil {
+				return 0, err
+			}
+			if hi, err = value(item[j+1:]); err != nil {
+				return 0, err
+			}
+		default:
+			v, err := value(item)
+			if err != nil {
+				return 0, err
+			}
+			lo, hi = v, v
+			if step > 1 {
+				hi = f.max
+			}
+		}
+		// a range such as oct-apr wraps around
+		for v, n := lo, 0; n <= (hi-lo+f.max-f.min+1)%(f.max-f.min+1); v, n = v+step, n+step {
+			if v > f.max {
+				v -= f.max - f.min + 1
+			}
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c cronExpr) matches(t time.Time) bool {
+	has := func(i, v int) bool { return c.fields[i]&(1<<uint(v)) != 0 }
+	if !has(0, t.Minute()) || !has(1, t.Hour()) || !has(3, int(t.Month())) {
+		return false
+	}
+	dom, dow := has(2, t.Day()), has(4, int(t.Weekday()))
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Active reports whether t, in its location, falls within the schedule.
+func (s Schedule) Active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	for _, c := range s {
+		if c.matches(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,665 @@
+// Package sensor accumulates the readings decoded from a sensor's
+// advertisements and reduces them to one value per field each interval.
+package sensor
+
+import (
+	"crypto/cipher"
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/markdrayton/mijiamon/pkg/output"
+)
+
+// Log receives the package's messages, e.g. about sensors going quiet.
+var Log = decode.Discard
+
+// RateLimited counts advertisements dropped by the rate limit, by sensor.
+var RateLimited = expvar.NewMap("rate_limited")
+
+// DecoderPanics counts payloads whose decoder panicked, by sensor.
+var DecoderPanics = expvar.NewMap("decoder_panics")
+
+// DecodeErrors counts payloads that yielded no readings, by sensor.
+var DecodeErrors = expvar.NewMap("decode_errors")
+
+// RejectedFrames counts payloads failing decode.Validate, by sensor.
+var RejectedFrames = expvar.NewMap("rejected_frames")
+
+// maxUnknown bounds the distinct undecodable payloads remembered per sensor.
+const maxUnknown = 100
+
+// Sensor is a configured sensor and the readings gathered from it since the
+// last Flush. The exported fields configure it and must be set before use.
+type Sensor struct {
+	Name       string
+	MAC        string
+	Model      string                      // the configured type(s)
+	Processors map[string]decode.Processor // keyed by service data UUID
+	// Detect, if set, picks the processors of a sensor configured without
+	// a type from the first service data it sends that identifies it,
+	// returning its type and processors, or nil if b doesn't.
+	Detect      func(uuid string, b []byte) (string, map[string]decode.Processor)
+	Aggregation Aggregation
+	Output      output.Profile
+	// Discard the first reading after a silence longer than this; zero
+	// disables.
+	ReappearGap time.Duration
+	// Report the sensor as stale when not heard from for this long; zero
+	// disables.
+	StaleAfter time.Duration
+	// Maximum advertisements processed per second; zero is unlimited.
+	MaxRate     float64
+	Calibration map[string]Calibration // keyed by field
+	Smoothing   map[string]Smoothing   // keyed by field; applied after calibration
+	Derived     []string               // see Derive
+	// Poll over GATT when advertisements haven't delivered a reading for
+	// this long; zero disables.
+	Poll time.Duration
+	// Set the clock of a device with one, such as the LYWSD02, over GATT
+	// this often, to the time in TimeZone; zero disables.
+	SyncTime time.Duration
+	TimeZone *time.Location
+	// How often the readings are flushed.
+	Interval time.Duration
+	// How points are timestamped: FlushTime, ReceiveTime or EachReading.
+	Timestamps string
+	// How soon after one receiver hears an advertisement the same one from
+	// another is treated as a copy; zero means DefaultDedupeWindow.
+	DedupeWindow time.Duration
+	// Estimate the days the battery has left, as battery_days_left, from
+	// its level over this long; zero disables.
+	BatteryTrend time.Duration
+	// Resolves the random private addresses the sensor advertises from, if
+	// set; see NewIRK.
+	IRK cipher.Block
+	// Fields only written when they've changed enough, keyed by field.
+	ReportOnChange map[string]ReportOnChange
+	// Bounds on the values of fields as decoded, before calibration, keyed
+	// by field.
+	Plausibility map[string]Plausibility
+	// Fields added to points lacking them from their last known value, for
+	// up to this long after it was received (indefinitely if negative),
+	// keyed by field.
+	CarryForward map[string]time.Duration
+	// When the sensor is active; outside it, its advertisements are
+	// ignored and it doesn't go stale. Nil is always.
+	Schedule Schedule
+
+	mu          sync.Mutex
+	data        map[string]*aggregate
+	lastSeen    time.Time // last decoded reading
+	lastHeard   time.Time // last advertisement of any kind
+	lastAdded   time.Time // last value added this interval
+	lastRSSI    int
+	readings    []Reading         // with EachReading
+	filters     map[string]filter // keyed by field
+	stale       bool
+	inactive    bool        // outside Schedule when last checked
+	written     decode.Data // last flushed value of each changeOnlyFields field
+	tokens      float64
+	lastAllowed time.Time
+	advCount    int
+	last        *heard // for suppressing copies heard by other receivers
+	battery     batteryTrend
+	reported    map[string]reported  // last value written of ReportOnChange fields
+	known       map[string]Known     // last value written of each field
+	plausible   map[string]plausible // last plausible value of Plausibility fields
+	restored    decode.Data          // restored fields not yet written
+	unknown     map[string]bool      // distinct undecodable payloads, by UUID and payload
+	adapters    map[string]int       // advertisements heard by each adapter
+	// the last packet processed on each UUID, for dropping repeats
+	lastPackets map[string]packet
+}
+
+type packet struct {
+	id string
+	t  time.Time
+}
+
+// The ways points can be timestamped.
+const (
+	// FlushTime stamps each interval's point with when it's flushed.
+	FlushTime = "flush"
+	// ReceiveTime stamps it with when the last advertisement in it was
+	// received.
+	ReceiveTime = "received"
+	// EachReading writes a point for every reading decoded, stamped with
+	// when it was received, rather than aggregating them.
+	EachReading = "each"
+)
+
+// CheckTimestamps returns an error if mode isn't a known timestamp mode or "".
+func CheckTimestamps(mode string) error {
+	switch mode {
+	case "", FlushTime, ReceiveTime, EachReading:
+		return nil
+	}
+	return fmt.Errorf("unknown timestamps %s, want flush, received or each", mode)
+}
+
+// Reading is a set of fields written as one point.
+type Reading struct {
+	Time   time.Time // when received, or zero for the flush time
+	Fields decode.Data
+}
+
+// New returns a sensor decoding advertisements with processors.
+func New(name string, processors map[string]decode.Processor) *Sensor {
+	return &Sensor{
+		Name:       name,
+		Processors: processors,
+		data:       make(map[string]*aggregate),
+		written:    make(decode.Data),
+		// so that a sensor never heard from goes stale too
+		lastHeard: time.Now(),
+	}
+}
+
+// DefaultDedupeWindow is the default Sensor.DedupeWindow: long enough for
+// copies forwarded by relays to arrive.
+const DefaultDedupeWindow = 2 * time.Second
+
+// heard is the advertisement last heard, whose copies from other receivers
+// are dropped. Its RSSI and receiver are only counted once no more copies
+// are expected, so that it's the strongest copy that counts.
+type heard struct {
+	id      string
+	adapter string
+	rssi    int
+	t       time.Time
+	counted bool
+}
+
+// Heard records an advertisement identified by id, as heard by adapter with
+// signal strength rssi, in place of Seen when more than one receiver could
+// hear the sensor. It reports whether the advertisement is a copy of one
+// another receiver heard, which should be dropped; a copy heard more
+// strongly replaces the original's RSSI and receiver.
+func (s *Sensor) Heard(adapter, id string, rssi int, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	window := s.DedupeWindow
+	if window == 0 {
+		window = DefaultDedupeWindow
+	}
+	if h := s.last; h != nil && h.id == id && h.adapter != adapter && now.Sub(h.t) < window {
+		if !h.counted && rssi > h.rssi {
+			h.adapter, h.rssi = adapter, rssi
+			s.lastRSSI = rssi
+		}
+		return true
+	}
+	s.countHeard()
+	s.last = &heard{id: id, adapter: adapter, rssi: rssi, t: now}
+	s.seen(rssi)
+	return false
+}
+
+// countHeard counts the RSSI and receiver of the advertisement last heard, if
+// they haven't been; s.mu must be held.
+func (s *Sensor) countHeard() {
+	h := s.last
+	if h == nil || h.counted {
+		return
+	}
+	h.counted = true
+	s.add("rssi", h.rssi)
+	if s.adapters == nil {
+		s.adapters = make(map[string]int)
+	}
+	s.adapters[h.adapter]++
+}
+
+// repeatWindow bounds how long a packet is remembered, in case a counter
+// wraps round to the same value or a payload without one legitimately
+// recurs.
+const repeatWindow = 5 * time.Minute
+
+// Repeat reports whether service data b on uuid repeats the measurement last
+// processed, as firmware like pvvx's re-sends each measurement in several
+// advertisements, and otherwise records it.
+func (s *Sensor) Repeat(uuid string, b []byte, now time.Time) bool {
+	id := decode.PacketID(uuid, b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.lastPackets[uuid]; ok && last.id == id && now.Sub(last.t) < repeatWindow {
+		return true
+	}
+	if s.lastPackets == nil {
+		s.lastPackets = make(map[string]packet)
+	}
+	s.lastPackets[uuid] = packet{id, now}
+	return false
+}
+
+// TopAdapter returns the adapter that heard the sensor most since the last
+// call, resetting the counts.
+func (s *Sensor) TopAdapter() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.countHeard()
+	var top string
+	for a, n := range s.adapters {
+		if n > s.adapters[top] || (n == s.adapters[top] && a < top) {
+			top = a
+		}
+	}
+	s.adapters = nil
+	return top
+}
+
+// Calibration corrects a sensor's readings of a field as v*Scale + Offset.
+type Calibration struct {
+	Scale  float64
+	Offset float64
+}
+
+// Apply returns the corrected value of v.
+func (c Calibration) Apply(v interface{}) interface{} {
+	if f, ok := v.(float64); ok {
+		return f*c.Scale + c.Offset
+	}
+	return v
+}
+
+// changeOnlyFields rarely change, so are only flushed when they differ from
+// the last value written.
+var changeOnlyFields = map[string]bool{
+	"device_type_id":   true,
+	"firmware_version": true,
+}
+
+// Processor returns the processor for service data b sent on uuid, if any,
+// first detecting the sensor's type from it if it's still unknown.
+func (s *Sensor) Processor(uuid string, b []byte) (decode.Processor, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Processors) == 0 && s.Detect != nil {
+		if typ, ps := s.Detect(uuid, b); ps != nil {
+			Log.Infof("%s: detected type %s from UUID %s data", s.Name, typ, uuid)
+			s.Processors = ps
+		}
+	}
+	p, ok := s.Processors[uuid]
+	return p, ok
+}
+
+// ProcessAdv decodes service data b sent on uuid, if the sensor has a
+// processor for it, returning the readings decoded or nil if there were
+// none.
+func (s *Sensor) ProcessAdv(uuid string, b []byte) decode.Data {
+	p, ok := s.Processor(uuid, b)
+	if !ok {
+		return nil
+	}
+	d := s.Decode(p, uuid, b)
+	if len(d) == 0 {
+		return nil
+	}
+	s.Record(d)
+	return d
+}
+
+// Rejects reports whether service data b sent on uuid fails decode.Validate,
+// counting and logging it if so.
+func (s *Sensor) Rejects(uuid string, b []byte) bool {
+	hw, _ := net.ParseMAC(s.MAC)
+	err := decode.Validate(uuid, b, hw)
+	if err == nil {
+		return false
+	}
+	RejectedFrames.Add(s.Name, 1)
+	Log.Debugf("%s: rejecting UUID %s data %s: %s", s.Name, uuid, decode.FormatHex(b), err)
+	return true
+}
+
+// Record adds decoded readings, however they were obtained.
+func (s *Sensor) Record(d decode.Data) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	gap := now.Sub(s.lastSeen)
+	stale := s.ReappearGap > 0 && !s.lastSeen.IsZero() && gap > s.ReappearGap
+	s.lastSeen = now
+	if stale {
+		Log.Infof("%s: discarding first reading after %s gap", s.Name, gap.Round(time.Second))
+		return
+	}
+	s.checkPlausible(d, now)
+	d = s.correct(d)
+	if s.Timestamps == EachReading {
+		r := Reading{Time: now, Fields: decode.Data{"rssi": s.lastRSSI}}
+		for k, v := range d {
+			if changeOnlyFields[k] {
+				if w, ok := s.written[k]; ok && w == v {
+					continue
+				}
+				s.written[k] = v
+			}
+			r.Fields[k] = v
+		}
+		Derive(s.Derived, r.Fields)
+		if s.reportChanges(r.Fields, now) {
+			s.readings = append(s.readings, r)
+		}
+		return
+	}
+	for k, v := range d {
+		s.add(k, v)
+	}
+}
+
+// correct returns d calibrated and smoothed; s.mu must be held.
+func (s *Sensor) correct(d decode.Data) decode.Data {
+	out := make(decode.Data, len(d))
+	for k, v := range d {
+		if c, ok := s.Calibration[k]; ok {
+			v = c.Apply(v)
+		}
+		if c, ok := s.Smoothing[k]; ok {
+			if f, ok := v.(float64); ok {
+				if c.KeepRaw {
+					out[k+"_raw"] = f
+				}
+				if s.filters == nil {
+					s.filters = make(map[string]filter)
+				}
+				if s.filters[k] == nil {
+					s.filters[k] = c.filter()
+				}
+				v = s.filters[k].add(f)
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// add records a value for field k; s.mu must be held.
+func (s *Sensor) add(k string, v interface{}) {
+	a, ok := s.data[k]
+	if !ok {
+		a = &aggregate{}
+		s.data[k] = a
+	}
+	a.add(v)
+	s.lastAdded = time.Now()
+}
+
+// Seen records an advertisement from the sensor and its signal strength.
+func (s *Sensor) Seen(rssi int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen(rssi)
+	s.add("rssi", rssi)
+}
+
+// seen records an advertisement from the sensor; s.mu must be held.
+func (s *Sensor) seen(rssi int) {
+	s.advCount++
+	s.lastHeard = time.Now()
+	s.lastRSSI = rssi
+	if s.stale {
+		Log.Infof("%s: heard from again", s.Name)
+		s.stale = false
+	}
+}
+
+// LastHeard returns when the sensor last sent an advertisement.
+func (s *Sensor) LastHeard() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastHeard
+}
+
+// LastReading returns when a reading was last recorded.
+func (s *Sensor) LastReading() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSeen
+}
+
+// Active reports whether now is within the sensor's schedule. Going stale
+// is counted from when it becomes active again, rather than from when it
+// was last heard from.
+func (s *Sensor) Active(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active(now)
+}
+
+// active is Active; s.mu must be held.
+func (s *Sensor) active(now time.Time) bool {
+	active := s.Schedule.Active(now)
+	switch {
+	case active && s.inactive:
+		Log.Infof("%s: active", s.Name)
+		s.lastHeard, s.stale = now, false
+	case !active && !s.inactive:
+		Log.Infof("%s: inactive, as scheduled", s.Name)
+	}
+	s.inactive = !active
+	return active
+}
+
+// CheckStale returns how long it's been since the sensor was heard from, and
+// whether it has just gone stale. It doesn't while inactive.
+func (s *Sensor) CheckStale(now time.Time) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.active(now) {
+		return now.Sub(s.lastHeard), false
+	}
+	age := now.Sub(s.lastHeard)
+	if s.StaleAfter <= 0 || s.stale || age < s.StaleAfter {
+		return age, false
+	}
+	s.stale = true
+	Log.Warnf("%s: not heard from for %s", s.Name, age.Round(time.Second))
+	return age, true
+}
+
+// Decode runs p, recovering from any panic so that a buggy decoder or a
+// malformed packet can't take down the collector.
+func (s *Sensor) Decode(p decode.Processor, uuid string, b []byte) (d decode.Data) {
+	defer func() {
+		if r := recover(); r != nil {
+			DecoderPanics.Add(s.Name, 1)
+			Log.Errorf("%s: decoder for UUID %s panicked on %s: %v", s.Name, uuid, decode.FormatHex(b), r)
+			d = decode.Data{}
+		}
+	}()
+	return p(b)
+}
+
+// Undecodable records that service data b sent on uuid yielded no readings,
+// reporting whether it's the first time this payload has, which is logged.
+func (s *Sensor) Undecodable(uuid string, b []byte) bool {
+	DecodeErrors.Add(s.Name, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := uuid + string(b)
+	if s.unknown[key] || len(s.unknown) >= maxUnknown {
+		return false
+	}
+	if s.unknown == nil {
+		s.unknown = make(map[string]bool)
+	}
+	s.unknown[key] = true
+	Log.Infof("%s: can't decode UUID %s data (len %d): %s", s.Name, uuid, len(b), decode.FormatHex(b))
+	return true
+}
+
+// Allow reports whether an advertisement may be processed under the rate
+// limit, using a token bucket holding up to a second's worth, or one token
+// for a rate below one a second.
+func (s *Sensor) Allow(now time.Time) bool {
+	if s.MaxRate <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	burst := math.Max(s.MaxRate, 1)
+	if s.lastAllowed.IsZero() {
+		s.tokens = burst
+	} else {
+		s.tokens += now.Sub(s.lastAllowed).Seconds() * s.MaxRate
+		if s.tokens > burst {
+			s.tokens = burst
+		}
+	}
+	s.lastAllowed = now
+	if s.tokens < 1 {
+		RateLimited.Add(s.Name, 1)
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// Readings returns the readings to write since the last call, and starts a
+// new interval: with EachReading, every reading decoded, or otherwise the
+// aggregated readings as one.
+func (s *Sensor) Readings() []Reading {
+	var ret []Reading
+	if s.Timestamps == EachReading {
+		s.mu.Lock()
+		s.countHeard()
+		ret = s.readings
+		s.readings = nil
+		s.data = make(map[string]*aggregate)
+		s.advCount = 0
+		s.mu.Unlock()
+	} else {
+		var t time.Time
+		if s.Timestamps == ReceiveTime {
+			s.mu.Lock()
+			t = s.lastAdded
+			s.mu.Unlock()
+		}
+		if d := s.Flush(); len(d) > 0 {
+			ret = []Reading{{t, d}}
+		}
+	}
+	s.trackBattery(ret)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remember(ret)
+	s.carryForward(ret)
+	return append(s.takeRestored(), ret...)
+}
+
+// trackBattery adds the battery levels in rs to the battery's history and
+// the estimate of its days left to the last reading with a level.
+func (s *Sensor) trackBattery(rs []Reading) {
+	if s.BatteryTrend <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var last decode.Data
+	for _, r := range rs {
+		var pct float64
+		switch v := r.Fields["battery_pct"].(type) {
+		case int:
+			pct = float64(v)
+		case float64:
+			pct = v
+		default:
+			continue
+		}
+		t := r.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		s.battery.add(t, pct, s.BatteryTrend)
+		last = r.Fields
+	}
+	if last == nil {
+		return
+	}
+	if days, ok := s.battery.daysLeft(); ok {
+		last["battery_days_left"] = days
+	}
+}
+
+// BatteryDaysLeft returns the estimated days the battery has left, or false
+// if there's no estimate.
+func (s *Sensor) BatteryDaysLeft() (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.BatteryTrend <= 0 {
+		return 0, false
+	}
+	return s.battery.daysLeft()
+}
+
+// Flush returns the aggregated readings since the last call and starts a new
+// interval.
+func (s *Sensor) Flush() decode.Data {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.countHeard()
+	ret := make(decode.Data)
+	for k, v := range s.Aggregation.apply(s.data) {
+		if changeOnlyFields[k] {
+			if w, ok := s.written[k]; ok && w == v {
+				continue
+			}
+			s.written[k] = v
+		}
+		ret[k] = v
+	}
+	Derive(s.Derived, ret)
+	if s.advCount > 0 {
+		ret["adv_count"] = s.advCount
+	}
+	s.data = make(map[string]*aggregate)
+	s.advCount = 0
+	if !s.reportChanges(ret, time.Now()) {
+		return decode.Data{}
+	}
+	return ret
+}
+
+// Adopt carries over the readings and state accumulated by old, which is
+// being replaced by s on reload, so the current interval isn't lost.
+func (s *Sensor) Adopt(old *Sensor) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data, s.written, s.advCount = old.data, old.written, old.advCount
+	s.lastSeen, s.tokens, s.lastAllowed = old.lastSeen, old.tokens, old.lastAllowed
+	s.lastHeard, s.stale, s.inactive = old.lastHeard, old.stale, old.inactive
+	s.lastPackets = old.lastPackets
+	s.lastAdded, s.lastRSSI = old.lastAdded, old.lastRSSI
+	s.last, s.adapters = old.last, old.adapters
+	s.battery, s.unknown = old.battery, old.unknown
+	s.known, s.restored = old.known, old.restored
+	s.plausible = old.plausible
+	for k, r := range old.reported {
+		if s.ReportOnChange[k] == old.ReportOnChange[k] {
+			if s.reported == nil {
+				s.reported = make(map[string]reported)
+			}
+			s.reported[k] = r
+		}
+	}
+	for k, f := range old.filters {
+		if s.Smoothing[k] == old.Smoothing[k] {
+			if s.filters == nil {
+				s.filters = make(map[string]filter)
+			}
+			s.filters[k] = f
+		}
+	}
+	if s.Timestamps == EachReading {
+		s.readings = old.readings
+	}
+}
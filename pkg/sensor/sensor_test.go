@@ -0,0 +1,38 @@
+package sensor
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+func TestChangeOnlyFields(t *testing.T) {
+	s := New("office", map[string]decode.Processor{"fcd2": decode.NewBTHome(nil, nil)})
+	flush := func(frame string) decode.Data {
+		b, _ := hex.DecodeString(frame)
+		if d := s.ProcessAdv("fcd2", b); d == nil {
+			t.Fatalf("device information frame %s didn't decode", frame)
+		}
+		return s.Flush()
+	}
+	// device type 1, firmware 4.4.1.0
+	d := flush("40f00100f100010404")
+	if d["firmware_version"] != "4.4.1.0" || d["device_type_id"] != 1 {
+		t.Fatalf("first flush = %v, want firmware_version 4.4.1.0 and device_type_id 1", d)
+	}
+	d = flush("40f00100f100010404")
+	for _, k := range []string{"firmware_version", "device_type_id"} {
+		if _, ok := d[k]; ok {
+			t.Errorf("unchanged %s flushed again: %v", k, d)
+		}
+	}
+	// firmware 4.5.0.0
+	d = flush("40f00100f100000504")
+	if d["firmware_version"] != "4.5.0.0" {
+		t.Errorf("after an update, flush = %v, want firmware_version 4.5.0.0", d)
+	}
+	if _, ok := d["device_type_id"]; ok {
+		t.Errorf("unchanged device_type_id flushed again: %v", d)
+	}
+}
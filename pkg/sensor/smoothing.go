@@ -0,0 +1,82 @@
+package sensor
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Smoothing configures a filter applied to each value of a field before
+// it's recorded, to damp jumpy readings such as humidity.
+type Smoothing struct {
+	Method string  // ema, median, or none to turn off smoothing set globally
+	Alpha  float64 // ema: the weight of each new value, in (0, 1]
+	Window int     // median: how many values the median is taken over
+	// Also record the unsmoothed value, as <field>_raw.
+	KeepRaw bool `toml:"keep_raw"`
+}
+
+// Check returns an error if the smoothing configuration is invalid.
+func (c Smoothing) Check() error {
+	switch c.Method {
+	case "none":
+	case "ema":
+		if c.Alpha <= 0 || c.Alpha > 1 {
+			return fmt.Errorf("ema alpha must be in (0, 1], not %g", c.Alpha)
+		}
+	case "median":
+		if c.Window < 1 {
+			return fmt.Errorf("median window must be at least 1, not %d", c.Window)
+		}
+	default:
+		return fmt.Errorf("unknown smoothing method %q, want ema, median or none", c.Method)
+	}
+	return nil
+}
+
+// filter smooths a series of values.
+type filter interface {
+	add(v float64) float64
+}
+
+func (c Smoothing) filter() filter {
+	if c.Method == "median" {
+		return &medianFilter{window: c.Window}
+	}
+	return &emaFilter{alpha: c.Alpha}
+}
+
+// emaFilter is an exponential moving average.
+type emaFilter struct {
+	alpha float64
+	v     float64
+	init  bool
+}
+
+func (f *emaFilter) add(v float64) float64 {
+	if !f.init {
+		f.v, f.init = v, true
+	} else {
+		f.v += f.alpha * (v - f.v)
+	}
+	return f.v
+}
+
+// medianFilter is the median of the last window values.
+type medianFilter struct {
+	window int
+	vals   []float64
+}
+
+func (f *medianFilter) add(v float64) float64 {
+	f.vals = append(f.vals, v)
+	if len(f.vals) > f.window {
+		f.vals = f.vals[1:]
+	}
+	sorted := append([]float64(nil), f.vals...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,133 @@
+package sensor
+
+import (
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// Known is the value of a field last written, and when.
+type Known struct {
+	Value interface{}
+	Time  time.Time
+}
+
+// unremembered fields aren't worth restoring, as they're written with every
+// point or describe how it was received.
+var unremembered = map[string]bool{
+	"rssi":      true,
+	"adv_count": true,
+	"adapter":   true,
+	"stale":     true,
+	"restored":  true,
+}
+
+// remember records the fields of rs, as returned by Readings, as known;
+// s.mu must be held.
+func (s *Sensor) remember(rs []Reading) {
+	now := time.Now()
+	for _, r := range rs {
+		t := r.Time
+		if t.IsZero() {
+			t = now
+		}
+		for k, v := range r.Fields {
+			if unremembered[k] {
+				continue
+			}
+			if s.known == nil {
+				s.known = make(map[string]Known)
+			}
+			s.known[k] = Known{v, t}
+			delete(s.restored, k)
+		}
+	}
+}
+
+// Known returns the last known value of each field.
+func (s *Sensor) Known() map[string]Known {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	known := make(map[string]Known, len(s.known))
+	for k, v := range s.known {
+		known[k] = v
+	}
+	return known
+}
+
+// Restore sets the fields' last known values, saved from an earlier run, for
+// those not known yet. They're written as an extra point, tagged
+// restored=true, with the next readings not holding them.
+func (s *Sensor) Restore(known map[string]Known) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range known {
+		if _, ok := s.known[k]; ok || unremembered[k] {
+			continue
+		}
+		if s.known == nil {
+			s.known = make(map[string]Known)
+		}
+		if s.restored == nil {
+			s.restored = make(decode.Data)
+		}
+		s.known[k] = v
+		s.restored[k] = v.Value
+	}
+}
+
+// BatteryHistory returns the battery levels its days left are estimated
+// from.
+func (s *Sensor) BatteryHistory() []BatterySample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]BatterySample(nil), s.battery.samples...)
+}
+
+// RestoreBattery sets the battery levels its days left are estimated from,
+// saved from an earlier run, if there are none yet, other than those outside
+// BatteryTrend's window.
+func (s *Sensor) RestoreBattery(samples []BatterySample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.BatteryTrend <= 0 || len(s.battery.samples) > 0 {
+		return
+	}
+	s.battery.samples = append([]BatterySample(nil), samples...)
+	s.battery.trim(time.Now(), s.BatteryTrend)
+}
+
+// carryForward adds the fields in CarryForward to the readings rs lacking
+// them, from their last known values if they're recent enough; s.mu must be
+// held.
+func (s *Sensor) carryForward(rs []Reading) {
+	now := time.Now()
+	for _, r := range rs {
+		t := r.Time
+		if t.IsZero() {
+			t = now
+		}
+		for k, maxAge := range s.CarryForward {
+			if _, ok := r.Fields[k]; ok {
+				continue
+			}
+			if v, ok := s.known[k]; ok && (maxAge < 0 || t.Sub(v.Time) <= maxAge) {
+				r.Fields[k] = v.Value
+			}
+		}
+	}
+}
+
+// takeRestored returns the point of restored fields to write, if any;
+// s.mu must be held.
+func (s *Sensor) takeRestored() []Reading {
+	if len(s.restored) == 0 {
+		return nil
+	}
+	fields := decode.Data{"restored": "true"}
+	for k, v := range s.restored {
+		fields[k] = v
+	}
+	s.restored = nil
+	return []Reading{{Fields: fields}}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches to the user called name and group, or the user's
+// own groups if group is "". It's done once the HCI sockets are open, which
+// needs root, so the daemon needn't keep running as root; but reopening a
+// wedged adapter then fails unless the user has been granted the
+// capabilities instead.
+func dropPrivileges(name, group string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("can't switch to user %s: not running as root", name)
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s: bad uid %s", name, u.Uid)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("user %s: bad gid %s", name, u.Gid)
+	}
+	var gids []int
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("group %s: bad gid %s", group, g.Gid)
+		}
+		gids = []int{gid}
+	} else {
+		ids, err := u.GroupIds()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if n, err := strconv.Atoi(id); err == nil {
+				gids = append(gids, n)
+			}
+		}
+	}
+	// the group must go first, while there's still permission to change it
+	if err := syscall.Setgroups(gids); err != nil {
+		return fmt.Errorf("setgroups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %s", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// dropPrivileges isn't supported here: only the Linux backend needs root.
+func dropPrivileges(name, group string) error {
+	return errors.New("the user setting is only supported on Linux")
+}
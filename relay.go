@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ble/ble"
+)
+
+// ingestConfig configures receiving advertisements relayed by other
+// receivers, such as ESPHome nodes or mijiamon instances in relay mode, to be
+// decoded as though heard by a local adapter.
+type ingestConfig struct {
+	Listen    string // HTTP address; advertisements are POSTed to /advertisements
+	UDP       string // UDP address; one advertisement per datagram
+	Token     string // required of relays
+	TokenFile string `toml:"token_file"` // read Token from here
+}
+
+// relayedAdv is an advertisement as relayed, in JSON.
+type relayedAdv struct {
+	MAC  string `json:"mac"`
+	RSSI int    `json:"rssi"`
+	// hex, optionally space-separated, by service data UUID
+	ServiceData map[string]string `json:"service_data"`
+	// when the relay heard it, if known; more than the interval before or
+	// after now and it's dropped
+	Time time.Time `json:"time"`
+	// the relay's name, used in place of the adapter's; defaults to its
+	// address
+	Receiver string `json:"receiver,omitempty"`
+	Token    string `json:"token,omitempty"` // UDP only; HTTP uses a bearer token
+}
+
+// advertisement is a relayed advertisement to be handled in the same way as
+// one heard locally.
+type advertisement struct {
+	addr ble.Addr
+	rssi int
+	sd   []ble.ServiceData
+}
+
+func (a advertisement) LocalName() string              { return "" }
+func (a advertisement) ManufacturerData() []byte       { return nil }
+func (a advertisement) ServiceData() []ble.ServiceData { return a.sd }
+func (a advertisement) Services() []ble.UUID           { return nil }
+func (a advertisement) OverflowService() []ble.UUID    { return nil }
+func (a advertisement) TxPowerLevel() int              { return 0 }
+func (a advertisement) Connectable() bool              { return false }
+func (a advertisement) SolicitedService() []ble.UUID   { return nil }
+func (a advertisement) RSSI() int                      { return a.rssi }
+func (a advertisement) Addr() ble.Addr                 { return a.addr }
+
+func (r relayedAdv) advertisement() (advertisement, error) {
+	if hw, err := net.ParseMAC(r.MAC); err != nil || len(hw) != 6 {
+		return advertisement{}, fmt.Errorf("bad MAC address %q", r.MAC)
+	}
+	a := advertisement{addr: ble.NewAddr(r.MAC), rssi: r.RSSI}
+	for u, h := range r.ServiceData {
+		uuid, err := ble.Parse(u)
+		if err != nil {
+			return advertisement{}, fmt.Errorf("bad service data UUID %q", u)
+		}
+		b, err := hex.DecodeString(strings.Replace(h, " ", "", -1))
+		if err != nil {
+			return advertisement{}, fmt.Errorf("bad service data for %s: %s", u, err)
+		}
+		a.sd = append(a.sd, ble.ServiceData{UUID: uuid, Data: b})
+	}
+	return a, nil
+}
+
+// ingest handles an advertisement relayed from the host at addr.
+func (c *collector) ingest(r relayedAdv, addr string) error {
+	a, err := r.advertisement()
+	if err != nil {
+		return err
+	}
+	if !r.Time.IsZero() {
+		if age := time.Since(r.Time); age > c.interval {
+			advsDropped.WithLabelValues("late").Inc()
+			return nil
+		} else if age < -c.interval {
+			advsDropped.WithLabelValues("future").Inc()
+			return nil
+		}
+	}
+	receiver := r.Receiver
+	if receiver == "" {
+		receiver = addr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			receiver = host
+		}
+	}
+	advsRelayed.WithLabelValues(receiver).Inc()
+	if !c.captureFails {
+		c.captureAdv(a)
+	}
+	if c.advFilter(a) {
+		c.advHandler(receiver, a)
+	}
+	return nil
+}
+
+// ingestMaxBody is the most a request to the HTTP listener can send, enough
+// for several times relayBatch advertisements.
+const ingestMaxBody = 1 << 20
+
+// serveIngest receives relayed advertisements over HTTP, one or more JSON
+// objects per request.
+func (c *collector) serveIngest(conf ingestConfig) error {
+	want := []byte("Bearer " + conf.Token)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/advertisements", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST advertisements", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, ingestMaxBody))
+		for {
+			var adv relayedAdv
+			err := dec.Decode(&adv)
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				err = c.ingest(adv, r.RemoteAddr)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return http.ListenAndServe(conf.Listen, mux)
+}
+
+// serveIngestUDP receives relayed advertisements over UDP, a JSON object per
+// datagram, until ctx is cancelled.
+func (c *collector) serveIngestUDP(ctx context.Context, conf ingestConfig) error {
+	pc, err := net.ListenPacket("udp", conf.UDP)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		var adv relayedAdv
+		if err := json.Unmarshal(buf[:n], &adv); err != nil {
+			mainLog.Debugf("ingest: %s: %s", addr, err)
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(adv.Token), []byte(conf.Token)) != 1 {
+			mainLog.Debugf("ingest: %s: bad token", addr)
+			continue
+		}
+		if err := c.ingest(adv, addr.String()); err != nil {
+			mainLog.Debugf("ingest: %s: %s", addr, err)
+		}
+	}
+}
+
+// relayConfig configures relay mode, in which advertisements from the
+// configured sensors are forwarded to another mijiamon's [ingest] rather than
+// decoded and written here.
+type relayConfig struct {
+	URL       string // POST advertisements here, e.g. http://central:8760/advertisements
+	UDP       string // or send them to this address
+	Token     string
+	TokenFile string `toml:"token_file"` // read Token from here
+	Receiver  string // this relay's name; defaults to the hostname
+}
+
+func (conf relayConfig) enabled() bool {
+	return conf.URL != "" || conf.UDP != ""
+}
+
+const (
+	relayQueue = 1000 // advertisements awaiting forwarding
+	relayBatch = 100  // most advertisements per POST
+	// how long to wait for more advertisements, to batch them, before a
+	// POST
+	relayLinger = time.Second
+)
+
+// relayer forwards advertisements to an [ingest] listener. Those that can't
+// be sent are dropped: they'd be too late to be useful by the time they
+// could be resent.
+type relayer struct {
+	conf   relayConfig
+	client *http.Client
+	queue  chan relayedAdv
+}
+
+func newRelayer(conf relayConfig) (*relayer, error) {
+	if conf.URL != "" && conf.UDP != "" {
+		return nil, fmt.Errorf("only one of url and udp can be set")
+	}
+	if conf.Receiver == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		conf.Receiver = host
+	}
+	return &relayer{
+		conf:   conf,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan relayedAdv, relayQueue),
+	}, nil
+}
+
+// forward queues a for forwarding.
+func (r *relayer) forward(a ble.Advertisement) {
+	adv := relayedAdv{
+		MAC:         a.Addr().String(),
+		RSSI:        a.RSSI(),
+		ServiceData: make(map[string]string),
+		Time:        time.Now(),
+		Receiver:    r.conf.Receiver,
+	}
+	for _, sd := range a.ServiceData() {
+		adv.ServiceData[sd.UUID.String()] = hex.EncodeToString(sd.Data)
+	}
+	select {
+	case r.queue <- adv:
+	default:
+		advsDropped.WithLabelValues("relay_queue_full").Inc()
+	}
+}
+
+// run forwards queued advertisements until ctx is cancelled.
+func (r *relayer) run(ctx context.Context) {
+	if r.conf.UDP != "" {
+		r.runUDP(ctx)
+		return
+	}
+	for {
+		var batch []relayedAdv
+		select {
+		case adv := <-r.queue:
+			batch = append(batch, adv)
+		case <-ctx.Done():
+			return
+		}
+		linger := time.NewTimer(relayLinger)
+	collect:
+		for len(batch) < relayBatch {
+			select {
+			case adv := <-r.queue:
+				batch = append(batch, adv)
+			case <-linger.C:
+				break collect
+			case <-ctx.Done():
+				break collect
+			}
+		}
+		linger.Stop()
+		if err := r.post(ctx, batch); err != nil {
+			mainLog.Warnf("relay: dropping %d advertisements: %s", len(batch), err)
+		}
+	}
+}
+
+func (r *relayer) post(ctx context.Context, batch []relayedAdv) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, adv := range batch {
+		if err := enc.Encode(adv); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, r.conf.URL, &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if r.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.conf.Token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (r *relayer) runUDP(ctx context.Context) {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		select {
+		case adv := <-r.queue:
+			adv.Token = r.conf.Token
+			b, err := json.Marshal(adv)
+			if err != nil {
+				continue
+			}
+			if conn == nil {
+				if conn, err = net.Dial("udp", r.conf.UDP); err != nil {
+					mainLog.Warnf("relay: dropping advertisement: %s", err)
+					conn = nil
+					continue
+				}
+			}
+			if _, err := conn.Write(b); err != nil {
+				mainLog.Warnf("relay: dropping advertisement: %s", err)
+				conn.Close()
+				conn = nil
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
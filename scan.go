@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux/hci/cmd"
+)
+
+// scanConfig configures how an adapter scans. The [scan] table configures
+// every adapter, and [scan.adapter.hciN] overrides it for one.
+type scanConfig struct {
+	// Listen for advertisements without sending scan requests. The
+	// sensors put everything in their advertisements, so the scan
+	// responses active scanning asks for only cost them battery.
+	Passive *bool
+	// How often the adapter starts listening on the next advertising
+	// channel, and for how long; between 2.5ms and 10.24s, with the window
+	// no longer than the interval. Both default to 2.5ms, i.e. listening
+	// continuously. A shorter window leaves the radio free for WiFi on
+	// combined chips, such as the Raspberry Pi's, at the cost of missing
+	// advertisements.
+	Interval *duration
+	Window   *duration
+	// Report every advertisement rather than having the controller drop
+	// repeats; defaults to true. Many controllers drop everything after a
+	// device's first advertisement, so disabling this can stop readings.
+	AllowDuplicates *bool `toml:"allow_duplicates"`
+}
+
+// scanSettings are an adapter's resolved scan settings.
+type scanSettings struct {
+	passive         bool
+	interval        time.Duration
+	window          time.Duration
+	allowDuplicates bool
+}
+
+// scanUnit is the unit of the HCI scan interval and window.
+const scanUnit = 625 * time.Microsecond
+
+var defaultScan = scanSettings{
+	interval:        4 * scanUnit, // go-ble's defaults
+	window:          4 * scanUnit,
+	allowDuplicates: true,
+}
+
+// scanSettings returns the scan settings for the adapter called name.
+func (conf *Config) scanSettings(name string) (scanSettings, error) {
+	s := defaultScan
+	for _, c := range []scanConfig{conf.Scan.scanConfig, conf.Scan.Adapter[name]} {
+		if c.Passive != nil {
+			s.passive = *c.Passive
+		}
+		if c.Interval != nil {
+			s.interval = c.Interval.Duration
+		}
+		if c.Window != nil {
+			s.window = c.Window.Duration
+		}
+		if c.AllowDuplicates != nil {
+			s.allowDuplicates = *c.AllowDuplicates
+		}
+	}
+	if passiveScan {
+		s.passive = true
+	}
+	for _, d := range []time.Duration{s.interval, s.window} {
+		if d < 4*scanUnit || d > 0x4000*scanUnit {
+			return s, fmt.Errorf("%s: scan interval and window must be between %s and %s", name, 4*scanUnit, 0x4000*scanUnit)
+		}
+	}
+	if s.window > s.interval {
+		return s, fmt.Errorf("%s: scan window %s is longer than the interval %s", name, s.window, s.interval)
+	}
+	return s, nil
+}
+
+// options returns the device options applying s. Only the Linux backend
+// honours them; CoreBluetooth chooses its own scan parameters.
+func (s scanSettings) options() []ble.Option {
+	params := cmd.LESetScanParameters{
+		LEScanType:     0x01, // active
+		LEScanInterval: uint16(s.interval / scanUnit),
+		LEScanWindow:   uint16(s.window / scanUnit),
+	}
+	if s.passive {
+		params.LEScanType = 0x00
+	}
+	return []ble.Option{ble.OptScanParams(params)}
+}
+
+// checkScan returns an error if the scan settings of any adapter are
+// invalid, or [scan.adapter] configures one that isn't in use.
+func checkScan(conf *Config) error {
+	ids := conf.Adapters
+	if len(ids) == 0 {
+		ids = []int{0}
+	}
+	used := make(map[string]bool)
+	for _, id := range ids {
+		name := fmt.Sprintf("hci%d", id)
+		used[name] = true
+		if _, err := conf.scanSettings(name); err != nil {
+			return err
+		}
+	}
+	for name := range conf.Scan.Adapter {
+		if !used[name] {
+			return fmt.Errorf("adapter %s isn't configured", name)
+		}
+	}
+	return nil
+}
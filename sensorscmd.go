@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/markdrayton/mijiamon/pkg/sensor"
+)
+
+var (
+	sensorsURL     string
+	sensorsToken   string
+	sensorsWrite   bool
+	sensorsMAC     string
+	sensorsName    string
+	sensorsType    string
+	sensorsBindkey string
+	sensorsTags    string
+)
+
+func sensorsFlags(fs *flag.FlagSet) {
+	configFlags(fs)
+	fs.StringVar(&sensorsURL, "url", "", "the daemon's control API, e.g. http://localhost:8081; defaults to [api] listen")
+	fs.StringVar(&sensorsToken, "token", "", "the control API's token; defaults to [api] token")
+	fs.BoolVar(&sensorsWrite, "write", true, "also write the sensor to the sensors directory, so it's kept across restarts")
+	fs.StringVar(&sensorsMAC, "mac", "", "the sensor's MAC address")
+	fs.StringVar(&sensorsName, "name", "", "the sensor's name; from name_template if unset")
+	fs.StringVar(&sensorsType, "type", "", "the sensor's type, e.g. LYWSD03MMC")
+	fs.StringVar(&sensorsBindkey, "bindkey", "", "the sensor's bindkey, for encrypted advertisements")
+	fs.StringVar(&sensorsTags, "tags", "", "the sensor's tags, e.g. room=kitchen,floor=1")
+}
+
+// runSensors runs mijiamon sensors <action>, where the only action is add.
+// Its flags follow the action, so args are parsed again with fs.
+func runSensors(fs *flag.FlagSet, args []string) int {
+	if len(args) == 0 || args[0] != "add" {
+		fmt.Fprintf(os.Stderr, "usage: mijiamon sensors add -mac <MAC address> [-name <name>] [-type <type>] [flags]\n")
+		return 2
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "mijiamon sensors add: unexpected argument %s\n", fs.Arg(0))
+		return 2
+	}
+	if err := runSensorsAdd(); err != nil {
+		mainLog.Errorf("%s", err)
+		return 1
+	}
+	return 0
+}
+
+// runSensorsAdd adds the sensor the flags describe, checked against the
+// config, writing it to the sensors directory for the daemon to read on its
+// next reload or start and, with the control API configured, adding it to
+// the running daemon straight away.
+func runSensorsAdd() error {
+	var (
+		conf *Config
+		err  error
+		base string // the config file's directory
+	)
+	if envMode {
+		conf, err = loadEnvConfig()
+	} else {
+		conf, err = loadConfig(configFile)
+		base = filepath.Dir(configFile)
+	}
+	if err != nil {
+		return err
+	}
+	if sensorsMAC == "" {
+		return fmt.Errorf("-mac is required")
+	}
+	sc := sensorConfig{Mac: strings.ToLower(sensorsMAC), Name: sensorsName, Type: sensorsType, Bindkey: sensorsBindkey}
+	if sensorsTags != "" {
+		sc.Tags = make(map[string]string)
+		for _, kv := range strings.Split(sensorsTags, ",") {
+			i := strings.Index(kv, "=")
+			if i <= 0 {
+				return fmt.Errorf("bad tag %q, want key=value", kv)
+			}
+			sc.Tags[kv[:i]] = kv[i+1:]
+		}
+	}
+	if sc.Name == "" {
+		if sc.Name, err = sensorName(conf, sc); err != nil {
+			return err
+		}
+	}
+	// checked as the daemon would, alongside the configured sensors
+	conf.Sensors = append(conf.Sensors, sc)
+	if err := checkNewSensor(conf); err != nil {
+		return err
+	}
+
+	url, token := sensorsURL, sensorsToken
+	if url == "" && conf.API.Listen != "" {
+		url = apiURL(conf.API.Listen)
+	}
+	if token == "" {
+		token = conf.API.Token
+	}
+	if url == "" && !sensorsWrite {
+		return fmt.Errorf("nothing to add the sensor to: no [api] configured or -url given, and -write=false")
+	}
+	if sensorsWrite {
+		if base == "" && conf.SensorsDir == "" {
+			return fmt.Errorf("no sensors directory to write to with -env: set sensors_dir, or use -write=false")
+		}
+		path, err := writeSensorFile(conf, base, sc)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("wrote %s\n", path)
+	}
+	if url == "" {
+		fmt.Printf("reload mijiamon with SIGHUP to start collecting from %s\n", sc.Name)
+		return nil
+	}
+	s, err := postSensor(url, token, sc)
+	if err != nil {
+		if sensorsWrite {
+			return fmt.Errorf("adding %s to the daemon: %s; it will be read on the next reload", sc.Name, err)
+		}
+		return fmt.Errorf("adding %s to the daemon: %s", sc.Name, err)
+	}
+	fmt.Printf("added %s (%s)\n", s.Name, s.MAC)
+	return nil
+}
+
+// checkNewSensor returns the first problem with the last of conf's sensors,
+// the one being added, ignoring any with the rest of the config, which
+// aren't for sensors add to fix.
+func checkNewSensor(conf *Config) error {
+	i := len(conf.Sensors) - 1
+	where := fmt.Sprintf("sensors[%d]", i)
+	for _, p := range validate(conf) {
+		if strings.HasPrefix(p, where+":") || strings.HasPrefix(p, where+" (") {
+			return fmt.Errorf("%s", p)
+		}
+	}
+	// validate leaves the remaining settings, e.g. the bindkey, unchecked if
+	// there are other problems
+	agg, err := sensor.NewAggregation(conf.Aggregate, conf.Aggregates, conf.Extremes)
+	if err != nil {
+		return nil
+	}
+	_, err = newSensor(conf, conf.Sensors[i], agg)
+	return err
+}
+
+// apiURL returns the URL of the control API listening on addr, connecting
+// locally when it listens on every interface.
+func apiURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// writeSensorFile writes sc to a file of its own, named after it, in the
+// sensors directory, creating the directory if need be, and returns the
+// file's path.
+func writeSensorFile(conf *Config, base string, sc sensorConfig) (string, error) {
+	dir := conf.SensorsDir
+	if dir == "" {
+		dir = defaultSensorsDir
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(base, dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	file := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, strings.TrimLeft(sc.Name, "."))
+	path := filepath.Join(dir, file+".toml")
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%s already exists", path)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Added by mijiamon sensors add on %s.\n", time.Now().Format("2006-01-02"))
+	if err := toml.NewEncoder(&buf).Encode(map[string]interface{}{"sensors": []map[string]interface{}{sensorEntry(sc)}}); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	// it can hold the bindkey
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// sensorEntry returns the settings of sc the flags can set, with the keys
+// of a [[sensors]] entry.
+func sensorEntry(sc sensorConfig) map[string]interface{} {
+	entry := map[string]interface{}{"mac": sc.Mac, "name": sc.Name}
+	if sc.Type != "" {
+		entry["type"] = sc.Type
+	}
+	if sc.Bindkey != "" {
+		entry["bindkey"] = sc.Bindkey
+	}
+	if len(sc.Tags) > 0 {
+		entry["tags"] = sc.Tags
+	}
+	return entry
+}
+
+// postSensor adds sc to the daemon through the control API at url.
+func postSensor(url, token string, sc sensorConfig) (apiSensor, error) {
+	b, err := json.Marshal(sensorEntry(sc))
+	if err != nil {
+		return apiSensor{}, err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(url, "/")+"/v1/sensors", bytes.NewReader(b))
+	if err != nil {
+		return apiSensor{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return apiSensor{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return apiSensor{}, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var s apiSensor
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return apiSensor{}, err
+	}
+	return s, nil
+}
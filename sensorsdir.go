@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// defaultSensorsDir is where sensor files are read from, next to the config
+// file, if sensors_dir isn't set.
+const defaultSensorsDir = "sensors.d"
+
+// loadSensorsDir adds the sensors defined by the files in the sensors
+// directory to conf, in the order of their names, after those of the config
+// file itself. base is the directory of the config file, which a relative
+// sensors_dir is taken from, or "" in -env mode, where there's no default
+// directory. Each file holds [[sensors]] entries in TOML, or a sensors list
+// in YAML or JSON, and nothing else; files with other extensions, such as
+// editors' backups, are ignored.
+func loadSensorsDir(conf *Config, base string) error {
+	dir, defaulted := conf.SensorsDir, false
+	if dir == "" {
+		if base == "" {
+			return nil
+		}
+		dir, defaulted = defaultSensorsDir, true
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(base, dir)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if defaulted && os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("sensors_dir: %s", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".toml", ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		path := filepath.Join(dir, name)
+		sensors, err := decodeSensorsFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		conf.Sensors = append(conf.Sensors, sensors...)
+	}
+	return nil
+}
+
+// decodeSensorsFile returns the sensors defined in the file at path. Unlike
+// in the config file, an unknown setting is an error in any format.
+func decodeSensorsFile(path string) ([]sensorConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = expandEnv(b); err != nil {
+		return nil, err
+	}
+	var f struct {
+		Sensors []sensorConfig
+	}
+	switch configFormat(path) {
+	case "json":
+		err = decodeJSONConfig(b, &f)
+	case "yaml":
+		err = decodeYAMLConfig(b, &f)
+	default:
+		var meta toml.MetaData
+		if meta, err = toml.Decode(string(b), &f); err == nil {
+			if keys := meta.Undecoded(); len(keys) > 0 {
+				err = fmt.Errorf("unknown setting %s", keys[0])
+			}
+		}
+	}
+	return f.Sensors, err
+}
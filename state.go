@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/sensor"
+)
+
+// savedField is a field's last known value in the state file. JSON doesn't
+// distinguish integers, which InfluxDB does, so they're marked.
+type savedField struct {
+	Value interface{} `json:"value"`
+	Int   bool        `json:"int,omitempty"`
+	Time  time.Time   `json:"time"`
+}
+
+// savedSensor is a sensor's entry in the state file: its fields' last known
+// values and the battery levels its days left are estimated from. Files
+// written before the battery levels were saved hold only the fields, as the
+// entry itself.
+type savedSensor struct {
+	Fields  map[string]savedField `json:"fields"`
+	Battery []savedBattery        `json:"battery,omitempty"`
+}
+
+// savedBattery is a battery level in the state file.
+type savedBattery struct {
+	Time time.Time `json:"time"`
+	Pct  float64   `json:"pct"`
+}
+
+// restoreState restores each sensor's last known values and battery levels
+// from the state file at path, other than values older than maxAge if it's
+// positive. A missing file isn't an error, as there's none before the first
+// flush.
+func restoreState(path string, maxAge time.Duration, sensors map[string]*sensor.Sensor) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved map[string]json.RawMessage
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+	n := 0
+	for mac, raw := range saved {
+		s, ok := sensors[mac]
+		if !ok {
+			continue
+		}
+		var ss savedSensor
+		if err := json.Unmarshal(raw, &ss); err != nil {
+			return err
+		}
+		if ss.Fields == nil && ss.Battery == nil {
+			if err := json.Unmarshal(raw, &ss.Fields); err != nil {
+				return err
+			}
+		}
+		known := make(map[string]sensor.Known)
+		for k, f := range ss.Fields {
+			if maxAge > 0 && time.Since(f.Time) > maxAge {
+				continue
+			}
+			v := f.Value
+			if n, ok := v.(float64); ok && f.Int {
+				v = int(n)
+			}
+			known[k] = sensor.Known{Value: v, Time: f.Time}
+		}
+		s.Restore(known)
+		n += len(known)
+		if len(ss.Battery) > 0 {
+			samples := make([]sensor.BatterySample, len(ss.Battery))
+			for i, b := range ss.Battery {
+				samples[i] = sensor.BatterySample{Time: b.Time, Pct: b.Pct}
+			}
+			s.RestoreBattery(samples)
+		}
+	}
+	mainLog.Infof("state: restored %d values from %s", n, path)
+	return nil
+}
+
+// saveState writes the sensors' last known values and battery levels to the
+// state file at path, replacing it atomically.
+func saveState(path string, sensors map[string]*sensor.Sensor) error {
+	saved := make(map[string]savedSensor, len(sensors))
+	for mac, s := range sensors {
+		ss := savedSensor{Fields: make(map[string]savedField)}
+		for k, v := range s.Known() {
+			_, isInt := v.Value.(int)
+			ss.Fields[k] = savedField{v.Value, isInt, v.Time}
+		}
+		for _, b := range s.BatteryHistory() {
+			ss.Battery = append(ss.Battery, savedBattery{b.Time, b.Pct})
+		}
+		if len(ss.Fields) > 0 || len(ss.Battery) > 0 {
+			saved[mac] = ss
+		}
+	}
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
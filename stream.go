@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+)
+
+// streamEvent is a decoded advertisement as sent on /stream.
+type streamEvent struct {
+	Time    time.Time   `json:"time"`
+	Name    string      `json:"name"`
+	MAC     string      `json:"mac"`
+	Adapter string      `json:"adapter"`
+	UUID    string      `json:"uuid"`
+	RSSI    int         `json:"rssi"`
+	Fields  decode.Data `json:"fields"`
+}
+
+// streamer sends each decoded advertisement to the clients of /stream as
+// Server-Sent Events. Events for a client that isn't keeping up are dropped.
+type streamer struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+}
+
+func newStreamer() *streamer {
+	return &streamer{clients: make(map[chan []byte]struct{})}
+}
+
+func (st *streamer) publish(e streamEvent) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.clients) == 0 {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		mainLog.Warnf("stream: %s", err)
+		return
+	}
+	for ch := range st.clients {
+		select {
+		case ch <- b:
+		default:
+		}
+	}
+}
+
+func (st *streamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan []byte, 64)
+	st.mu.Lock()
+	st.clients[ch] = struct{}{}
+	st.mu.Unlock()
+	defer func() {
+		st.mu.Lock()
+		delete(st.clients, ch)
+		st.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	// a comment every so often stops proxies timing out an idle stream
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case b := <-ch:
+			if _, err := fmt.Fprintf(w, "event: reading\ndata: %s\n\n", b); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		f.Flush()
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/signal"
+)
+
+// telegrafTriggers asks for a flush on each line read from r and on each
+// SIGUSR1 or SIGUSR2, the ways a Telegraf execd input with signal set to
+// STDIN, SIGUSR1 or SIGUSR2 asks for a collection. Telegraf closing r means
+// it's stopping, so cancel is called.
+func (c *collector) telegrafTriggers(ctx context.Context, cancel context.CancelFunc, r io.Reader) {
+	sigs := make(chan os.Signal, 1)
+	if len(telegrafSignals) > 0 {
+		signal.Notify(sigs, telegrafSignals...)
+		defer signal.Stop(sigs)
+	}
+	lines := make(chan struct{})
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			select {
+			case lines <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		close(lines)
+	}()
+	for {
+		select {
+		case _, ok := <-lines:
+			if !ok {
+				mainLog.Infof("telegraf: stdin closed, shutting down")
+				cancel()
+				return
+			}
+		case <-sigs:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case c.trigger <- struct{}{}:
+		default: // a flush is already pending
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// telegrafSignals are the signals a Telegraf execd input can be set to send.
+var telegrafSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2}
@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// telegrafSignals is empty, as Windows has no SIGUSR1 or SIGUSR2; Telegraf
+// there can signal on stdin.
+var telegrafSignals []os.Signal
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics about the daemon itself, served alongside the readings when the
+// exporter is enabled.
+var (
+	advsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mijiamon_advertisements_received_total",
+		Help: "Advertisements received from configured sensors.",
+	})
+	advsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mijiamon_advertisements_dropped_total",
+		Help: "Advertisements dropped before decoding, by reason.",
+	}, []string{"reason"})
+	advsRelayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mijiamon_advertisements_relayed_total",
+		Help: "Advertisements received from relays, by receiver.",
+	}, []string{"receiver"})
+	payloadsDecoded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mijiamon_payloads_decoded_total",
+		Help: "Service data payloads that yielded readings.",
+	})
+	payloadsUndecoded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mijiamon_payloads_undecoded_total",
+		Help: "Service data payloads with a decoder that yielded no readings, including those whose decoder panicked.",
+	})
+	writes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mijiamon_writes_total",
+		Help: "Readings written, by output and result.",
+	}, []string{"output", "result"})
+	writeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mijiamon_write_duration_seconds",
+		Help:    "Time taken to write a reading, by output.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"output"})
+	queueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mijiamon_output_queue_length",
+		Help: "Writes queued for each output.",
+	}, []string{"output"})
+	queueDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mijiamon_output_queue_dropped_total",
+		Help: "Writes dropped because an output's queue was full, by output.",
+	}, []string{"output"})
+	flushDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mijiamon_flush_duration_seconds",
+		Help:    "Time taken to flush and write every sensor's readings.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+)
+
+var telemetry = []prometheus.Collector{
+	advsReceived, advsDropped, advsRelayed, payloadsDecoded, payloadsUndecoded,
+	writes, writeDuration, queueLength, queueDropped, flushDuration,
+}
+
+// observeWrite records the outcome of writing a reading to an output.
+func observeWrite(output string, d time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	writes.WithLabelValues(output, result).Inc()
+	writeDuration.WithLabelValues(output).Observe(d.Seconds())
+}
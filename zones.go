@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/markdrayton/mijiamon/pkg/decode"
+	"github.com/markdrayton/mijiamon/pkg/output"
+	"github.com/markdrayton/mijiamon/pkg/sensor"
+)
+
+// zoneConfig configures a zone, in a [[zones]] entry: a room, say, whose
+// sensors' readings are combined into one series.
+type zoneConfig struct {
+	OutputConfig
+	Name    string
+	Sensors []string // the members, by name
+	Fields  []string // defaults to temperature and humidity
+}
+
+// zone is a group of sensors for which a point of each field's mean, minimum
+// and maximum across them is written whenever they're flushed.
+type zone struct {
+	name    string
+	members []string
+	fields  []string
+	profile output.Profile
+}
+
+// newZones returns the zones configured, given the sensors.
+func newZones(conf *Config, sensors map[string]*sensor.Sensor) ([]*zone, error) {
+	names := make(map[string]bool)
+	for _, s := range sensors {
+		names[s.Name] = true
+	}
+	_, disabled := disabledSensors(conf)
+	zones := make([]*zone, 0, len(conf.Zones))
+	seen := make(map[string]bool)
+	for _, zc := range conf.Zones {
+		if zc.Name == "" {
+			return nil, fmt.Errorf("zone with sensors %v: no name configured", zc.Sensors)
+		}
+		if names[zc.Name] || disabled[zc.Name] || seen[zc.Name] {
+			return nil, fmt.Errorf("zone %s: name is already used by a sensor or zone", zc.Name)
+		}
+		seen[zc.Name] = true
+		if len(zc.Sensors) == 0 {
+			return nil, fmt.Errorf("zone %s: no sensors configured", zc.Name)
+		}
+		var members []string
+		for _, m := range zc.Sensors {
+			if !names[m] && !disabled[m] {
+				return nil, fmt.Errorf("zone %s: no sensor %s configured", zc.Name, m)
+			}
+			if !disabled[m] {
+				members = append(members, m)
+			}
+		}
+		z := &zone{name: zc.Name, members: members, fields: zc.Fields}
+		if len(z.fields) == 0 {
+			z.fields = []string{"temperature", "humidity"}
+		}
+		var err error
+		if z.profile, err = output.Resolve(conf.OutputConfig, zc.OutputConfig); err != nil {
+			return nil, fmt.Errorf("zone %s: %s", zc.Name, err)
+		}
+		if z.profile.Bucket == "" {
+			z.profile.Bucket = conf.Database.defaultBucket()
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+// has reports whether the sensor called name is one of z's members.
+func (z *zone) has(name string) bool {
+	for _, m := range z.members {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneMember is what a zone's point is aggregated from for one of its
+// members.
+type zoneMember struct {
+	known       map[string]sensor.Known // each field's last value written
+	lastReading time.Time               // when a reading was last recorded
+	interval    time.Duration
+}
+
+// newZoneMember returns s as a member of a zone, as of its last flush.
+func newZoneMember(s *sensor.Sensor) zoneMember {
+	return zoneMember{s.Known(), s.LastReading(), s.Interval}
+}
+
+// aggregate returns the fields of z's point from its members' last known
+// values, which report_on_change doesn't hold back, skipping members with no
+// reading in two of their intervals, or nil if there's nothing to write.
+func (z *zone) aggregate(members map[string]zoneMember, now time.Time) decode.Data {
+	fields := make(decode.Data)
+	sensors := 0
+	for _, f := range z.fields {
+		var sum, min, max float64
+		n := 0
+		for _, m := range z.members {
+			zm, ok := members[m]
+			if !ok || now.Sub(zm.lastReading) > 2*zm.interval {
+				continue
+			}
+			k, ok := zm.known[f]
+			if !ok {
+				continue
+			}
+			v, ok := numericField(k.Value)
+			if !ok {
+				continue
+			}
+			if n == 0 || v < min {
+				min = v
+			}
+			if n == 0 || v > max {
+				max = v
+			}
+			sum += v
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		fields[f] = math.Round(sum/float64(n)*100) / 100
+		fields[f+"_min"] = min
+		fields[f+"_max"] = max
+		if n > sensors {
+			sensors = n
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	fields["sensors"] = sensors
+	return fields
+}